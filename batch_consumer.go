@@ -3,3 +3,56 @@ package rmq
 type BatchConsumer interface {
 	Consume(batch Deliveries)
 }
+
+// FlushAwareBatchConsumer can be implemented by batch consumers which want to
+// know why a batch was flushed. If implemented, ConsumeBatch gets called
+// instead of Consume
+type FlushAwareBatchConsumer interface {
+	BatchConsumer
+	ConsumeBatch(batch Batch)
+}
+
+// ProgressBatchConsumer can be implemented by batch consumers which report
+// which deliveries of a batch they processed. If implemented, ConsumeProgress
+// gets called instead of Consume and must not ack or reject any deliveries.
+// The deliveries at the returned indices get acked, all others get nacked, so
+// they are returned to the ready list and get consumed again
+type ProgressBatchConsumer interface {
+	BatchConsumer
+	ConsumeProgress(batch Deliveries) (processed []int)
+}
+
+// settleProgress acks the processed deliveries of the batch and nacks the others
+func settleProgress(batch Deliveries, processed []int) {
+	done := make([]bool, len(batch))
+	for _, i := range processed {
+		if i >= 0 && i < len(batch) {
+			done[i] = true
+		}
+	}
+
+	for i, delivery := range batch {
+		if done[i] {
+			delivery.Ack()
+		} else {
+			delivery.Nack()
+		}
+	}
+}
+
+// Batch is a batch of deliveries passed to a FlushAwareBatchConsumer
+type Batch struct {
+	deliveries       Deliveries
+	flushedByTimeout bool
+}
+
+// Deliveries returns the deliveries of the batch
+func (batch Batch) Deliveries() Deliveries {
+	return batch.deliveries
+}
+
+// FlushedByTimeout returns true if the batch was flushed because the batch
+// timeout passed, false if it was flushed because it was full
+func (batch Batch) FlushedByTimeout() bool {
+	return batch.flushedByTimeout
+}
@@ -0,0 +1,123 @@
+package rmq
+
+import (
+	"sync"
+	"time"
+)
+
+// BatchPublisher buffers published payloads and publishes them to its queue
+// in batches, either once maxBatch payloads are buffered or maxLatency after
+// the first payload of a batch got buffered, whatever happens first
+type BatchPublisher struct {
+	queue        Queue
+	maxBatch     int
+	maxLatency   time.Duration
+	errorHandler func(payloads []string, err error)
+
+	mutex  sync.Mutex
+	buffer []string
+	timer  *time.Timer // nil while the buffer is empty
+	batch  uint64      // bumped by each flush, so timers of flushed batches don't flush the next one
+	closed bool
+}
+
+// NewBatchPublisher returns a batch publisher publishing to the given queue
+func NewBatchPublisher(queue Queue, maxBatch int, maxLatency time.Duration) *BatchPublisher {
+	if maxBatch < 1 {
+		maxBatch = 1
+	}
+
+	return &BatchPublisher{
+		queue:      queue,
+		maxBatch:   maxBatch,
+		maxLatency: maxLatency,
+		buffer:     make([]string, 0, maxBatch),
+	}
+}
+
+// SetErrorHandler sets a function which gets called with the payloads of a
+// batch that failed to be published
+func (publisher *BatchPublisher) SetErrorHandler(handler func(payloads []string, err error)) {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	publisher.errorHandler = handler
+}
+
+// Publish adds the payload to the current batch, returns false if the
+// publisher was closed
+func (publisher *BatchPublisher) Publish(payload string) bool {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+
+	if publisher.closed {
+		return false
+	}
+
+	publisher.buffer = append(publisher.buffer, payload)
+	if len(publisher.buffer) >= publisher.maxBatch {
+		publisher.flush()
+		return true
+	}
+
+	if publisher.timer == nil { // first payload of this batch
+		batch := publisher.batch
+		publisher.timer = time.AfterFunc(publisher.maxLatency, func() { publisher.flushBatch(batch) })
+	}
+	return true
+}
+
+// PublishBytes just casts the bytes and calls Publish
+func (publisher *BatchPublisher) PublishBytes(payload []byte) bool {
+	return publisher.Publish(string(payload))
+}
+
+// Flush publishes the current batch right away
+func (publisher *BatchPublisher) Flush() {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	publisher.flush()
+}
+
+// flushBatch flushes the current batch if it's still the given one. Stopping
+// the timer of a batch doesn't stop it if it already fired and waits for the
+// mutex, which then must not flush the batch started in the meantime
+func (publisher *BatchPublisher) flushBatch(batch uint64) {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	if publisher.batch != batch {
+		return
+	}
+	publisher.flush()
+}
+
+// Close publishes the current batch and stops accepting new payloads, returns
+// the error of the final publish
+func (publisher *BatchPublisher) Close() error {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+
+	publisher.closed = true
+	return publisher.flush()
+}
+
+// flush publishes the buffered payloads, must be called with the mutex held
+func (publisher *BatchPublisher) flush() error {
+	if publisher.timer != nil {
+		publisher.timer.Stop()
+		publisher.timer = nil
+	}
+	publisher.batch++
+
+	if len(publisher.buffer) == 0 {
+		return nil
+	}
+
+	payloads := publisher.buffer
+	publisher.buffer = make([]string, 0, publisher.maxBatch)
+
+	err := publisher.queue.PublishBatch(payloads)
+	if err != nil && publisher.errorHandler != nil {
+		publisher.errorHandler(payloads, err)
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package rmq
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/adjust/gocheck"
+)
+
+func TestBatchPublisherSuite(t *testing.T) {
+	TestingSuiteT(&BatchPublisherSuite{}, t)
+}
+
+type BatchPublisherSuite struct{}
+
+func (suite *BatchPublisherSuite) TestBatchPublisherMaxBatch(c *C) {
+	queue := NewTestQueue("batch-pub-q")
+	publisher := NewBatchPublisher(queue, 3, time.Hour)
+
+	c.Check(publisher.Publish("d1"), Equals, true)
+	c.Check(publisher.Publish("d2"), Equals, true)
+	c.Check(queue.LastDeliveries, HasLen, 0)
+	c.Check(publisher.Publish("d3"), Equals, true)
+	c.Check(queue.LastDeliveries, DeepEquals, []string{"d1", "d2", "d3"})
+
+	c.Check(publisher.Publish("d4"), Equals, true)
+	c.Check(publisher.Close(), IsNil)
+	c.Check(queue.LastDeliveries, DeepEquals, []string{"d1", "d2", "d3", "d4"})
+	c.Check(publisher.Publish("d5"), Equals, false)
+}
+
+func (suite *BatchPublisherSuite) TestBatchPublisherMaxLatency(c *C) {
+	queue := NewTestQueue("batch-pub-q")
+	publisher := NewBatchPublisher(queue, 100, 5*time.Millisecond)
+
+	c.Check(publisher.Publish("d1"), Equals, true)
+	publisher.mutex.Lock() // the timer publishes under the mutex
+	c.Check(queue.LastDeliveries, HasLen, 0)
+	publisher.mutex.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	publisher.mutex.Lock()
+	c.Check(queue.LastDeliveries, DeepEquals, []string{"d1"})
+	publisher.mutex.Unlock()
+	c.Check(publisher.Close(), IsNil)
+}
+
+func (suite *BatchPublisherSuite) TestBatchPublisherStaleTimer(c *C) {
+	queue := NewTestQueue("batch-pub-q")
+	publisher := NewBatchPublisher(queue, 2, time.Hour)
+
+	c.Check(publisher.Publish("d1"), Equals, true)
+	stale := publisher.batch
+	c.Check(publisher.Publish("d2"), Equals, true)
+	c.Check(publisher.Publish("d3"), Equals, true)
+
+	// the timer of the first batch firing late doesn't flush the second
+	publisher.flushBatch(stale)
+	c.Check(queue.LastDeliveries, DeepEquals, []string{"d1", "d2"})
+	publisher.flushBatch(publisher.batch)
+	c.Check(queue.LastDeliveries, DeepEquals, []string{"d1", "d2", "d3"})
+	c.Check(publisher.Close(), IsNil)
+}
+
+func (suite *BatchPublisherSuite) TestBatchPublisherRedis(c *C) {
+	connection := OpenConnection("batch-pub-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("batch-pub-q").(*redisQueue)
+	queue.PurgeReady()
+
+	publisher := NewBatchPublisher(queue, 10, time.Hour)
+	for i := 0; i < 25; i++ {
+		c.Check(publisher.Publish(fmt.Sprintf("batch-pub-d%d", i)), Equals, true)
+	}
+	c.Check(queue.ReadyCount(), Equals, 20)
+	c.Check(publisher.Close(), IsNil)
+	c.Check(queue.ReadyCount(), Equals, 25)
+
+	consumer := NewTestConsumer("batch-pub-cons")
+	queue.StartConsuming(30, time.Millisecond)
+	queue.AddConsumer("batch-pub-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	deliveries := consumer.Deliveries()
+	c.Assert(deliveries, HasLen, 25)
+	c.Check(deliveries[0].Payload(), Equals, "batch-pub-d0")
+	c.Check(deliveries[24].Payload(), Equals, "batch-pub-d24")
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
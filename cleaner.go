@@ -1,16 +1,46 @@
 package rmq
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type Cleaner struct {
-	connection *redisConnection
+	connection  *redisConnection
+	gracePeriod time.Duration
+	suspects    map[string]time.Time // dead connections by when they were first found dead
 }
 
-func NewCleaner(connection *redisConnection) *Cleaner {
-	return &Cleaner{connection: connection}
+// CleanerOption configures a cleaner when it is created
+type CleanerOption func(cleaner *Cleaner)
+
+// WithGracePeriod makes the cleaner only clean a connection whose heartbeat is
+// absent after it found it absent on consecutive Clean calls for at least the
+// given duration, so a slow but alive connection doesn't get its unacked
+// deliveries returned. Without a grace period connections are cleaned as soon
+// as their heartbeat is absent
+func WithGracePeriod(gracePeriod time.Duration) CleanerOption {
+	return func(cleaner *Cleaner) {
+		cleaner.gracePeriod = gracePeriod
+	}
+}
+
+func NewCleaner(connection *redisConnection, options ...CleanerOption) *Cleaner {
+	cleaner := &Cleaner{
+		connection: connection,
+		suspects:   map[string]time.Time{},
+	}
+	for _, option := range options {
+		option(cleaner)
+	}
+	return cleaner
 }
 
 func (cleaner *Cleaner) Clean() error {
+	now := time.Now()
+	suspects := map[string]time.Time{}
+	defer func() { cleaner.suspects = suspects }()
+
 	connectionNames := cleaner.connection.GetConnections()
 	for _, connectionName := range connectionNames {
 		connection := cleaner.connection.hijackConnection(connectionName)
@@ -18,6 +48,10 @@ func (cleaner *Cleaner) Clean() error {
 			continue // skip active connections!
 		}
 
+		if !cleaner.confirmDead(connectionName, now, suspects) {
+			continue // wait for the next pass
+		}
+
 		if err := cleaner.CleanConnection(connection); err != nil {
 			return err
 		}
@@ -26,6 +60,26 @@ func (cleaner *Cleaner) Clean() error {
 	return nil
 }
 
+// confirmDead returns true if the connection without heartbeat was already
+// found dead on the previous pass at least gracePeriod ago. Otherwise it
+// remembers the connection in suspects for the next pass
+func (cleaner *Cleaner) confirmDead(connectionName string, now time.Time, suspects map[string]time.Time) bool {
+	if cleaner.gracePeriod <= 0 {
+		return true
+	}
+
+	firstDead, ok := cleaner.suspects[connectionName]
+	if !ok {
+		firstDead = now
+	}
+	if ok && now.Sub(firstDead) >= cleaner.gracePeriod {
+		return true
+	}
+
+	suspects[connectionName] = firstDead
+	return false
+}
+
 func (cleaner *Cleaner) CleanConnection(connection *redisConnection) error {
 	queueNames := connection.GetConsumingQueues()
 	for _, queueName := range queueNames {
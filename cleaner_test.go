@@ -138,3 +138,34 @@ func (suite *CleanerSuite) TestCleaner(c *C) {
 	c.Check(cleaner.Clean(), IsNil)
 	cleanerConn.StopHeartbeat()
 }
+
+func (suite *CleanerSuite) TestCleanerGracePeriod(c *C) {
+	flushConn := OpenConnection("cleaner-flush", "tcp", "localhost:6379", 1)
+	flushConn.flushDb()
+	flushConn.StopHeartbeat()
+
+	conn := OpenConnection("cleaner-grace-conn", "tcp", "localhost:6379", 1)
+	queue := conn.OpenQueue("grace-q").(*redisQueue)
+	queue.Publish("grace-d1")
+	queue.StartConsuming(1, time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	c.Check(queue.UnackedCount(), Equals, 1)
+	queue.StopConsuming()
+	conn.StopHeartbeat()
+	time.Sleep(2 * time.Millisecond)
+
+	cleanerConn := OpenConnection("cleaner-grace-cleaner", "tcp", "localhost:6379", 1)
+	cleaner := NewCleaner(cleanerConn, WithGracePeriod(20*time.Millisecond))
+	c.Check(cleaner.Clean(), IsNil) // first found dead
+	c.Check(queue.UnackedCount(), Equals, 1)
+	c.Check(cleaner.Clean(), IsNil) // still within grace period
+	c.Check(queue.UnackedCount(), Equals, 1)
+
+	time.Sleep(20 * time.Millisecond)
+	c.Check(cleaner.Clean(), IsNil) // confirmed dead
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 1)
+
+	queue.PurgeReady()
+	cleanerConn.StopHeartbeat()
+}
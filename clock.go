@@ -0,0 +1,16 @@
+package rmq
+
+import "time"
+
+// Clock is the time source queues use to decide when delayed deliveries are
+// due. Replace it with SetClock to control delayed deliveries in tests
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the default clock using the system time
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
@@ -4,70 +4,291 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/adjust/uniuri"
 	"github.com/go-redis/redis/v8"
 )
 
-const heartbeatDuration = time.Minute
+const (
+	heartbeatDuration = time.Minute
+
+	// shutdownReserve is the part of the GracefulShutdown budget which is kept
+	// to return the unacked deliveries instead of waiting for consumers
+	shutdownReserve      = time.Second
+	shutdownPollInterval = 100 * time.Millisecond
+)
 
 // Connection is an interface that can be used to test publishing
 type Connection interface {
-	OpenQueue(name string) Queue
+	OpenQueue(name string, options ...QueueOption) Queue
+	OpenTenantQueue(tenant, name string, options ...QueueOption) Queue
 	CollectStats(queueList []string) Stats
 	GetOpenQueues() []string
+	QueueExists(name string) (bool, error)
+	OpenedQueues() ([]string, error)
+	GracefulShutdown(ctx context.Context) error
+	Inspect(queue string) (QueueStats, error)
+	OpenTemporaryQueue(name string, ttl time.Duration) Queue
+	QueuesMatching(pattern string) ([]string, error)
+	StatsMatching(pattern string) (QueueStats, error)
+	PeekUnacked(connectionName, queueName string, limit int) ([]string, error)
+	AckUnackedAt(connectionName, queueName string, index int, payload string) error
+	CopyReady(srcQueue string, dst Queue, count int) (int, error)
 }
 
 // Connection is the entry point. Use a connection to access queues, consumers and deliveries
 // Each connection has a single heartbeat shared among all consumers
 type redisConnection struct {
 	Name             string
-	heartbeatKey     string // key to keep alive
-	queuesKey        string // key to list of queues consumed by this connection
+	keys             KeyBuilder // builds the keys of the namespace of the connection
+	heartbeatKey     string     // key to keep alive
+	queuesKey        string     // key to list of queues consumed by this connection
 	redisClient      *redis.Client
+	inFlight         *inFlightLimiter // shared by all queues opened on this connection
+	clock            Clock            // passed to all queues opened on this connection
+	logger           Logger           // passed to all queues opened on this connection
+	errorHandler     func(err error)  // gets the redis errors of the heartbeat and the consume loops, nil to panic
 	heartbeatStopped bool
+	openQueues       map[Queue]bool // each queue opened by OpenQueue until closed, stopped by GracefulShutdown
+	openQueuesMu     sync.Mutex
 }
 
 // OpenConnectionWithRedisClient opens and returns a new connection
 func OpenConnectionWithRedisClient(tag string, redisClient *redis.Client) *redisConnection {
+	return openConnection(tag, redisClient, Options{})
+}
+
+// openConnection opens a connection with the namespace, logger, error handler and clock of opts, the other fields are ignored
+func openConnection(tag string, redisClient *redis.Client, opts Options) *redisConnection {
 	name := fmt.Sprintf("%s-%s", tag, uniuri.NewLen(6))
+	keys := NewKeyBuilder(opts.Namespace)
 
 	connection := &redisConnection{
 		Name:         name,
-		heartbeatKey: strings.Replace(connectionHeartbeatTemplate, phConnection, name, 1),
-		queuesKey:    strings.Replace(connectionQueuesTemplate, phConnection, name, 1),
+		keys:         keys,
+		heartbeatKey: keys.HeartbeatKey(name),
+		queuesKey:    keys.ConnectionQueuesKey(name),
 		redisClient:  redisClient,
+		inFlight:     newInFlightLimiter(),
+		clock:        realClock{},
+		logger:       stdLogger{},
+		errorHandler: opts.ErrorHandler,
+		openQueues:   map[Queue]bool{},
+	}
+	if opts.Clock != nil {
+		connection.clock = opts.Clock
+	}
+	if opts.Logger != nil {
+		connection.logger = opts.Logger
 	}
 
-	if !connection.updateHeartbeat() { // checks the connection
-		log.Panicf("rmq connection failed to update heartbeat %s", connection)
+	if err := connection.updateHeartbeat(); err != nil { // checks the connection
+		log.Panicf("rmq connection failed to update heartbeat %s %s", connection, err)
 	}
 
 	// add to connection set after setting heartbeat to avoid race with cleaner
-	redisErrIsNil(redisClient.SAdd(context.Background(), connectionsKey, name))
+	redisErrIsNil(redisClient.SAdd(context.Background(), keys.ConnectionsKey(), name))
 
 	go connection.heartbeat()
 	// log.Printf("rmq connection connected to %s %s:%s %d", name, network, address, db)
 	return connection
 }
 
+// Keys returns the builder of the keys of the connection and its queues, which
+// honors the namespace the connection was opened with
+func (connection *redisConnection) Keys() KeyBuilder {
+	return connection.keys
+}
+
+// AddRedisHook adds the hook to the Redis client of the connection, so it sees
+// all commands of the connection and its queues. To have hooks in place before
+// the connection sends its first heartbeat, add them to a client and pass it to
+// OpenConnectionWithRedisClient instead
+func (connection *redisConnection) AddRedisHook(hook redis.Hook) {
+	connection.redisClient.AddHook(hook)
+}
+
+// Options configures a connection opened by OpenConnectionWithConfig
+type Options struct {
+	Tag      string // prefix of the connection name, which gets a random suffix
+	Network  string // "tcp" or "unix", defaults to "tcp"
+	Addr     string // host:port or path of the unix socket
+	Password string
+	DB       int
+
+	// Namespace replaces the "rmq" prefix of all keys, so several independent
+	// setups can share a Redis database. Connections only see the connections
+	// and queues of their own namespace, cleaners included
+	Namespace string
+
+	Logger Logger // writes the debug messages, defaults to the standard logger
+	// ErrorHandler gets the redis errors of the heartbeat and the consume loops
+	// of the connection's queues. Without it they panic, unless the queue has
+	// an error budget set with WithConsumeErrorBudget
+	ErrorHandler func(err error)
+	Clock        Clock // decides when delayed deliveries are due, defaults to the system time
+}
+
+// OpenConnectionWithConfig opens and returns a new connection configured by opts
+func OpenConnectionWithConfig(opts Options) *redisConnection {
+	network := opts.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	redisClient := redis.NewClient(&redis.Options{
+		Network:  network,
+		Addr:     opts.Addr,
+		Password: opts.Password,
+		DB:       opts.DB,
+	})
+	return openConnection(opts.Tag, redisClient, opts)
+}
+
 // OpenConnection opens and returns a new connection
 func OpenConnection(tag, network, address string, db int) *redisConnection {
-	redisClient := redis.NewClient(&redis.Options{
+	return OpenConnectionWithConfig(Options{
+		Tag:     tag,
 		Network: network,
 		Addr:    address,
 		DB:      db,
 	})
-	return OpenConnectionWithRedisClient(tag, redisClient)
 }
 
-// OpenQueue opens and returns the queue with a given name
-func (connection *redisConnection) OpenQueue(name string) Queue {
-	redisErrIsNil(connection.redisClient.SAdd(context.Background(), queuesKey, name))
-	queue := newQueue(name, connection.Name, connection.queuesKey, connection.redisClient)
-	return queue
+// OpenQueue opens and returns the queue with a given name. It registers the
+// queue in the set of open queues right away, so queues which are only
+// published to are returned by GetOpenQueues before anything consumes them
+func (connection *redisConnection) OpenQueue(name string, options ...QueueOption) Queue {
+	redisErrIsNil(connection.redisClient.SAdd(context.Background(), connection.keys.QueuesKey(), name))
+	return connection.open(name, options...)
+}
+
+// OpenTemporaryQueue opens and returns a queue whose keys expire once nothing
+// was published to it for ttl, like a reply queue of a single client
+// which might get abandoned. Unlike OpenQueue it doesn't register the queue,
+// so it doesn't show up in the stats
+func (connection *redisConnection) OpenTemporaryQueue(name string, ttl time.Duration) Queue {
+	return connection.open(name, func(queue *redisQueue) {
+		queue.readyTTL = ttl
+	})
+}
+
+// open returns a new queue of this connection without registering it
+func (connection *redisConnection) open(name string, options ...QueueOption) Queue {
+	queue := newQueue(name, connection.Name, connection.keys, connection.redisClient, options...)
+	queue.inFlight = connection.inFlight
+	queue.clock = connection.clock
+	queue.logger = connection.logger
+	queue.errorHandler = connection.errorHandler
+	var opened Queue = queue
+	if queue.useStreams {
+		opened = newStreamQueue(queue)
+	}
+
+	connection.openQueuesMu.Lock()
+	connection.openQueues[opened] = true
+	connection.openQueuesMu.Unlock()
+	queue.onClose = func() {
+		connection.openQueuesMu.Lock()
+		defer connection.openQueuesMu.Unlock()
+		delete(connection.openQueues, opened)
+	}
+	return opened
+}
+
+// OpenTenantQueue opens and returns the queue with the given name of the given
+// tenant. Its keys are scoped by the tenant, so queues with the same name of
+// different tenants never share deliveries
+func (connection *redisConnection) OpenTenantQueue(tenant, name string, options ...QueueOption) Queue {
+	return connection.OpenQueue(TenantQueueName(tenant, name), options...)
+}
+
+// SetClock sets the clock queues opened on this connection afterwards use to
+// decide when delayed deliveries are due, defaults to the system time
+func (connection *redisConnection) SetClock(clock Clock) {
+	connection.clock = clock
+}
+
+// SetMaxInFlight caps the number of consumed deliveries which are neither
+// acked, rejected, nacked nor pushed yet across all queues of this connection.
+// Queues stop consuming while the limit is reached. Zero means unlimited,
+// which is the default
+func (connection *redisConnection) SetMaxInFlight(limit int) {
+	connection.inFlight.setLimit(limit)
+}
+
+// GracefulShutdown stops all queues opened on this connection from consuming,
+// waits for their unacked deliveries to be settled and returns the remaining
+// unacked deliveries to ready once ctx is about to expire. One second of the
+// budget is reserved for returning them.
+//
+// This is the recommended way to shut down on SIGTERM in Kubernetes: derive
+// ctx from the termination grace period, like
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+//	defer cancel()
+//	err := connection.GracefulShutdown(ctx)
+//
+// Note that stopping to consume cancels the contexts of consumed deliveries.
+// It only returns an error if returning the unacked deliveries failed
+func (connection *redisConnection) GracefulShutdown(ctx context.Context) error {
+	connection.openQueuesMu.Lock()
+	queues := make([]Queue, 0, len(connection.openQueues))
+	for queue := range connection.openQueues {
+		queues = append(queues, queue)
+	}
+	connection.openQueuesMu.Unlock()
+
+	for _, queue := range queues {
+		queue.StopConsuming()
+	}
+
+	waitCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithDeadline(ctx, deadline.Add(-shutdownReserve))
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for !allUnackedSettled(queues) {
+		select {
+		case <-waitCtx.Done():
+			return returnUnacked(queues)
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// allUnackedSettled returns true if none of the queues has unacked deliveries
+// on this connection. Queues whose stats fail count as not settled, so the
+// unacked deliveries get returned once the wait is over
+func allUnackedSettled(queues []Queue) bool {
+	for _, queue := range queues {
+		stat, err := queue.Stats()
+		if err != nil || stat.UnackedCount() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// returnUnacked returns the unacked deliveries of all given queues to ready
+func returnUnacked(queues []Queue) error {
+	for _, queue := range queues {
+		returner, ok := queue.(interface{ ReturnAllUnackedE() (int, error) })
+		if !ok {
+			continue
+		}
+		if _, err := returner.ReturnAllUnackedE(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (connection *redisConnection) CollectStats(queueList []string) Stats {
@@ -80,7 +301,7 @@ func (connection *redisConnection) String() string {
 
 // GetConnections returns a list of all open connections
 func (connection *redisConnection) GetConnections() []string {
-	result := connection.redisClient.SMembers(context.Background(), connectionsKey)
+	result := connection.redisClient.SMembers(context.Background(), connection.keys.ConnectionsKey())
 	if redisErrIsNil(result) {
 		return []string{}
 	}
@@ -89,8 +310,7 @@ func (connection *redisConnection) GetConnections() []string {
 
 // Check retuns true if the connection is currently active in terms of heartbeat
 func (connection *redisConnection) Check() bool {
-	heartbeatKey := strings.Replace(connectionHeartbeatTemplate, phConnection, connection.Name, 1)
-	result := connection.redisClient.TTL(context.Background(), heartbeatKey)
+	result := connection.redisClient.TTL(context.Background(), connection.heartbeatKey)
 	if redisErrIsNil(result) {
 		return false
 	}
@@ -105,21 +325,242 @@ func (connection *redisConnection) StopHeartbeat() bool {
 }
 
 func (connection *redisConnection) Close() bool {
-	return !redisErrIsNil(connection.redisClient.SRem(context.Background(), connectionsKey, connection.Name))
+	return !redisErrIsNil(connection.redisClient.SRem(context.Background(), connection.keys.ConnectionsKey(), connection.Name))
 }
 
 // GetOpenQueues returns a list of all open queues
 func (connection *redisConnection) GetOpenQueues() []string {
-	result := connection.redisClient.SMembers(context.Background(), queuesKey)
+	result := connection.redisClient.SMembers(context.Background(), connection.keys.QueuesKey())
 	if redisErrIsNil(result) {
 		return []string{}
 	}
 	return result.Val()
 }
 
+// QueuesMatching returns the names of all open queues matching the given glob
+// style pattern, like "email.*"
+func (connection *redisConnection) QueuesMatching(pattern string) ([]string, error) {
+	names := []string{}
+	seen := map[string]bool{} // SSCAN may return a name more than once
+	cursor := uint64(0)
+	for {
+		keys, nextCursor, err := connection.redisClient.SScan(context.Background(), connection.keys.QueuesKey(), cursor, pattern, 100).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range keys {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		if nextCursor == 0 {
+			return names, nil
+		}
+		cursor = nextCursor
+	}
+}
+
+// StatsMatching returns the ready, rejected and delayed counts of all open
+// queues matching the given glob style pattern, read in a single round trip
+func (connection *redisConnection) StatsMatching(pattern string) (QueueStats, error) {
+	names, err := connection.QueuesMatching(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return connection.queueCounts(names)
+}
+
+// CollectQueueStats returns the ready, rejected and delayed counts of all open
+// queues, read in a single round trip after reading the queue names. Unlike
+// CollectStats it doesn't look at the connections and their consumers, which
+// keeps it cheap enough for dashboards of many queues
+func (connection *redisConnection) CollectQueueStats() (QueueStats, error) {
+	names, err := connection.redisClient.SMembers(context.Background(), connection.keys.QueuesKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	return connection.queueCounts(names)
+}
+
+// Inspect returns the ready, rejected and delayed counts of the given queue,
+// read in a single round trip. Unlike OpenQueue it doesn't register the queue
+// or change any other state, so monitoring processes can observe queues they
+// neither publish to nor consume from. The returned stats are empty if the
+// queue doesn't exist
+func (connection *redisConnection) Inspect(queue string) (QueueStats, error) {
+	ctx := context.Background()
+	pipe := connection.redisClient.Pipeline()
+	exists := pipe.SIsMember(ctx, connection.keys.QueuesKey(), queue)
+	readyCount := pipe.LLen(ctx, connection.keys.ReadyKey(queue))
+	rejectedCount := pipe.LLen(ctx, connection.keys.RejectedKey(queue))
+	delayedCount := pipe.ZCard(ctx, connection.keys.DelayedKey(queue))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	stats := QueueStats{}
+	if !exists.Val() {
+		return stats, nil
+	}
+	stat := NewQueueStat(int(readyCount.Val()), int(rejectedCount.Val()))
+	stat.DelayedCount = int(delayedCount.Val())
+	stats[queue] = stat
+	return stats, nil
+}
+
+// queueCounts returns the ready, rejected and delayed counts of the given
+// queues, read in a single round trip
+func (connection *redisConnection) queueCounts(names []string) (QueueStats, error) {
+	stats := QueueStats{}
+	if len(names) == 0 {
+		return stats, nil
+	}
+
+	ctx := context.Background()
+	pipe := connection.redisClient.Pipeline()
+	readyCounts := make([]*redis.IntCmd, len(names))
+	rejectedCounts := make([]*redis.IntCmd, len(names))
+	delayedCounts := make([]*redis.IntCmd, len(names))
+	for i, name := range names {
+		queue := connection.openQueue(name)
+		readyCounts[i] = pipe.LLen(ctx, queue.readyKey)
+		rejectedCounts[i] = pipe.LLen(ctx, queue.rejectedKey)
+		delayedCounts[i] = pipe.ZCard(ctx, queue.delayedKey)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	for i, name := range names {
+		stat := NewQueueStat(int(readyCounts[i].Val()), int(rejectedCounts[i].Val()))
+		stat.DelayedCount = int(delayedCounts[i].Val())
+		stats[name] = stat
+	}
+	return stats, nil
+}
+
+// PeekUnacked returns the payloads of up to limit unacked deliveries of the
+// queue with the given name consumed by the connection with the given name,
+// most recently consumed first
+func (connection *redisConnection) PeekUnacked(connectionName, queueName string, limit int) ([]string, error) {
+	if limit <= 0 {
+		return []string{}, nil
+	}
+
+	queue := connection.hijackConnection(connectionName).openQueue(queueName)
+	values, err := connection.redisClient.LRange(context.Background(), queue.unackedKey, 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	payloads := make([]string, len(values))
+	for i, value := range values {
+		payloads[i] = decodeEnvelope(value).Payload
+	}
+	return payloads, nil
+}
+
+// AckUnackedAt acks the unacked delivery at the given index of the list
+// returned by PeekUnacked, which removes it for good together with its lease
+// and retry attempts. payload must be the payload PeekUnacked returned at that
+// index, the delivery only gets acked if it's still there. Returns
+// ErrDeliveryNotFound if the delivery at that index has another payload by now,
+// because deliveries got consumed or settled in the meantime, or there is none
+func (connection *redisConnection) AckUnackedAt(connectionName, queueName string, index int, payload string) error {
+	queue := connection.hijackConnection(connectionName).openQueue(queueName)
+	removed, err := ackUnackedAtScript.Run(context.Background(), connection.redisClient,
+		[]string{queue.unackedKey, queue.leasesKey, queue.attemptsKey},
+		index,
+		payload,
+		envelopePrefix,
+		leaseTokenLength,
+	).Int()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrDeliveryNotFound
+	}
+	return nil
+}
+
+// CopyReady copies up to count of the oldest ready deliveries of the queue
+// with the given name to dst without removing them, so they get consumed in
+// the same order there. dst can be opened on a connection to another Redis.
+// Returns the number of copied deliveries
+func (connection *redisConnection) CopyReady(srcQueue string, dst Queue, count int) (int, error) {
+	if count <= 0 {
+		return 0, nil
+	}
+
+	values, err := connection.redisClient.LRange(context.Background(), connection.keys.ReadyKey(srcQueue), -int64(count), -1).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	// the oldest delivery is the last one, publish it first
+	payloads := make([]string, len(values))
+	for i, value := range values {
+		payloads[len(values)-1-i] = decodeEnvelope(value).Payload
+	}
+	if err := dst.PublishBatch(payloads); err != nil {
+		return 0, err
+	}
+	return len(payloads), nil
+}
+
+// FlushAll purges the ready, rejected and delayed deliveries of all open
+// queues. It wipes all queues of the Redis, so it only runs if confirm is true
+// and returns ErrNotConfirmed otherwise. Failing queues don't stop the others
+// from being purged, their errors are returned as QueueErrors
+func (connection *redisConnection) FlushAll(confirm bool) error {
+	if !confirm {
+		return ErrNotConfirmed
+	}
+
+	names, err := connection.redisClient.SMembers(context.Background(), connection.keys.QueuesKey()).Result()
+	if err != nil {
+		return err
+	}
+
+	errs := QueueErrors{}
+	for _, name := range names {
+		if err := connection.openQueue(name).flush(); err != nil {
+			errs[name] = err
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// LastActivity returns when the queue with the given name was last published
+// to or consumed from, by any connection. Polling an empty queue doesn't count
+// as activity. The time is accurate to about a second. Returns the zero time if
+// there was no activity since this was supported
+func (connection *redisConnection) LastActivity(queue string) (time.Time, error) {
+	millis, err := connection.redisClient.Get(context.Background(), connection.keys.ActivityKey(queue)).Int64()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, millis*int64(time.Millisecond)), nil
+}
+
+// QueueExists returns true if a queue with the given name was opened and not
+// closed since, which distinguishes empty queues from queues that never existed
+func (connection *redisConnection) QueueExists(name string) (bool, error) {
+	return connection.redisClient.SIsMember(context.Background(), connection.keys.QueuesKey(), name).Result()
+}
+
 // CloseAllQueues closes all queues by removing them from the global list
 func (connection *redisConnection) CloseAllQueues() int {
-	result := connection.redisClient.Del(context.Background(), queuesKey)
+	result := connection.redisClient.Del(context.Background(), connection.keys.QueuesKey())
 	if redisErrIsNil(result) {
 		return 0
 	}
@@ -129,7 +570,7 @@ func (connection *redisConnection) CloseAllQueues() int {
 // CloseAllQueuesInConnection closes all queues in the associated connection by removing all related keys
 func (connection *redisConnection) CloseAllQueuesInConnection() error {
 	redisErrIsNil(connection.redisClient.Del(context.Background(), connection.queuesKey))
-	// debug(fmt.Sprintf("connection closed all queues %s %d", connection, connection.queuesKey)) // COMMENTOUT
+	connection.debugf("connection closed all queues %s %s", connection, connection.queuesKey)
 	return nil
 }
 
@@ -142,11 +583,18 @@ func (connection *redisConnection) GetConsumingQueues() []string {
 	return result.Val()
 }
 
+// OpenedQueues returns the queues this connection is consuming from, unlike
+// GetOpenQueues which returns all open queues. Like GetConsumingQueues, but
+// returns redis errors instead of panicking
+func (connection *redisConnection) OpenedQueues() ([]string, error) {
+	return connection.redisClient.SMembers(context.Background(), connection.queuesKey).Result()
+}
+
 // heartbeat keeps the heartbeat key alive
 func (connection *redisConnection) heartbeat() {
 	for {
-		if !connection.updateHeartbeat() {
-			// log.Printf("rmq connection failed to update heartbeat %s", connection)
+		if err := connection.updateHeartbeat(); err != nil {
+			connection.heartbeatFailed(err)
 		}
 
 		time.Sleep(time.Second)
@@ -158,23 +606,38 @@ func (connection *redisConnection) heartbeat() {
 	}
 }
 
-func (connection *redisConnection) updateHeartbeat() bool {
-	return !redisErrIsNil(connection.redisClient.Set(context.Background(), connection.heartbeatKey, "1", heartbeatDuration))
+func (connection *redisConnection) updateHeartbeat() error {
+	return connection.redisClient.Set(context.Background(), connection.heartbeatKey, "1", heartbeatDuration).Err()
+}
+
+// heartbeatFailed passes the error of a heartbeat update to the error handler,
+// without one it panics like it always did
+func (connection *redisConnection) heartbeatFailed(err error) {
+	if connection.errorHandler == nil {
+		log.Panicf("rmq connection failed to update heartbeat %s %s", connection, err)
+	}
+	connection.errorHandler(err)
 }
 
 // hijackConnection reopens an existing connection for inspection purposes without starting a heartbeat
 func (connection *redisConnection) hijackConnection(name string) *redisConnection {
 	return &redisConnection{
 		Name:         name,
-		heartbeatKey: strings.Replace(connectionHeartbeatTemplate, phConnection, name, 1),
-		queuesKey:    strings.Replace(connectionQueuesTemplate, phConnection, name, 1),
+		keys:         connection.keys,
+		heartbeatKey: connection.keys.HeartbeatKey(name),
+		queuesKey:    connection.keys.ConnectionQueuesKey(name),
 		redisClient:  connection.redisClient,
+		clock:        connection.clock,
+		logger:       connection.logger,
+		openQueues:   map[Queue]bool{},
 	}
 }
 
 // openQueue opens a queue without adding it to the set of queues
 func (connection *redisConnection) openQueue(name string) *redisQueue {
-	return newQueue(name, connection.Name, connection.queuesKey, connection.redisClient)
+	queue := newQueue(name, connection.Name, connection.keys, connection.redisClient)
+	queue.logger = connection.logger
+	return queue
 }
 
 // flushDb flushes the redis database to reset everything, used in tests
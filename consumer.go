@@ -3,3 +3,18 @@ package rmq
 type Consumer interface {
 	Consume(delivery Delivery)
 }
+
+// Executor runs tasks, for example on a bounded worker pool. Each consumer of
+// a queue opened WithExecutor is a task which runs until the queue stops
+// consuming, so the executor must be able to run all of them at once
+type Executor interface {
+	Submit(task func())
+}
+
+// ConsumerFunc is a function which can be used as a Consumer
+type ConsumerFunc func(delivery Delivery)
+
+// Consume calls the function with the delivery
+func (consumerFunc ConsumerFunc) Consume(delivery Delivery) {
+	consumerFunc(delivery)
+}
@@ -37,10 +37,10 @@ func assertDelayed(queue *redisQueue, v int) bool {
 func waitFor(payload string, consumer *TestConsumer) string {
 	for i := 0; i < 10; i++ {
 		time.Sleep(100 * time.Millisecond)
-		if consumer == nil || consumer.LastDelivery == nil {
+		if consumer == nil || consumer.Last() == nil {
 			continue
 		}
-		if consumer.LastDelivery.Payload() == payload {
+		if consumer.Last().Payload() == payload {
 			break
 		}
 	}
@@ -50,7 +50,7 @@ func waitFor(payload string, consumer *TestConsumer) string {
 func waitForAll(payloads []string, consumer *TestConsumer) []string {
 	for _, pl := range payloads {
 		a := waitFor(pl, consumer)
-		debug(a)
+		debugf("consumed %s", a)
 	}
 	return payloads
 }
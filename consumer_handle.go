@@ -0,0 +1,77 @@
+package rmq
+
+import "sync"
+
+// ConsumerHandle is returned by AddConsumerWithHandle and controls a single
+// consumer of a queue
+type ConsumerHandle struct {
+	Name string // internal name of the consumer
+
+	queue    *redisQueue // nil for handles of test queues
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{} // closed once the consumer returned
+	doneOnce sync.Once
+}
+
+func newConsumerHandle(name string, queue *redisQueue) *ConsumerHandle {
+	return &ConsumerHandle{
+		Name:  name,
+		queue: queue,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// Stop stops the consumer after it consumed its current delivery, once it did
+// it gets removed from the consumers of the queue. The other consumers of the
+// queue keep consuming. Stop doesn't wait for the consumer, so it can be called
+// from within its Consume, use Wait for that. Returns false if the consumer was
+// stopped already
+func (handle *ConsumerHandle) Stop() bool {
+	stopped := false
+	handle.stopOnce.Do(func() {
+		close(handle.stop)
+		stopped = true
+	})
+	return stopped
+}
+
+// Wait blocks until the consumer returned, after Stop or because the queue
+// stopped consuming. It must not be called from within the consumer's Consume,
+// which would never return then
+func (handle *ConsumerHandle) Wait() {
+	<-handle.done
+}
+
+// Stats returns the number of deliveries the consumer consumed, acked and
+// rejected since it was added
+func (handle *ConsumerHandle) Stats() ConsumerStat {
+	if handle.queue == nil {
+		return ConsumerStat{}
+	}
+	stat, _ := handle.queue.ConsumerStats(handle.Name)
+	return stat
+}
+
+// finish removes a stopped consumer from the consumers of the queue and closes
+// done, the consumer may return more than once if it got stopped while
+// ReconfigureConsuming replaced its delivery channel
+func (handle *ConsumerHandle) finish() {
+	handle.doneOnce.Do(func() {
+		if handle.queue != nil && handle.stopped() {
+			handle.queue.RemoveConsumer(handle.Name)
+		}
+		close(handle.done)
+	})
+}
+
+// stopped returns true once Stop was called
+func (handle *ConsumerHandle) stopped() bool {
+	select {
+	case <-handle.stop:
+		return true
+	default:
+		return false
+	}
+}
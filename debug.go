@@ -0,0 +1,56 @@
+package rmq
+
+import (
+	"log"
+	"os"
+)
+
+// debugEnv enables debug logging for all queues, set by running with a non
+// empty RMQ_DEBUG environment variable
+var debugEnv = os.Getenv("RMQ_DEBUG") != ""
+
+// Logger writes the log messages of a connection and its queues, see
+// Options.Logger. *log.Logger implements it
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// stdLogger is the default Logger, it writes to the standard logger of the
+// log package
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+// debugf logs the formatted message if RMQ_DEBUG is set. The arguments only
+// get formatted if it's logged, so calls are cheap on hot paths
+func debugf(format string, args ...interface{}) {
+	if debugEnv {
+		log.Printf("rmq debug: "+format, args...)
+	}
+}
+
+// debugf logs the formatted message to the logger of the connection if
+// RMQ_DEBUG is set
+func (connection *redisConnection) debugf(format string, args ...interface{}) {
+	if debugEnv {
+		connection.logger.Printf("rmq debug: "+format, args...)
+	}
+}
+
+// debugf logs the formatted message to the logger of the queue if the queue
+// was opened WithDebug or RMQ_DEBUG is set
+func (queue *redisQueue) debugf(format string, args ...interface{}) {
+	if queue.debug || debugEnv {
+		queue.logger.Printf("rmq debug: "+format, args...)
+	}
+}
+
+// debugf logs the formatted message to the logger of the queue the delivery
+// was consumed from if it was opened WithDebug or RMQ_DEBUG is set
+func (delivery *wrapDelivery) debugf(format string, args ...interface{}) {
+	if delivery.debug || debugEnv {
+		delivery.logger.Printf("rmq debug: "+format, args...)
+	}
+}
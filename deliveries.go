@@ -21,3 +21,13 @@ func (deliveries Deliveries) Reject() int {
 	}
 	return failedCount
 }
+
+func (deliveries Deliveries) Nack() int {
+	failedCount := 0
+	for _, delivery := range deliveries {
+		if !delivery.Nack() {
+			failedCount++
+		}
+	}
+	return failedCount
+}
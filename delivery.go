@@ -3,34 +3,106 @@ package rmq
 import (
 	"context"
 	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
 type Delivery interface {
 	Payload() string
+	EnvelopeVersion() int
+	Attempts() int
+	Headers() map[string]string
+	Context() context.Context
 	Ack() bool
+	AckWith(fn func(pipe redis.Pipeliner) error) error
+	AckAndPublish(next Queue, payload string) error
 	Reject() bool
+	RejectWithReason(reason string) bool
+	RejectWithReasonE(reason string) error
+	Nack() bool
+	Discard() error
+	Retry() error
+	ExtendLease(duration time.Duration) error
 	Push() bool
 }
 
+// requeuer is implemented by the deliveries of list and stream queues
+type requeuer interface {
+	requeue() error
+}
+
+// requeue returns a delivery the library took back, like a prefetched one, to
+// ready without counting it as nacked by a consumer
+func requeue(delivery Delivery) error {
+	if requeuer, ok := delivery.(requeuer); ok {
+		return requeuer.requeue()
+	}
+	delivery.Nack()
+	return nil
+}
+
 type wrapDelivery struct {
-	payload     string
-	unackedKey  string
-	rejectedKey string
-	pushKey     string
-	delayedKey  string
-	redisClient *redis.Client
+	payload       string // as stored in redis, possibly wrapped in an envelope
+	envelope      envelope
+	ctx           context.Context // nil unless consumed by consumers
+	leaseToken    string          // empty if the queue doesn't use leases
+	leaseExpiry   time.Time       // zero if the delivery isn't leased
+	leaseMargin   time.Duration   // the context deadline is this much before leaseExpiry
+	leaseCtx      *leaseContext   // ctx with the lease deadline, nil until Context was called
+	leaseMu       sync.Mutex
+	readyKey      string
+	unackedKey    string
+	rejectedKey   string
+	rejectedAtKey string
+	reasonsKey    string // key to the reasons of rejected deliveries
+	pushKey       string
+	pushDiscard   bool
+	delayedKey    string
+	leasesKey     string
+	attemptsKey   string
+	rejectRouter  RejectRouter
+	retryPolicy   *RetryPolicy
+	requeueLimit  *requeueLimit // nil if nacks are unlimited
+	maxDelayed    int           // zero if the delayed set is unlimited
+	clock         Clock
+	counters      *consumerCounters // of the consumer which got the delivery, nil if none
+	inFlight      *inFlightLimiter  // released once the delivery isn't unacked anymore, nil if none
+	unsettled     *int64            // decremented once settled, nil unless the queue uses WithHardPrefetchLimit
+	settled       int32             // set to 1 once inFlight was released
+	loopFailed    func(err error)   // takes redis errors while the consume loop handles the delivery, nil afterwards
+	debug         bool              // log debug messages, see WithDebug
+	logger        Logger            // writes the debug messages
+	redisClient   *redis.Client
 }
 
-func newDelivery(payload, unackedKey, rejectedKey, pushKey string, delayedKey string, redisClient *redis.Client) *wrapDelivery {
+func newDelivery(payload, leaseToken string, queue *redisQueue) *wrapDelivery {
 	return &wrapDelivery{
-		payload:     payload,
-		unackedKey:  unackedKey,
-		rejectedKey: rejectedKey,
-		pushKey:     pushKey,
-		delayedKey:  delayedKey,
-		redisClient: redisClient,
+		payload:       payload,
+		envelope:      queue.unwrap(payload),
+		leaseToken:    leaseToken,
+		leaseMargin:   queue.leaseContextMargin(),
+		readyKey:      queue.readyKey,
+		unackedKey:    queue.unackedKey,
+		rejectedKey:   queue.rejectedKey,
+		rejectedAtKey: queue.rejectedAtKey,
+		reasonsKey:    queue.rejectReasonsKey,
+		pushKey:       queue.pushKey,
+		pushDiscard:   queue.pushDiscard,
+		delayedKey:    queue.delayedKey,
+		leasesKey:     queue.leasesKey,
+		attemptsKey:   queue.attemptsKey,
+		rejectRouter:  queue.rejectRouter,
+		retryPolicy:   queue.retryPolicy,
+		requeueLimit:  queue.requeueLimit,
+		maxDelayed:    queue.maxDelayed,
+		clock:         queue.clock,
+		debug:         queue.debug,
+		logger:        queue.logger,
+		redisClient:   queue.redisClient,
 	}
 }
 
@@ -38,42 +110,403 @@ func (delivery *wrapDelivery) String() string {
 	return fmt.Sprintf("[%s %s]", delivery.payload, delivery.unackedKey)
 }
 
+// Payload returns the payload of the delivery, unwrapped from its envelope
 func (delivery *wrapDelivery) Payload() string {
-	return delivery.payload
+	return delivery.envelope.Payload
+}
+
+// EnvelopeVersion returns the version of the envelope the delivery was
+// published in, 0 if it was published without envelope
+func (delivery *wrapDelivery) EnvelopeVersion() int {
+	return delivery.envelope.Version
+}
+
+// Attempts returns the attempts of a Laravel job, see WithLaravelEnvelope.
+// It's zero for other deliveries
+func (delivery *wrapDelivery) Attempts() int {
+	return delivery.envelope.Attempts
+}
+
+// Headers returns the headers the delivery was published with, nil if it has
+// none. The returned map must not be modified
+func (delivery *wrapDelivery) Headers() map[string]string {
+	return delivery.envelope.Headers
+}
+
+// Context returns the context of the delivery, which gets cancelled once the
+// queue it was consumed from stops consuming, so long running consumers can
+// abort. Deliveries which weren't consumed by a consumer are never cancelled.
+//
+// If the queue uses leases, the context also has a deadline shortly before
+// the lease expires, see WithLeaseMargin. Without it a consumer which finishes
+// just after the lease expired would fail to ack a delivery which got returned
+// by ReturnExpiredLeases and possibly processed by another consumer already.
+// ExtendLease moves the deadline of the context forward, it only gets
+// cancelled once the delivery is settled or the lease got lost
+func (delivery *wrapDelivery) Context() context.Context {
+	parent := delivery.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	delivery.leaseMu.Lock()
+	defer delivery.leaseMu.Unlock()
+	if delivery.leaseToken == "" || delivery.leaseExpiry.IsZero() {
+		return parent
+	}
+	if delivery.leaseCtx == nil {
+		delivery.leaseCtx = newLeaseContext(parent, delivery.leaseExpiry.Add(-delivery.leaseMargin))
+	}
+	return delivery.leaseCtx
 }
 
 func (delivery *wrapDelivery) Ack() bool {
-	// debug(fmt.Sprintf("delivery ack %s", delivery)) // COMMENTOUT
+	delivery.debugf("delivery ack %s", delivery)
+
+	if !delivery.ack() {
+		return false
+	}
+	delivery.counters.acked()
+	delivery.forgetAttempts()
+	return true
+}
+
+func (delivery *wrapDelivery) ack() bool {
+	if delivery.leaseToken != "" {
+		return delivery.release("")
+	}
 
 	result := delivery.redisClient.LRem(context.Background(), delivery.unackedKey, 1, delivery.payload)
-	if redisErrIsNil(result) {
+	if err := result.Err(); err != nil {
+		delivery.redisFailed(err)
 		return false
 	}
 
+	delivery.settle() // also if it wasn't unacked anymore, it's not in flight either way
 	return result.Val() == 1
 }
 
+// redisFailed handles a redis error of a delivery operation. While the consume
+// loop handles the delivery the error counts towards its error budget,
+// otherwise it panics like redisErrIsNil
+func (delivery *wrapDelivery) redisFailed(err error) {
+	if delivery.loopFailed != nil {
+		delivery.loopFailed(err)
+		return
+	}
+	log.Panicf("rmq redis error is not nil %s", err)
+}
+
+// AckWith acks the delivery in a MULTI/EXEC transaction together with the
+// commands fn adds to the given pipeline. If fn returns an error nothing gets
+// executed and the delivery stays unacked. Note that Redis doesn't roll back a
+// transaction if one of its commands fails, in that case the error is returned
+// but the other commands were applied. The transaction watches the unacked
+// list and the lease of the delivery, returns ErrNotUnacked without applying
+// fn's commands if the delivery wasn't unacked anymore or its lease was lost.
+// fn gets called again if the watched keys changed before the transaction ran,
+// up to ackWithAttempts times, after which redis.TxFailedErr is returned
+func (delivery *wrapDelivery) AckWith(fn func(pipe redis.Pipeliner) error) error {
+	ctx := context.Background()
+	keys := []string{delivery.unackedKey}
+	if delivery.leaseToken != "" {
+		keys = append(keys, delivery.leasesKey)
+	}
+
+	var err error
+	for i := 0; i < ackWithAttempts; i++ {
+		err = delivery.redisClient.Watch(ctx, func(tx *redis.Tx) error {
+			if err := delivery.checkUnacked(ctx, tx); err != nil {
+				return err
+			}
+			_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if err := fn(pipe); err != nil {
+					return err
+				}
+
+				if delivery.leaseToken != "" {
+					pipe.ZRem(ctx, delivery.leasesKey, delivery.leaseMember())
+				}
+				pipe.LRem(ctx, delivery.unackedKey, 1, delivery.payload)
+				if delivery.retryPolicy != nil {
+					pipe.HDel(ctx, delivery.attemptsKey, delivery.payload)
+				}
+				return nil
+			})
+			return err
+		}, keys...)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err == ErrNotUnacked {
+		delivery.settle()
+	}
+	if err != nil {
+		return err
+	}
+
+	delivery.settle()
+	delivery.counters.acked()
+	return nil
+}
+
+// checkUnacked returns ErrNotUnacked unless the delivery is still unacked and
+// its lease, if any, is still held, like releaseScript checks
+func (delivery *wrapDelivery) checkUnacked(ctx context.Context, tx *redis.Tx) error {
+	if delivery.leaseToken != "" {
+		err := tx.ZScore(ctx, delivery.leasesKey, delivery.leaseMember()).Err()
+		if err == redis.Nil {
+			return ErrNotUnacked
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err := tx.LPos(ctx, delivery.unackedKey, delivery.payload, redis.LPosArgs{}).Err()
+	if err == redis.Nil {
+		return ErrNotUnacked
+	}
+	return err
+}
+
 func (delivery *wrapDelivery) Reject() bool {
-	return delivery.move(delivery.rejectedKey)
+	return delivery.rejectTo("")
 }
 
-func (delivery *wrapDelivery) Push() bool {
-	if delivery.pushKey != "" {
-		return delivery.move(delivery.pushKey)
-	} else {
-		return delivery.move(delivery.rejectedKey)
+// RejectWithReason rejects the delivery to the queue the reject router of its
+// queue picks for the reason. Without a router, or if the router doesn't pick a
+// queue, the delivery gets rejected to the rejected list like with Reject and
+// the reason is kept for RejectedReasons. Deliveries routed to another queue
+// don't keep it and get stored in that queue's format, like with
+// AckAndPublish. Returns false if the router picked a queue deliveries can't be
+// moved to, see RejectWithReasonE
+func (delivery *wrapDelivery) RejectWithReason(reason string) bool {
+	return delivery.RejectWithReasonE(reason) == nil
+}
+
+// RejectWithReasonE is like RejectWithReason, but returns ErrNotUnacked if the
+// delivery wasn't unacked anymore and ErrUnsupportedPushQueue if the router
+// picked a stream queue, which leaves the delivery unacked
+func (delivery *wrapDelivery) RejectWithReasonE(reason string) error {
+	var queue Queue
+	routed := false
+	if delivery.rejectRouter != nil {
+		queue, routed = delivery.rejectRouter(delivery, reason)
+	}
+	if !routed {
+		if !delivery.rejectTo(reason) {
+			return ErrNotUnacked
+		}
+		return nil
+	}
+
+	target, ok := pushTargetOf(queue)
+	if !ok {
+		return ErrUnsupportedPushQueue
+	}
+	// stored in the format of the target, which may use different envelopes
+	if !delivery.releaseTo(target.readyKeyName(), target.wrap(delivery.Payload())) {
+		return ErrNotUnacked
 	}
+	delivery.counters.rejected()
+	return nil
 }
 
-func (delivery *wrapDelivery) move(key string) bool {
-	if redisErrIsNil(delivery.redisClient.LPush(context.Background(), key, delivery.payload)) {
+// rejectTo rejects the delivery to the rejected list with the given reason,
+// which may be empty, and counts it as rejected
+func (delivery *wrapDelivery) rejectTo(reason string) bool {
+	if !delivery.reject(reason) {
 		return false
 	}
+	delivery.counters.rejected()
+	return true
+}
 
-	if redisErrIsNil(delivery.redisClient.LRem(context.Background(), delivery.unackedKey, 1, delivery.payload)) {
+// Discard removes the delivery from unacked without storing it anywhere, for
+// deliveries which failed but aren't worth keeping in the rejected list. It
+// counts as rejected in the consumer stats. Returns ErrNotUnacked if the
+// delivery wasn't unacked anymore
+func (delivery *wrapDelivery) Discard() error {
+	if !delivery.ack() {
+		return ErrNotUnacked
+	}
+	delivery.counters.rejected()
+	delivery.forgetAttempts()
+	return nil
+}
+
+// AckAndPublish acks the delivery and publishes payload to next in a single
+// script, so a pipeline stage which crashes can neither lose the delivery nor
+// publish its result twice. Returns ErrNotUnacked if the delivery wasn't unacked
+// anymore, in which case nothing gets published, and ErrUnsupportedPushQueue if
+// next is a stream queue
+func (delivery *wrapDelivery) AckAndPublish(next Queue, payload string) error {
+	target, ok := pushTargetOf(next)
+	if !ok {
+		return ErrUnsupportedPushQueue
+	}
+	if !delivery.releaseTo(target.readyKeyName(), target.wrap(payload)) {
+		return ErrNotUnacked
+	}
+	delivery.counters.acked()
+	delivery.forgetAttempts()
+	return nil
+}
+
+// Nack returns the delivery to the tail of the ready list, so it gets retried
+// after all deliveries which are currently ready. Use Reject for deliveries
+// which should not be retried. If the queue was opened WithMaxRequeues, a
+// delivery which was nacked too often gets rejected with a reason instead
+func (delivery *wrapDelivery) Nack() bool {
+	delivery.debugf("delivery nack %s", delivery)
+	if delivery.requeueLimit != nil {
+		return delivery.nackLimited()
+	}
+	return delivery.release(delivery.readyKey)
+}
+
+// Push moves the delivery to the ready list of the push queue of its queue. If
+// the push queue is DiscardQueue the delivery gets acked instead, and if the
+// queue has no push queue the delivery gets rejected. Pushed and discarded
+// deliveries count as acked, rejected ones as rejected
+func (delivery *wrapDelivery) Push() bool {
+	if delivery.pushDiscard {
+		return delivery.Ack()
+	}
+	if delivery.pushKey == "" {
+		return delivery.rejectTo("")
+	}
+	if !delivery.move(delivery.pushKey) {
 		return false
 	}
+	delivery.counters.acked()
+	delivery.forgetAttempts()
+	return true
+}
 
-	// debug(fmt.Sprintf("delivery rejected %s", delivery)) // COMMENTOUT
+// reject moves the delivery to the rejected list and records when it got
+// rejected for ReturnRejectedSince and the reason, unless it's empty
+func (delivery *wrapDelivery) reject(reason string) bool {
+	if !delivery.move(delivery.rejectedKey) {
+		return false
+	}
+	stampRejected(delivery.redisClient, delivery.rejectedAtKey, delivery.reasonsKey, delivery.payload, reason)
 	return true
 }
+
+// move moves the delivery from unacked to key in a single step, so deliveries
+// which were settled already, for example by WithAutoAck, don't get moved
+func (delivery *wrapDelivery) move(key string) bool {
+	return delivery.release(key)
+}
+
+// release atomically removes the delivery from unacked and pushes it to key
+// (unless key is empty). If the delivery was leased, nothing happens unless the
+// lease is still held, so a delivery which got reclaimed in the meantime can't
+// be released twice
+func (delivery *wrapDelivery) release(key string) bool {
+	return delivery.releaseTo(key, delivery.payload)
+}
+
+// releaseTo is like release, but pushes value instead of the delivery
+func (delivery *wrapDelivery) releaseTo(key, value string) bool {
+	released, err := delivery.tryRelease(key, value)
+	if err != nil {
+		delivery.redisFailed(err)
+		return false
+	}
+	return released
+}
+
+// tryRelease is like releaseTo, but returns redis errors
+func (delivery *wrapDelivery) tryRelease(key, value string) (bool, error) {
+	keys := []string{delivery.unackedKey, delivery.leasesKey}
+	if key != "" {
+		keys = append(keys, key)
+	}
+
+	result := releaseScript.Run(context.Background(), delivery.redisClient,
+		keys,
+		delivery.payload,
+		delivery.leaseMember(),
+		value,
+	)
+	if err := result.Err(); err != nil {
+		return false, err
+	}
+
+	delivery.settle() // also if it wasn't unacked anymore, it's not in flight either way
+	return result.Val() == int64(1), nil
+}
+
+// requeue returns the delivery to the tail of the ready list like Nack, for
+// the library's own returns. It doesn't count towards WithMaxRequeues
+func (delivery *wrapDelivery) requeue() error {
+	_, err := delivery.tryRelease(delivery.readyKey, delivery.payload)
+	return err
+}
+
+// settle frees the in flight slot of the delivery once it isn't unacked
+// anymore, either because it got settled or because it was returned by someone
+// else, like ReturnExpiredLeases or the cleaner, in the meantime
+func (delivery *wrapDelivery) settle() {
+	if atomic.CompareAndSwapInt32(&delivery.settled, 0, 1) {
+		delivery.inFlight.release()
+		if delivery.unsettled != nil {
+			atomic.AddInt64(delivery.unsettled, -1)
+		}
+		delivery.stopLeaseContext()
+	}
+}
+
+// stopLeaseContext cancels the context returned by Context, if any
+func (delivery *wrapDelivery) stopLeaseContext() {
+	delivery.leaseMu.Lock()
+	defer delivery.leaseMu.Unlock()
+	if delivery.leaseCtx != nil {
+		delivery.leaseCtx.stop()
+	}
+}
+
+// ExtendLease extends the lease of the delivery to expire after the given
+// duration from now, so a long running consumer keeps it from being returned by
+// ReturnExpiredLeases. The deadline of the context returned by Context moves
+// along. Returns ErrNotLeased if the queue doesn't use leases and
+// ErrNotUnacked if the lease was lost already, which cancels the context
+func (delivery *wrapDelivery) ExtendLease(duration time.Duration) error {
+	if delivery.leaseToken == "" {
+		return ErrNotLeased
+	}
+
+	expiry := time.Now().Add(duration)
+	extended, err := extendLeaseScript.Run(context.Background(), delivery.redisClient,
+		[]string{delivery.leasesKey},
+		leaseScore(expiry),
+		delivery.leaseMember(),
+	).Int()
+	if err != nil {
+		return err
+	}
+	if extended == 0 {
+		delivery.stopLeaseContext()
+		return ErrNotUnacked
+	}
+
+	delivery.leaseMu.Lock()
+	delivery.leaseExpiry = expiry
+	if delivery.leaseCtx != nil {
+		delivery.leaseCtx.extend(expiry.Add(-delivery.leaseMargin))
+	}
+	delivery.leaseMu.Unlock()
+	return nil
+}
+
+// leaseMember returns the member of the delivery in the leases set of its
+// queue, empty if the delivery isn't leased
+func (delivery *wrapDelivery) leaseMember() string {
+	if delivery.leaseToken == "" {
+		return ""
+	}
+	return leaseMember(delivery.leaseToken, delivery.payload)
+}
@@ -0,0 +1,37 @@
+package rmq
+
+import "fmt"
+
+// Dispatcher is a consumer which hands each delivery to the consumer handling
+// the value of the delivery's routing header. Deliveries without a consumer for
+// their header value get rejected with a reason
+type Dispatcher struct {
+	headerKey string
+	consumers map[string]Consumer
+}
+
+// NewDispatcher returns a dispatcher routing by the header with the given key
+func NewDispatcher(headerKey string) *Dispatcher {
+	return &Dispatcher{
+		headerKey: headerKey,
+		consumers: map[string]Consumer{},
+	}
+}
+
+// Handle makes the dispatcher hand deliveries whose header has the given value
+// to consumer. All handlers must be registered before the dispatcher is added
+// as consumer to a queue
+func (dispatcher *Dispatcher) Handle(value string, consumer Consumer) {
+	dispatcher.consumers[value] = consumer
+}
+
+// Consume hands the delivery to the consumer of its header value
+func (dispatcher *Dispatcher) Consume(delivery Delivery) {
+	value := delivery.Headers()[dispatcher.headerKey]
+	consumer, ok := dispatcher.consumers[value]
+	if !ok {
+		delivery.RejectWithReason(fmt.Sprintf("rmq: no handler for %s %q", dispatcher.headerKey, value))
+		return
+	}
+	consumer.Consume(delivery)
+}
@@ -0,0 +1,54 @@
+package rmq
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const (
+	// envelopePrefix marks payloads which are wrapped in an envelope. It starts
+	// with a null byte so it can't be confused with plain text or JSON payloads
+	envelopePrefix = "\x00rmq"
+	// envelopeVersion is the version of the envelopes this package writes
+	envelopeVersion = 1
+)
+
+// envelope wraps a payload with metadata. Fields only ever get added, decoding
+// ignores unknown fields and leaves missing ones at their zero value, so
+// producers and consumers of different versions can be mixed during rollouts
+type envelope struct {
+	Version int               `json:"v"`
+	Payload string            `json:"p"`
+	Headers map[string]string `json:"h,omitempty"`
+
+	Attempts int `json:"-"` // only read from Laravel jobs
+}
+
+// encodeEnvelope wraps the payload in an envelope of the current version
+func encodeEnvelope(payload string) string {
+	return encodeEnvelopeWithHeaders(payload, nil)
+}
+
+// encodeEnvelopeWithHeaders wraps the payload and the headers in an envelope
+// of the current version
+func encodeEnvelopeWithHeaders(payload string, headers map[string]string) string {
+	encoded, err := json.Marshal(envelope{Version: envelopeVersion, Payload: payload, Headers: headers})
+	if err != nil { // can't happen for a struct of strings and ints
+		return payload
+	}
+	return envelopePrefix + string(encoded)
+}
+
+// decodeEnvelope returns the envelope the given stored value was wrapped in.
+// Values which aren't wrapped are returned as payload of a version 0 envelope
+func decodeEnvelope(value string) envelope {
+	if !strings.HasPrefix(value, envelopePrefix) {
+		return envelope{Payload: value}
+	}
+
+	var decoded envelope
+	if err := json.Unmarshal([]byte(value[len(envelopePrefix):]), &decoded); err != nil {
+		return envelope{Payload: value}
+	}
+	return decoded
+}
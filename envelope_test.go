@@ -0,0 +1,141 @@
+package rmq
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/adjust/gocheck"
+)
+
+func TestEnvelopeSuite(t *testing.T) {
+	TestingSuiteT(&EnvelopeSuite{}, t)
+}
+
+type EnvelopeSuite struct{}
+
+func (suite *EnvelopeSuite) TestDecodeEnvelope(c *C) {
+	c.Check(decodeEnvelope("plain"), DeepEquals, envelope{Payload: "plain"})
+	c.Check(decodeEnvelope(`{"v":1,"p":"json"}`), DeepEquals, envelope{Payload: `{"v":1,"p":"json"}`})
+	c.Check(decodeEnvelope(encodeEnvelope("wrapped")), DeepEquals, envelope{Version: envelopeVersion, Payload: "wrapped"})
+
+	// newer versions with unknown fields and older versions with missing fields
+	c.Check(decodeEnvelope(envelopePrefix+`{"v":7,"p":"newer","x":{"y":1}}`), DeepEquals, envelope{Version: 7, Payload: "newer"})
+	c.Check(decodeEnvelope(envelopePrefix+`{"v":1}`), DeepEquals, envelope{Version: 1})
+
+	// broken envelopes are treated as plain payloads
+	c.Check(decodeEnvelope(envelopePrefix+"{"), DeepEquals, envelope{Payload: envelopePrefix + "{"})
+}
+
+func (suite *EnvelopeSuite) TestLaravelEnvelope(c *C) {
+	stored := `{"uuid":"3f1b","displayName":"App\\Jobs\\Notify","job":"Illuminate\\Queue\\CallQueuedHandler@call","maxTries":null,"data":{"commandName":"App\\Jobs\\Notify"},"attempts":2}`
+	decoded, ok := decodeLaravel(stored)
+	c.Check(ok, Equals, true)
+	c.Check(decoded, DeepEquals, envelope{Payload: `{"commandName":"App\\Jobs\\Notify"}`, Attempts: 2})
+
+	for _, payload := range []string{"plain", `{"order":12345}`, "12345", `"quoted"`} {
+		decoded, ok = decodeLaravel(encodeLaravel(payload, "Handler@call"))
+		c.Check(ok, Equals, true)
+		c.Check(decoded, DeepEquals, envelope{Payload: payload})
+	}
+
+	_, ok = decodeLaravel(`{"order":12345}`)
+	c.Check(ok, Equals, false)
+	_, ok = decodeLaravel("plain")
+	c.Check(ok, Equals, false)
+
+	connection := OpenConnection("laravel-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("laravel-q", WithLaravelEnvelope("Handler@call")).(*redisQueue)
+	queue.PurgeReady()
+	queue.redisClient.LPush(context.Background(), queue.readyKey, stored)
+	queue.Publish("laravel-d1")
+
+	delivery, err := queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Payload(), Equals, `{"commandName":"App\\Jobs\\Notify"}`)
+	c.Check(delivery.Attempts(), Equals, 2)
+	c.Check(delivery.Ack(), Equals, true)
+	delivery, err = queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Payload(), Equals, "laravel-d1")
+	c.Check(delivery.Attempts(), Equals, 0)
+	c.Check(delivery.Ack(), Equals, true)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *EnvelopeSuite) TestConsumeEnvelope(c *C) {
+	connection := OpenConnection("envelope-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("envelope-q", WithEnvelope()).(*redisQueue)
+	plainQueue := connection.OpenQueue("envelope-q").(*redisQueue)
+	queue.PurgeReady()
+
+	queue.Publish("envelope-d1")
+	plainQueue.Publish("envelope-d2")
+	stored := queue.redisClient.LRange(context.Background(), queue.readyKey, 0, -1).Val()
+	c.Assert(stored, HasLen, 2)
+	c.Check(strings.HasPrefix(stored[1], envelopePrefix), Equals, true)
+	c.Check(stored[0], Equals, "envelope-d2")
+
+	consumer := NewTestConsumer("envelope-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("envelope-cons", consumer)
+	time.Sleep(5 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+	c.Check(consumer.LastDeliveries[0].Payload(), Equals, "envelope-d1")
+	c.Check(consumer.LastDeliveries[0].EnvelopeVersion(), Equals, envelopeVersion)
+	c.Check(consumer.LastDeliveries[1].Payload(), Equals, "envelope-d2")
+	c.Check(consumer.LastDeliveries[1].EnvelopeVersion(), Equals, 0)
+
+	c.Check(consumer.LastDeliveries[0].Ack(), Equals, true)
+	c.Check(consumer.LastDeliveries[1].Ack(), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *EnvelopeSuite) TestRejectRouterEnvelope(c *C) {
+	connection := OpenConnection("envelope-router-conn", "tcp", "localhost:6379", 1)
+	enveloped := connection.OpenQueue("envelope-router-enveloped", WithEnvelope()).(*redisQueue)
+	plain := connection.OpenQueue("envelope-router-plain").(*redisQueue)
+	stream := connection.OpenQueue("envelope-router-stream", WithStreams(time.Minute)).(*streamQueue)
+	for _, queue := range []*redisQueue{enveloped, plain} {
+		queue.PurgeReady()
+		queue.PurgeRejected()
+	}
+	stream.PurgeReady()
+	enveloped.SetRejectRouter(func(delivery Delivery, reason string) (Queue, bool) { return plain, true })
+	plain.SetRejectRouter(func(delivery Delivery, reason string) (Queue, bool) { return enveloped, true })
+	stream.SetRejectRouter(func(delivery Delivery, reason string) (Queue, bool) { return enveloped, true })
+
+	// routed deliveries are stored in the format of the target
+	c.Check(enveloped.Publish("envelope-router-d1"), Equals, true)
+	delivery, err := enveloped.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.RejectWithReasonE("plain"), IsNil)
+	c.Check(plain.redisClient.LRange(context.Background(), plain.readyKey, 0, -1).Val(), DeepEquals, []string{"envelope-router-d1"})
+
+	delivery, err = plain.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.RejectWithReasonE("enveloped"), IsNil)
+	c.Check(enveloped.redisClient.LRange(context.Background(), enveloped.readyKey, 0, -1).Val(), DeepEquals, []string{encodeEnvelope("envelope-router-d1")})
+
+	delivery, err = enveloped.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Payload(), Equals, "envelope-router-d1")
+	c.Check(delivery.EnvelopeVersion(), Equals, envelopeVersion)
+	c.Check(delivery.Ack(), Equals, true)
+
+	// the same for deliveries of stream queues
+	c.Check(stream.Publish("envelope-router-d2"), Equals, true)
+	delivery, err = stream.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.RejectWithReasonE("enveloped"), IsNil)
+	c.Check(enveloped.redisClient.LRange(context.Background(), enveloped.readyKey, 0, -1).Val(), DeepEquals, []string{encodeEnvelope("envelope-router-d2")})
+
+	enveloped.PurgeReady()
+	connection.StopHeartbeat()
+}
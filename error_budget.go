@@ -0,0 +1,76 @@
+package rmq
+
+import (
+	"fmt"
+	"log"
+)
+
+// consumeFailed records an error of a redis call made by the consume loop and
+// passes it to the error handler of the connection. Without an error budget or
+// error handler the consume loop panics like it always did
+func (queue *redisQueue) consumeFailed(err error) {
+	if queue.errorBudget <= 0 && queue.errorHandler == nil {
+		log.Panicf("rmq queue failed to consume %s %s", queue, err)
+	}
+	if queue.errorHandler != nil {
+		queue.errorHandler(err)
+	}
+	queue.loopErr = err
+}
+
+// spendErrorBudget counts the consecutive iterations of the consume loop which
+// failed. Once the error budget is used up it stops consuming, returns the
+// prefetched deliveries and returns true, the consume loop must end then.
+// Without an error budget it keeps consuming
+func (queue *redisQueue) spendErrorBudget() bool {
+	err := queue.loopErr
+	queue.loopErr = nil
+	if err == nil || queue.errorBudget <= 0 {
+		queue.consumeErrors = 0
+		return false
+	}
+
+	queue.consumeErrors++
+	if queue.consumeErrors < queue.errorBudget {
+		return false
+	}
+
+	queue.attachMu.Lock()
+	queue.consumeErr = fmt.Errorf("%w after %d errors: %s", ErrErrorBudget, queue.consumeErrors, err)
+	queue.consumingStopped = true
+	queue.attachMu.Unlock()
+	queue.consumeCancel()
+	queue.returnPrefetched()
+	return true
+}
+
+// returnPrefetched returns the deliveries which were fetched but not taken by
+// a consumer yet to ready. Redis is likely down at this point, deliveries
+// which can't be returned stay unacked until the cleaner returns them
+func (queue *redisQueue) returnPrefetched() {
+	for {
+		select {
+		case delivery := <-queue.consumeChan():
+			requeue(delivery)
+		default:
+			return
+		}
+	}
+}
+
+// ConsumeErr returns the error which made the queue stop consuming, nil unless
+// the error budget set by WithConsumeErrorBudget was used up since consuming
+// started
+func (queue *redisQueue) ConsumeErr() error {
+	queue.attachMu.Lock()
+	defer queue.attachMu.Unlock()
+	return queue.consumeErr
+}
+
+// resetErrorBudget clears the errors of the previous consume loop, called
+// with attachMu held when consuming starts
+func (queue *redisQueue) resetErrorBudget() {
+	queue.consumeErrors = 0
+	queue.loopErr = nil
+	queue.consumeErr = nil
+}
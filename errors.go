@@ -0,0 +1,100 @@
+package rmq
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrQueueNotEmpty is returned by CloseEmpty if the queue still has ready or rejected deliveries
+	ErrQueueNotEmpty = errors.New("rmq: queue is not empty")
+
+	// ErrNoDelivery is returned by Pull if there is no ready delivery
+	ErrNoDelivery = errors.New("rmq: no delivery ready")
+
+	// ErrUnsupportedPushQueue is returned by SetPushQueue if deliveries can't be
+	// pushed to the given queue, and by RejectWithReasonE if the reject router
+	// picked such a queue
+	ErrUnsupportedPushQueue = errors.New("rmq: unsupported push queue")
+
+	// ErrAlreadyConsuming is returned when starting to consume a queue which is
+	// already consuming
+	ErrAlreadyConsuming = errors.New("rmq: queue is already consuming")
+
+	// ErrNoRetryPolicy is returned when retrying a delivery of a queue without
+	// retry policy
+	ErrNoRetryPolicy = errors.New("rmq: queue has no retry policy")
+
+	// ErrNotSupported is returned by stream queues for features only list
+	// queues support
+	ErrNotSupported = errors.New("rmq: not supported by stream queues")
+
+	// ErrStrictFIFO is returned by operations which would break the order of a
+	// queue opened with WithStrictFIFO
+	ErrStrictFIFO = errors.New("rmq: operation not allowed on strict FIFO queue")
+
+	// ErrNotUnacked is returned when acking a delivery which isn't unacked anymore
+	ErrNotUnacked = errors.New("rmq: delivery is not unacked")
+
+	// ErrDeliveryNotFound is returned when addressing a delivery which doesn't exist
+	ErrDeliveryNotFound = errors.New("rmq: delivery not found")
+
+	// ErrNotReplicated is returned by PublishDurable if the delivery didn't get
+	// replicated to enough replicas in time
+	ErrNotReplicated = errors.New("rmq: delivery not replicated in time")
+
+	// ErrDelayedFull is returned when delaying a delivery while the delayed set
+	// of a queue opened WithMaxDelayed is full
+	ErrDelayedFull = errors.New("rmq: delayed set is full")
+
+	// ErrNotLeased is returned when extending the lease of a delivery of a queue
+	// which doesn't use leases
+	ErrNotLeased = errors.New("rmq: delivery is not leased")
+
+	// ErrNotConsuming is returned when reconfiguring a queue which isn't consuming
+	ErrNotConsuming = errors.New("rmq: queue is not consuming")
+
+	// ErrInvalidPrefetchLimit is returned when reconfiguring a queue with a
+	// negative prefetch limit
+	ErrInvalidPrefetchLimit = errors.New("rmq: prefetch limit must not be negative")
+
+	// ErrDuplicateConsumerTag is returned by AddConsumerUnique if a consumer
+	// with the same tag was already added
+	ErrDuplicateConsumerTag = errors.New("rmq: duplicate consumer tag")
+
+	// ErrErrorBudget is returned by ConsumeErr and ConsumeWithContext once the
+	// consume loop stopped after too many consecutive redis errors
+	ErrErrorBudget = errors.New("rmq: consume error budget used up")
+
+	// ErrQueueClosed is returned when publishing to a queue after it got closed
+	ErrQueueClosed = errors.New("rmq: queue is closed")
+
+	// ErrInvalidReservation is returned by Commit and Rollback for tokens which
+	// weren't returned by Reserve
+	ErrInvalidReservation = errors.New("rmq: invalid reservation token")
+
+	// ErrNoReply is returned by PublishAndAwaitReply if no reply arrived in time
+	ErrNoReply = errors.New("rmq: no reply in time")
+
+	// ErrNotConfirmed is returned by FlushAll if it wasn't confirmed
+	ErrNotConfirmed = errors.New("rmq: flush all not confirmed")
+)
+
+// QueueErrors holds the errors of an operation on several queues by queue name
+type QueueErrors map[string]error
+
+func (errs QueueErrors) Error() string {
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := make([]string, len(names))
+	for i, name := range names {
+		messages[i] = fmt.Sprintf("%s: %s", name, errs[name])
+	}
+	return fmt.Sprintf("rmq: %d queues failed: %s", len(errs), strings.Join(messages, "; "))
+}
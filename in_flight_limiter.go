@@ -0,0 +1,94 @@
+package rmq
+
+import (
+	"context"
+	"sync"
+)
+
+// inFlightLimiter caps the number of deliveries which are consumed but not yet
+// acked, rejected, nacked or pushed across all queues of a connection. All
+// methods are safe to call on a nil limiter, which doesn't limit anything
+type inFlightLimiter struct {
+	mu      sync.Mutex
+	changed chan struct{} // closed and replaced whenever a slot may have become free
+	limit   int           // zero means unlimited
+	count   int
+}
+
+func newInFlightLimiter() *inFlightLimiter {
+	return &inFlightLimiter{changed: make(chan struct{})}
+}
+
+// setLimit changes the limit, deliveries already in flight are not affected
+func (limiter *inFlightLimiter) setLimit(limit int) {
+	limiter.mu.Lock()
+	limiter.limit = limit
+	limiter.broadcast()
+	limiter.mu.Unlock()
+}
+
+// acquire blocks until a delivery can be consumed without exceeding the limit.
+// Returns false without taking a slot if ctx is done before that
+func (limiter *inFlightLimiter) acquire(ctx context.Context) bool {
+	if limiter == nil {
+		return true
+	}
+
+	for {
+		limiter.mu.Lock()
+		if limiter.limit <= 0 || limiter.count < limiter.limit {
+			limiter.count++
+			limiter.mu.Unlock()
+			return true
+		}
+		changed := limiter.changed
+		limiter.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// tryAcquire takes up to n slots without blocking and returns how many it got
+func (limiter *inFlightLimiter) tryAcquire(n int) int {
+	if limiter == nil {
+		return n
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if limiter.limit > 0 && limiter.count+n > limiter.limit {
+		n = limiter.limit - limiter.count
+		if n < 0 {
+			n = 0
+		}
+	}
+	limiter.count += n
+	return n
+}
+
+// release frees the slot of a delivery which isn't in flight anymore
+func (limiter *inFlightLimiter) release() {
+	limiter.releaseN(1)
+}
+
+// releaseN frees n slots at once
+func (limiter *inFlightLimiter) releaseN(n int) {
+	if limiter == nil || n == 0 {
+		return
+	}
+
+	limiter.mu.Lock()
+	limiter.count -= n
+	limiter.broadcast()
+	limiter.mu.Unlock()
+}
+
+// broadcast wakes all goroutines waiting in acquire, must be called with mu held
+func (limiter *inFlightLimiter) broadcast() {
+	close(limiter.changed)
+	limiter.changed = make(chan struct{})
+}
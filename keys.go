@@ -0,0 +1,196 @@
+package rmq
+
+import "strings"
+
+// KeyBuilder builds the Redis keys of the connections and queues of a
+// namespace, the same way the connections opened with that namespace do. Tools
+// which inspect or modify the keys of a connection opened with
+// OpenConnectionWithConfig should get its builder with Keys or NewKeyBuilder,
+// the key functions of this package only build the keys of the default
+// namespace
+type KeyBuilder struct {
+	namespace string // replaces the rmq prefix of all keys, empty for the default
+}
+
+// NewKeyBuilder returns a KeyBuilder for the keys of connections opened with
+// the given Options.Namespace
+func NewKeyBuilder(namespace string) KeyBuilder {
+	return KeyBuilder{namespace: namespace}
+}
+
+// defaultKeys builds the keys of connections opened without namespace, the
+// key functions below use it
+var defaultKeys = KeyBuilder{}
+
+// build returns the key of the template with the given connection and queue
+// names, names of placeholders the template doesn't have are ignored
+func (keys KeyBuilder) build(template, connection, queue string) string {
+	key := template
+	if keys.namespace != "" {
+		key = keys.namespace + strings.TrimPrefix(key, defaultNamespace)
+	}
+	key = strings.Replace(key, phConnection, connection, 1)
+	return strings.Replace(key, phQueue, queue, 1)
+}
+
+// ConnectionsKey returns the key of the set of connection names
+func (keys KeyBuilder) ConnectionsKey() string {
+	return keys.build(connectionsKey, "", "")
+}
+
+// QueuesKey returns the key of the set of open queues
+func (keys KeyBuilder) QueuesKey() string {
+	return keys.build(queuesKey, "", "")
+}
+
+// HeartbeatKey returns the key which expires after the given connection died
+func (keys KeyBuilder) HeartbeatKey(connection string) string {
+	return keys.build(connectionHeartbeatTemplate, connection, "")
+}
+
+// ConnectionQueuesKey returns the key of the set of queues consumers of the
+// given connection are consuming
+func (keys KeyBuilder) ConnectionQueuesKey(connection string) string {
+	return keys.build(connectionQueuesTemplate, connection, "")
+}
+
+// ReadyKey is like the ReadyKey function, in the namespace of the builder
+func (keys KeyBuilder) ReadyKey(queue string) string {
+	return keys.build(queueReadyTemplate, "", queue)
+}
+
+// RejectedKey is like the RejectedKey function, in the namespace of the builder
+func (keys KeyBuilder) RejectedKey(queue string) string {
+	return keys.build(queueRejectedTemplate, "", queue)
+}
+
+// RejectedAtKey is like the RejectedAtKey function, in the namespace of the builder
+func (keys KeyBuilder) RejectedAtKey(queue string) string {
+	return keys.build(queueRejectedAtTemplate, "", queue)
+}
+
+// RejectReasonsKey is like the RejectReasonsKey function, in the namespace of the builder
+func (keys KeyBuilder) RejectReasonsKey(queue string) string {
+	return keys.build(queueRejectReasonsTemplate, "", queue)
+}
+
+// DelayedKey is like the DelayedKey function, in the namespace of the builder
+func (keys KeyBuilder) DelayedKey(queue string) string {
+	return keys.build(queueDelayedTemplate, "", queue)
+}
+
+// AttemptsKey is like the AttemptsKey function, in the namespace of the builder
+func (keys KeyBuilder) AttemptsKey(queue string) string {
+	return keys.build(queueAttemptsTemplate, "", queue)
+}
+
+// StreamKey is like the StreamKey function, in the namespace of the builder
+func (keys KeyBuilder) StreamKey(queue string) string {
+	return keys.build(queueStreamTemplate, "", queue)
+}
+
+// RateKey is like the RateKey function, in the namespace of the builder
+func (keys KeyBuilder) RateKey(queue string) string {
+	return keys.build(queueRateTemplate, "", queue)
+}
+
+// ActivityKey is like the ActivityKey function, in the namespace of the builder
+func (keys KeyBuilder) ActivityKey(queue string) string {
+	return keys.build(queueActivityTemplate, "", queue)
+}
+
+// IndexKey is like the IndexKey function, in the namespace of the builder
+func (keys KeyBuilder) IndexKey(queue, key, value string) string {
+	return strings.Replace(keys.build(queueIndexTemplate, "", queue), phIndex, key+":"+value, 1)
+}
+
+// UnackedKey is like the UnackedKey function, in the namespace of the builder
+func (keys KeyBuilder) UnackedKey(connection, queue string) string {
+	return keys.build(connectionQueueUnackedTemplate, connection, queue)
+}
+
+// LeasesKey is like the LeasesKey function, in the namespace of the builder
+func (keys KeyBuilder) LeasesKey(connection, queue string) string {
+	return keys.build(connectionQueueLeasesTemplate, connection, queue)
+}
+
+// ConsumersKey is like the ConsumersKey function, in the namespace of the builder
+func (keys KeyBuilder) ConsumersKey(connection, queue string) string {
+	return keys.build(connectionQueueConsumersTemplate, connection, queue)
+}
+
+// ReadyKey returns the key of the list of ready deliveries of the given queue.
+// Like the other key functions it builds the key of the default namespace, use
+// a KeyBuilder for connections opened with a namespace
+func ReadyKey(queue string) string {
+	return defaultKeys.ReadyKey(queue)
+}
+
+// RejectedKey returns the key of the list of rejected deliveries of the given queue
+func RejectedKey(queue string) string {
+	return defaultKeys.RejectedKey(queue)
+}
+
+// RejectedAtKey returns the key of the sorted set of rejected deliveries of the
+// given queue scored by the unix time in milliseconds they got rejected at
+func RejectedAtKey(queue string) string {
+	return defaultKeys.RejectedAtKey(queue)
+}
+
+// RejectReasonsKey returns the key of the hash of the reasons rejected
+// deliveries of the given queue got rejected with, by their rejected_at member
+func RejectReasonsKey(queue string) string {
+	return defaultKeys.RejectReasonsKey(queue)
+}
+
+// DelayedKey returns the key of the sorted set of delayed deliveries of the
+// given queue, scored by the time they are due
+func DelayedKey(queue string) string {
+	return defaultKeys.DelayedKey(queue)
+}
+
+// AttemptsKey returns the key of the hash of retry attempts of the given queue
+func AttemptsKey(queue string) string {
+	return defaultKeys.AttemptsKey(queue)
+}
+
+// StreamKey returns the key of the stream of the given queue if it uses streams
+func StreamKey(queue string) string {
+	return defaultKeys.StreamKey(queue)
+}
+
+// RateKey returns the key of the token bucket of the given queue if it was
+// opened WithDistributedRateLimit
+func RateKey(queue string) string {
+	return defaultKeys.RateKey(queue)
+}
+
+// ActivityKey returns the key of the time the given queue was last published
+// to or consumed from
+func ActivityKey(queue string) string {
+	return defaultKeys.ActivityKey(queue)
+}
+
+// IndexKey returns the key of the set of deliveries of the given queue which
+// were published with PublishIndexed and the given index key and value
+func IndexKey(queue, key, value string) string {
+	return defaultKeys.IndexKey(queue, key, value)
+}
+
+// UnackedKey returns the key of the list of deliveries of the given queue
+// which consumers of the given connection are currently consuming
+func UnackedKey(connection, queue string) string {
+	return defaultKeys.UnackedKey(connection, queue)
+}
+
+// LeasesKey returns the key of the sorted set of leases of the unacked
+// deliveries of the given queue and connection, scored by expiry
+func LeasesKey(connection, queue string) string {
+	return defaultKeys.LeasesKey(connection, queue)
+}
+
+// ConsumersKey returns the key of the set of consumers of the given connection
+// consuming from the given queue
+func ConsumersKey(connection, queue string) string {
+	return defaultKeys.ConsumersKey(connection, queue)
+}
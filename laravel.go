@@ -0,0 +1,63 @@
+package rmq
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// laravelJob is the payload format of Laravel's Redis queue driver. rmq only
+// reads and writes the fields it needs, unknown fields get dropped
+type laravelJob struct {
+	UUID        string          `json:"uuid"`
+	DisplayName string          `json:"displayName"`
+	Job         string          `json:"job"`
+	Data        json.RawMessage `json:"data"`
+	Attempts    int             `json:"attempts"`
+}
+
+// encodeLaravel wraps the payload as data of a Laravel job handled by job.
+// JSON objects and arrays are embedded as they are, other payloads as JSON
+// string, so they decode to the same payload
+func encodeLaravel(payload, job string) string {
+	data := json.RawMessage(payload)
+	if !strings.HasPrefix(payload, "{") && !strings.HasPrefix(payload, "[") || !json.Valid(data) {
+		data, _ = json.Marshal(payload) // can't fail for a string
+	}
+
+	encoded, err := json.Marshal(laravelJob{
+		UUID:        newUUID(),
+		DisplayName: job,
+		Job:         job,
+		Data:        data,
+	})
+	if err != nil { // can't happen for valid data
+		return payload
+	}
+	return string(encoded)
+}
+
+// decodeLaravel returns the data of the Laravel job as payload of an envelope
+// together with its attempts, or false if value isn't a Laravel job
+func decodeLaravel(value string) (envelope, bool) {
+	var job laravelJob
+	if err := json.Unmarshal([]byte(value), &job); err != nil || job.UUID == "" || job.Job == "" {
+		return envelope{}, false
+	}
+
+	var payload string
+	if err := json.Unmarshal(job.Data, &payload); err != nil {
+		payload = string(job.Data)
+	}
+	return envelope{Payload: payload, Attempts: job.Attempts}, true
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID() string {
+	var uuid [16]byte
+	rand.Read(uuid[:])
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
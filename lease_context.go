@@ -0,0 +1,76 @@
+package rmq
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// leaseContext is the context of a leased delivery. Unlike a context created
+// with context.WithDeadline its deadline can be pushed forward, so extending
+// the lease doesn't abort work which already uses the context. It gets
+// cancelled once the delivery is settled, the lease got lost or the deadline
+// passed, Err returns context.DeadlineExceeded in the latter case
+type leaseContext struct {
+	context.Context // cancelled by cancel, a child of the consume context
+
+	cancel   context.CancelFunc
+	timer    *time.Timer // cancels the context once the deadline passed
+	mu       sync.Mutex
+	deadline time.Time
+	expired  bool // cancelled because the deadline passed
+}
+
+func newLeaseContext(parent context.Context, deadline time.Time) *leaseContext {
+	ctx, cancel := context.WithCancel(parent)
+	leaseCtx := &leaseContext{Context: ctx, cancel: cancel, deadline: deadline}
+	leaseCtx.timer = time.AfterFunc(time.Until(deadline), leaseCtx.expire)
+	return leaseCtx
+}
+
+func (ctx *leaseContext) Deadline() (time.Time, bool) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.deadline, true
+}
+
+func (ctx *leaseContext) Err() error {
+	err := ctx.Context.Err()
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if err != nil && ctx.expired {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// extend moves the deadline to the given time, unless the context ended already
+func (ctx *leaseContext) extend(deadline time.Time) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.Context.Err() != nil {
+		return
+	}
+	ctx.deadline = deadline
+	ctx.timer.Stop()
+	ctx.timer.Reset(time.Until(deadline))
+}
+
+// expire cancels the context if the deadline passed, the timer may fire for a
+// deadline which got extended while it was waiting for the mutex
+func (ctx *leaseContext) expire() {
+	ctx.mu.Lock()
+	if time.Now().Before(ctx.deadline) || ctx.Context.Err() != nil {
+		ctx.mu.Unlock()
+		return
+	}
+	ctx.expired = true
+	ctx.mu.Unlock()
+	ctx.cancel()
+}
+
+// stop cancels the context before its deadline
+func (ctx *leaseContext) stop() {
+	ctx.timer.Stop()
+	ctx.cancel()
+}
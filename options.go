@@ -0,0 +1,258 @@
+package rmq
+
+import "time"
+
+// QueueOption configures a queue when it is opened
+type QueueOption func(queue *redisQueue)
+
+// WithMigrateChunkSize sets how many delayed deliveries are pushed to the
+// ready list per rpush call when they are migrated, defaults to 100 and is
+// capped at 1000. Returning unacked and rejected deliveries uses it too
+func WithMigrateChunkSize(size int) QueueOption {
+	return func(queue *redisQueue) {
+		if size > maxMigrateChunkSize {
+			size = maxMigrateChunkSize
+		}
+		if size > 0 {
+			queue.migrateChunkSize = size
+		}
+	}
+}
+
+// WithStatsHistory makes the queue keep the last size stats snapshots, sampled
+// every interval by the consume loop. Use StatsHistory to read them
+func WithStatsHistory(size int, interval time.Duration) QueueOption {
+	return func(queue *redisQueue) {
+		if size > 0 {
+			queue.statsHistory = newStatsHistory(size)
+			queue.statsInterval = interval
+		}
+	}
+}
+
+// WithLeases makes the queue lease every delivery it consumes for the given
+// duration. Acking, rejecting, nacking or pushing a delivery only succeeds while
+// its lease is held, so a delivery returned by ReturnExpiredLeases can't be
+// processed twice
+func WithLeases(duration time.Duration) QueueOption {
+	return func(queue *redisQueue) {
+		queue.leaseDuration = duration
+	}
+}
+
+// WithLeaseMargin sets how long before its lease expires the context of a
+// leased delivery reaches its deadline, defaults to a tenth of the lease
+// duration. The margin gives a consumer which got cancelled time to settle the
+// delivery before ReturnExpiredLeases may hand it to another consumer, so it
+// should cover the time the consumer needs to notice the cancellation
+func WithLeaseMargin(margin time.Duration) QueueOption {
+	return func(queue *redisQueue) {
+		queue.leaseMargin = margin
+	}
+}
+
+// WithPollJitter varies the time the queue sleeps between polls by up to
+// ± fraction of the poll duration, which keeps many consumers using the same
+// poll duration from polling Redis all at once. fraction must be between 0 and 1
+func WithPollJitter(fraction float64) QueueOption {
+	return func(queue *redisQueue) {
+		if fraction >= 0 && fraction <= 1 {
+			queue.pollJitter = fraction
+		}
+	}
+}
+
+// WithWarmUp makes the queue start consuming slowly. During the given window
+// after StartConsuming the prefetch limit grows from 1 to the full limit and at
+// most one batch gets consumed per poll duration, so consumers started against
+// a large backlog don't overwhelm their downstreams
+func WithWarmUp(window time.Duration) QueueOption {
+	return func(queue *redisQueue) {
+		queue.warmUp = window
+	}
+}
+
+// WithStrictFIFO guarantees that deliveries returned to the ready list are
+// consumed no earlier than all deliveries which were ready when they got
+// returned. Operations which would move deliveries to the front of the ready
+// list move them to the end instead, like ReturnAllUnacked, or fail with
+// ErrStrictFIFO, like ReturnAllUnackedToFront
+func WithStrictFIFO() QueueOption {
+	return func(queue *redisQueue) {
+		queue.strictFIFO = true
+	}
+}
+
+// WithAutoAck makes the consume loop ack deliveries as soon as it fetched them,
+// before handing them to the consumers. This gives at most once semantics: a
+// delivery is never consumed twice, but if the process dies the deliveries it
+// was processing or had prefetched are lost. Ack, Reject and the like return
+// false for auto acked deliveries. Pull and PullBatch don't auto ack
+func WithAutoAck() QueueOption {
+	return func(queue *redisQueue) {
+		queue.autoAck = true
+	}
+}
+
+// WithEnvelope makes the queue wrap published payloads in a versioned
+// envelope, which can carry metadata in future versions. Consumers unwrap
+// envelopes whether this option is set or not, so consumers must be updated
+// before producers start using envelopes
+func WithEnvelope() QueueOption {
+	return func(queue *redisQueue) {
+		queue.useEnvelope = true
+	}
+}
+
+// WithLaravelEnvelope makes the queue read and write payloads in the format of
+// Laravel's Redis queue driver, with job as the handling PHP job class like
+// "Illuminate\Queue\CallQueuedHandler@call". Published payloads become the
+// data of the job, and Delivery.Payload returns the data of consumed jobs while
+// Delivery.Attempts returns their attempts. Values which aren't Laravel jobs
+// are consumed as before. Note that this only covers the payloads, the keys of
+// rmq differ from the ones Laravel uses
+func WithLaravelEnvelope(job string) QueueOption {
+	return func(queue *redisQueue) {
+		queue.laravelJob = job
+	}
+}
+
+// WithStreams makes the queue use a Redis stream and a consumer group instead
+// of lists, see streamQueue for the differences. Deliveries which are pending
+// on any consumer for longer than claimAfter get claimed and consumed again,
+// zero disables claiming
+func WithStreams(claimAfter time.Duration) QueueOption {
+	return func(queue *redisQueue) {
+		queue.useStreams = true
+		queue.claimAfter = claimAfter
+	}
+}
+
+// WithMaxDelayed limits the delayed set of the queue to size deliveries.
+// Publishing on delay and retrying fail with ErrDelayedFull while it's full,
+// which keeps a retry storm from filling up Redis unnoticed
+func WithMaxDelayed(size int) QueueOption {
+	return func(queue *redisQueue) {
+		queue.maxDelayed = size
+	}
+}
+
+// WithDelayedReleaseRate limits how many due delayed deliveries the queue
+// moves to ready per second while consuming, the rest stay delayed until later
+// polls. This turns deliveries which come due at once, for example retries
+// after an outage, into a steady drip
+func WithDelayedReleaseRate(rps float64) QueueOption {
+	return func(queue *redisQueue) {
+		if rps > 0 {
+			queue.releaseRate = rps
+		}
+	}
+}
+
+// WithDistributedRateLimit limits how many deliveries per second all
+// consumers of the queue consume together, across all connections, using a
+// token bucket in Redis which holds up to burst tokens
+func WithDistributedRateLimit(rps float64, burst int) QueueOption {
+	return func(queue *redisQueue) {
+		if rps > 0 && burst > 0 {
+			queue.rateLimit = rps
+			queue.rateBurst = burst
+		}
+	}
+}
+
+// WithExecutor makes the queue run its consumers with the given executor
+// instead of starting a goroutine for each of them. The consume loop of the
+// queue still runs in its own goroutine
+func WithExecutor(executor Executor) QueueOption {
+	return func(queue *redisQueue) {
+		queue.executor = executor
+	}
+}
+
+// WithReadyShedding makes Publish delay deliveries by a random duration of up
+// to spread while the ready list holds more than softCap deliveries, which
+// smooths bursts into a trickle instead of growing the ready list further
+func WithReadyShedding(softCap int, spread time.Duration) QueueOption {
+	return func(queue *redisQueue) {
+		queue.sheddingCap = softCap
+		queue.sheddingSpread = spread
+	}
+}
+
+// WithMaxReady sets the ready count at which PublishBlocking waits for the
+// consumers to catch up. Other ways of publishing ignore it
+func WithMaxReady(size int) QueueOption {
+	return func(queue *redisQueue) {
+		queue.maxReady = size
+	}
+}
+
+// WithMaxRequeues limits how often a delivery can be nacked. Nacks are counted
+// together with the attempts of the retry policy, once a delivery was nacked
+// more than max times Nack rejects it with a reason instead, so a message no
+// consumer can handle doesn't cycle through the queue forever. onExceeded gets
+// called with the delivery right before it gets rejected, it may be nil.
+// Stream queues don't count nacks
+func WithMaxRequeues(max int, onExceeded func(delivery Delivery)) QueueOption {
+	return func(queue *redisQueue) {
+		if max > 0 {
+			queue.requeueLimit = &requeueLimit{max: max, onExceeded: onExceeded}
+		}
+	}
+}
+
+// WithHardPrefetchLimit makes the prefetch limit passed to StartConsuming a
+// hard cap on the deliveries the consumers hold. By default deliveries only
+// count towards it while they wait in the prefetch buffer, so up to one more
+// per consumer can be processed at the same time. With this option they count
+// until they got acked, rejected, nacked or pushed, so a delivery a consumer
+// never settles keeps its slot until consuming gets restarted. A delivery which
+// got returned by someone else in the meantime, for example by
+// ReturnExpiredLeases, frees its slot once the consumer tries to settle it.
+// It has no effect together with WithAutoAck, which settles deliveries before
+// the consumers get them. Stream queues ignore it
+func WithHardPrefetchLimit() QueueOption {
+	return func(queue *redisQueue) {
+		queue.hardPrefetch = true
+	}
+}
+
+// WithPoisonHandler sets the handler which decides what happens to consumed
+// deliveries which are marked as envelope but can't be parsed. Without a
+// handler they get rejected with a reason
+func WithPoisonHandler(handler PoisonHandler) QueueOption {
+	return func(queue *redisQueue) {
+		queue.poisonHandler = handler
+	}
+}
+
+// WithConsumeErrorBudget makes the consume loop stop after maxConsecutive
+// consecutive polls failed with a redis error, instead of panicking on the
+// first one. The prefetched deliveries get returned and ConsumeErr returns the
+// error, so a worker can exit and get restarted. Defaults to zero, which keeps
+// the panic unless the connection has an Options.ErrorHandler, which then gets
+// the errors while the loop keeps going
+func WithConsumeErrorBudget(maxConsecutive int) QueueOption {
+	return func(queue *redisQueue) {
+		queue.errorBudget = maxConsecutive
+	}
+}
+
+// WithDebug makes the queue and its deliveries log what they are doing, like
+// publishes, polls and acks. Running with a non empty RMQ_DEBUG environment
+// variable enables it for all queues
+func WithDebug(enabled bool) QueueOption {
+	return func(queue *redisQueue) {
+		queue.debug = enabled
+	}
+}
+
+// WithDurability sets how many replicas PublishDurable waits for and how long
+// at most, defaults to one replica and one second
+func WithDurability(replicas int, timeout time.Duration) QueueOption {
+	return func(queue *redisQueue) {
+		queue.durableReplicas = replicas
+		queue.durableTimeout = timeout
+	}
+}
@@ -0,0 +1,63 @@
+package rmq
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// poisonReason is the reason unparseable envelopes get rejected with
+const poisonReason = "rmq: unparseable envelope"
+
+// Action tells the queue what to do with a delivery, see PoisonHandler
+type Action int
+
+const (
+	// ActionReject rejects the delivery with a reason, so it gets quarantined
+	// in the rejected list or wherever the reject router moves it
+	ActionReject Action = iota
+	// ActionDiscard removes the delivery without storing it anywhere
+	ActionDiscard
+	// ActionDeliver hands the delivery to the consumers, with the raw value as
+	// payload
+	ActionDeliver
+)
+
+// PoisonHandler decides what happens to a consumed delivery whose value looks
+// like an envelope but can't be parsed, for example because it got corrupted
+// or was written by a different producer. It gets the raw value as stored in
+// redis, so it can try to salvage it
+type PoisonHandler func(raw string) Action
+
+// corruptEnvelope returns true if the stored value is marked as envelope but
+// can't be decoded
+func corruptEnvelope(value string) bool {
+	if !strings.HasPrefix(value, envelopePrefix) {
+		return false
+	}
+	var decoded envelope
+	return json.Unmarshal([]byte(value[len(envelopePrefix):]), &decoded) != nil
+}
+
+// handlePoison applies the poison handler of the queue to the delivery if its
+// raw value is a corrupt envelope. Without a handler such deliveries get
+// rejected with poisonReason. Returns true if the delivery got settled and must
+// not be handed to the consumers
+func (queue *redisQueue) handlePoison(raw string, delivery Delivery) bool {
+	if !corruptEnvelope(raw) {
+		return false
+	}
+
+	action := ActionReject
+	if queue.poisonHandler != nil {
+		action = queue.poisonHandler(raw)
+	}
+	switch action {
+	case ActionDeliver:
+		return false
+	case ActionDiscard:
+		delivery.Discard()
+	default:
+		delivery.RejectWithReason(poisonReason)
+	}
+	return true
+}
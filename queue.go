@@ -3,8 +3,13 @@ package rmq
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"math"
+	"math/rand"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/adjust/uniuri"
@@ -12,85 +17,262 @@ import (
 )
 
 const (
+	defaultNamespace = "rmq" // prefix of all keys unless a connection got another namespace
+
 	connectionsKey                   = "rmq::connections"                                           // Set of connection names
 	connectionHeartbeatTemplate      = "rmq::connection::{connection}::heartbeat"                   // expires after {connection} died
 	connectionQueuesTemplate         = "rmq::connection::{connection}::queues"                      // Set of queues consumers of {connection} are consuming
 	connectionQueueConsumersTemplate = "rmq::connection::{connection}::queue::[{queue}]::consumers" // Set of all consumers from {connection} consuming from {queue}
 	connectionQueueUnackedTemplate   = "rmq::connection::{connection}::queue::[{queue}]::unacked"   // List of deliveries consumers of {connection} are currently consuming
-
-	queuesKey             = "rmq::queues"                     // Set of all open queues
-	queueReadyTemplate    = "rmq::queue::[{queue}]::ready"    // List of deliveries in that {queue} (right is first and oldest, left is last and youngest)
-	queueRejectedTemplate = "rmq::queue::[{queue}]::rejected" // List of rejected deliveries from that {queue}
-	queueDelayedTemplate  = "rmq::queue::[{queue}]::delayed"  // List of delayed deliveries from that {queue}
+	connectionQueueLeasesTemplate    = "rmq::connection::{connection}::queue::[{queue}]::leases"    // Sorted set of leases of unacked deliveries scored by expiry
+
+	queuesKey                  = "rmq::queues"                           // Set of all open queues
+	queueReadyTemplate         = "rmq::queue::[{queue}]::ready"          // List of deliveries in that {queue} (right is first and oldest, left is last and youngest)
+	queueRejectedTemplate      = "rmq::queue::[{queue}]::rejected"       // List of rejected deliveries from that {queue}
+	queueDelayedTemplate       = "rmq::queue::[{queue}]::delayed"        // List of delayed deliveries from that {queue}
+	queueRejectedAtTemplate    = "rmq::queue::[{queue}]::rejected_at"    // Sorted set of rejected deliveries from that {queue} scored by the time they got rejected
+	queueRejectReasonsTemplate = "rmq::queue::[{queue}]::reject_reasons" // Hash of the reasons deliveries from that {queue} got rejected with by their rejected_at member
+	queueAttemptsTemplate      = "rmq::queue::[{queue}]::attempts"       // Hash of retry attempts by payload of deliveries from that {queue}
+	queueStreamTemplate        = "rmq::queue::[{queue}]::stream"         // Stream of deliveries in that {queue} if it uses streams
+	queueRateTemplate          = "rmq::queue::[{queue}]::rate"           // Hash of the token bucket limiting the consume rate of that {queue}
+	queueActivityTemplate      = "rmq::queue::[{queue}]::activity"       // Unix time in ms that {queue} was last published to or consumed from
+	queueIndexTemplate         = "rmq::queue::[{queue}]::index::{index}" // Set of deliveries published to {queue} with the index key and value {index}
+	tenantQueueTemplate        = "tenant::{tenant}::{queue}"             // Name of the {queue} of {tenant}
 
 	phConnection = "{connection}" // connection name
 	phQueue      = "{queue}"      // queue name
+	phTenant     = "{tenant}"     // tenant name
+	phIndex      = "{index}"      // index key and value, separated by a colon
 	phConsumer   = "{consumer}"   // consumer name (consisting of tag and token)
 
-	defaultBatchTimeout = time.Second
-	purgeBatchSize      = 100
+	defaultBatchTimeout     = time.Second
+	defaultMigrateChunkSize = 100
+	maxMigrateChunkSize     = 1000 // scripts unpack chunks, which fails for too many values
+	defaultDurableReplicas  = 1
+	defaultDurableTimeout   = time.Second
+	purgeBatchSize          = 100
+	leaseTokenLength        = 16
+	rejectedTokenLength     = 8                     // keeps the rejection times of equal payloads apart
+	activityInterval        = time.Second           // min duration between two activity stamps of a queue
+	blockingPollInterval    = 50 * time.Millisecond // duration PublishBlocking waits before checking the ready count again
+	pullPollInterval        = 10 * time.Millisecond // duration Pull waits before polling again if it can't block
+	readyBytesSamples       = 10                    // number of deliveries MEMORY USAGE samples for ReadyBytes
+	ackWithAttempts         = 10                    // transactions AckWith tries while the watched keys keep changing
 )
 
 type Queue interface {
 	Publish(payload string) bool
+	PublishE(payload string) error
+	PublishN(payload string) (int64, error)
 	PublishOnDelay(payload string, delayedAt time.Time) bool
+	PublishOnDelayE(payload string, delayedAt time.Time) error
+	PublishOnDelayWithMode(payload string, delayedAt time.Time, mode DelayMode) (bool, error)
 	PublishBytes(payload []byte) bool
 	PublishBytesOnDelay(payload []byte, delayedAt time.Time) bool
+	PublishBatch(payloads []string) error
+	PublishWithHeaders(payload string, headers map[string]string) error
+	PublishBlocking(ctx context.Context, payload string) error
+	PublishAndAwaitReply(ctx context.Context, payload string, replyQueue Queue, timeout time.Duration) (string, error)
+	PublishIndexed(payload string, indexKeys map[string]string) error
+	FindByIndex(key, value string) ([]string, error)
+	PublishBatchOnDelay(items []DelayedItem) (int, error)
+	PublishPipe(pipe redis.Pipeliner, payload string)
+	PublishDurable(ctx context.Context, payload string) error
 	PublishRejected(payload string) bool
-	SetPushQueue(pushQueue Queue)
-	StartConsuming(prefetchLimit int, pollDuration time.Duration) bool
+	AppendRejected(payload string) error
+	SetPushQueue(pushQueue Queue) error
+	SetRejectRouter(router RejectRouter)
+	SetRetryPolicy(policy RetryPolicy)
+	SetPayloadValidator(validator func(payload []byte) error)
+	SetWatermarks(high, low int, callback func(queue string, count int, crossed Watermark))
+	OnDrained(callback func())
+	StartConsuming(prefetchLimit int, pollDuration time.Duration) error
 	StopConsuming() bool
+	ConsumeErr() error
+	ReconfigureConsuming(prefetchLimit int, pollDuration time.Duration) error
+	ConsumeWithContext(ctx context.Context, prefetchLimit int, pollDuration time.Duration, consumer Consumer) error
 	AddConsumer(tag string, consumer Consumer) string
+	AddConsumerWithHandle(tag string, consumer Consumer) *ConsumerHandle
+	AddConsumerUnique(tag string, consumer Consumer) (string, error)
 	AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) string
 	AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) string
+	AddPartitionedConsumers(tag string, count int, keyFn func(payload string) string, consumers []Consumer) []string
+	AddFairConsumers(tag string, consumers []Consumer) []string
+	AddConsumerFunc(tag string, concurrency int, fn func(delivery Delivery)) []string
+	Pull(ctx context.Context) (Delivery, error)
+	ConsumeN(ctx context.Context, n int, consumer Consumer) (int, error)
+	PullBatch(ctx context.Context, max int) ([]Delivery, error)
+	Reserve(ctx context.Context) (Reservation, error)
+	Commit(token string) error
+	Rollback(token string) error
 	PurgeReady() int
+	RemoveReady(payload string, count int) (int, error)
+	TrimReady(keep int) (int, error)
 	PurgeRejected() int
+	FlushDelayed() (int, error)
 	ReturnRejected(count int) int
 	ReturnAllRejected() int
+	ReturnRejectedSince(since time.Time) (int, error)
+	ReturnRejectedWithDelay(count int, delay time.Duration) (int, error)
+	ReturnExpiredLeases() (int, error)
+	ReturnAllUnackedToFront() (int, error)
 	Close() bool
+	ClosePurging() bool
+	CloseE() error
+	CloseEmpty() (bool, error)
 	ReadyCount() int
+	ReadyBytes() (int64, error)
 	RejectedCount() int
+	RejectedReasons(count int) ([]RejectedReason, error)
 	UnackedCount() int
+	Stats() (QueueStat, error)
+	StatsHistory() []TimestampedStats
+	WaitUntilEmpty(ctx context.Context, pollInterval time.Duration) error
+	ConsumerStats(name string) (ConsumerStat, bool)
+	PollStats() PollStat
+	LastBatchSizes() []int
+	ConsumedCount() int64
+}
+
+// RejectRouter picks the queue a delivery rejected with the given reason gets
+// moved to. Returning false rejects the delivery to the rejected list
+type RejectRouter func(delivery Delivery, reason string) (Queue, bool)
+
+// RejectedReason is a rejection of a rejected delivery, see RejectedReasons
+type RejectedReason struct {
+	Payload    string
+	Reason     string // empty unless rejected with RejectWithReason
+	RejectedAt time.Time
 }
 
 type redisQueue struct {
 	name             string
 	connectionName   string
-	queuesKey        string // key to list of queues consumed by this connection
-	consumersKey     string // key to set of consumers using this connection
-	readyKey         string // key to list of ready deliveries
-	rejectedKey      string // key to list of rejected deliveries
-	unackedKey       string // key to list of currently consuming deliveries
-	pushKey          string // key to list of pushed deliveries
-	delayedKey       string // key to list of currently consuming deliveries
+	keys             KeyBuilder // builds the keys of the namespace of the connection
+	queuesKey        string     // key to list of queues consumed by this connection
+	consumersKey     string     // key to set of consumers using this connection
+	readyKey         string     // key to list of ready deliveries
+	rejectedKey      string     // key to list of rejected deliveries
+	rejectedAtKey    string     // key to sorted set of rejected deliveries by rejection time
+	rejectReasonsKey string     // key to hash of reject reasons by rejected_at member
+	unackedKey       string     // key to list of currently consuming deliveries
+	pushKey          string     // key to list of pushed deliveries
+	pushDiscard      bool       // Push acks deliveries, set by SetPushQueue(DiscardQueue)
+	delayedKey       string     // key to list of currently consuming deliveries
+	leasesKey        string     // key to sorted set of leases of unacked deliveries
+	attemptsKey      string     // key to hash of retry attempts
 	redisClient      *redis.Client
-	deliveryChan     chan Delivery // nil for publish channels, not nil for consuming channels
-	prefetchLimit    int           // max number of prefetched deliveries number of unacked can go up to prefetchLimit + numConsumers
+	deliveryChan     chan Delivery      // nil for publish channels, not nil for consuming channels, guarded by attachMu
+	consumeCtx       context.Context    // context of consumed deliveries, done once consuming stopped
+	consumeCancel    context.CancelFunc // cancels consumeCtx
+	prefetchLimit    int                // max number of prefetched deliveries number of unacked can go up to prefetchLimit + numConsumers, unless hardPrefetch
 	pollDuration     time.Duration
-	consumingStopped bool
+	migrateChunkSize int           // number of deliveries pushed per rpush when migrating delayed deliveries
+	leaseDuration    time.Duration // zero if deliveries don't get leased
+	leaseMargin      time.Duration // delivery contexts end this much before the lease, zero for the default
+	pollJitter       float64       // fraction of pollDuration the poll sleep varies by
+	clock            Clock         // decides when delayed deliveries are due
+	warmUp           time.Duration // window in which the prefetch limit grows after consuming started
+	consumingSince   time.Time
+	statsHistory     *statsHistory // nil unless enabled with WithStatsHistory
+	statsInterval    time.Duration // min duration between two stats samples
+	lastStatsSample  time.Time
+	watermarks       *watermarks   // nil unless set with SetWatermarks
+	drained          *drainedWatch // nil unless set with OnDrained
+	strictFIFO       bool          // never move deliveries to the front of ready
+	autoAck          bool          // ack consumed deliveries before handing them to the consumers
+	useEnvelope      bool          // wrap published payloads in envelopes
+	laravelJob       string        // job class of published Laravel jobs, empty unless using Laravel's format
+	useStreams       bool          // return a stream queue when opened on a connection
+	claimAfter       time.Duration // idle duration after which stream deliveries get claimed
+	durableReplicas  int           // replicas PublishDurable waits for
+	durableTimeout   time.Duration // max duration PublishDurable waits for replicas
+	maxDelayed       int           // max size of the delayed set, zero if unlimited
+	releaseRate      float64       // delayed deliveries migrated per second, zero if unlimited
+	releaseCredit    float64       // delayed deliveries the next migration may move
+	releasedAt       time.Time     // time of the last migration, zero before the first
+	rateKey          string        // key to the token bucket shared by all consumers of the queue
+	rateLimit        float64       // deliveries per second consumed across all connections, zero if unlimited
+	rateBurst        int           // capacity of the token bucket
+	sheddingCap      int           // ready count above which publishes get delayed, zero if disabled
+	maxReady         int           // ready count at which PublishBlocking waits, zero if unlimited
+	readyTTL         time.Duration // expiry of the keys of the queue refreshed on publish, zero for persistent queues
+	sheddingSpread   time.Duration // max delay of shed publishes
+	rejectRouter     RejectRouter
+	executor         Executor                     // runs the consumers, nil to run each in its own goroutine
+	retryPolicy      *RetryPolicy                 // nil unless set with SetRetryPolicy
+	requeueLimit     *requeueLimit                // nil unless set with WithMaxRequeues
+	payloadValidator func(payload []byte) error   // nil if payloads don't get validated
+	poisonHandler    PoisonHandler                // nil to reject unparseable envelopes
+	inFlight         *inFlightLimiter             // shared with all queues of the connection, nil if not opened on one
+	consumerStats    map[string]*consumerCounters // by consumer name
+	consumerStatsMu  sync.Mutex
+	reconfigureChan  chan reconfigureRequest         // receives ReconfigureConsuming requests
+	successors       map[chan Delivery]chan Delivery // delivery channels replaced by ReconfigureConsuming
+	uniqueTags       map[string]bool                 // tags added by AddConsumerUnique since consuming started
+	attachMu         sync.Mutex
+	polls            *pollCounters
+	activityKey      string
+	lastActivity     int64           // unix time in ns of the last activity stamp, accessed atomically
+	consumedCount    int64           // deliveries acked by consumers since consuming started, accessed atomically
+	closed           int32           // 1 once the queue got closed, accessed atomically
+	pullRegistered   int32           // 1 once Pull added the queue to queuesKey, accessed atomically
+	onClose          func()          // removes the queue from the open queues of its connection, nil if not opened on one
+	hardPrefetch     bool            // count deliveries towards the prefetch limit until they are settled
+	unsettled        *int64          // consumed deliveries which aren't settled yet if hardPrefetch, new for each StartConsuming, accessed atomically
+	errorBudget      int             // max consecutive failed polls, zero to panic on the first
+	debug            bool            // log debug messages, see WithDebug
+	logger           Logger          // writes the debug messages
+	errorHandler     func(err error) // gets the redis errors of the consume loop, nil to panic without error budget
+	consumeErrors    int             // consecutive failed polls of the consume loop
+	loopErr          error           // redis error of the current poll, only used by the consume loop
+	consumeErr       error           // error which stopped consuming, guarded by attachMu
+	consumingStopped bool            // set once the consume loop should stop, guarded by attachMu
 }
 
-func newQueue(name, connectionName, queuesKey string, redisClient *redis.Client) *redisQueue {
-	consumersKey := strings.Replace(connectionQueueConsumersTemplate, phConnection, connectionName, 1)
-	consumersKey = strings.Replace(consumersKey, phQueue, name, 1)
-
-	readyKey := strings.Replace(queueReadyTemplate, phQueue, name, 1)
-	rejectedKey := strings.Replace(queueRejectedTemplate, phQueue, name, 1)
-	delayedKey := strings.Replace(queueDelayedTemplate, phQueue, name, 1)
+// tenantEscaper escapes the colons of tenants, so the first separator of a
+// tenant queue name always ends the tenant
+var tenantEscaper = strings.NewReplacer("%", "%25", ":", "%3A")
 
-	unackedKey := strings.Replace(connectionQueueUnackedTemplate, phConnection, connectionName, 1)
-	unackedKey = strings.Replace(unackedKey, phQueue, name, 1)
+// TenantQueueName returns the name of the queue with the given name of the
+// given tenant, as opened by OpenTenantQueue. Colons in the tenant get escaped,
+// so different tenants and names never result in the same queue name
+func TenantQueueName(tenant, name string) string {
+	return strings.Replace(strings.Replace(tenantQueueTemplate, phTenant, tenantEscaper.Replace(tenant), 1), phQueue, name, 1)
+}
 
+func newQueue(name, connectionName string, keys KeyBuilder, redisClient *redis.Client, options ...QueueOption) *redisQueue {
 	queue := &redisQueue{
-		name:           name,
-		connectionName: connectionName,
-		queuesKey:      queuesKey,
-		consumersKey:   consumersKey,
-		readyKey:       readyKey,
-		rejectedKey:    rejectedKey,
-		unackedKey:     unackedKey,
-		delayedKey:     delayedKey,
-		redisClient:    redisClient,
+		name:             name,
+		connectionName:   connectionName,
+		keys:             keys,
+		queuesKey:        keys.ConnectionQueuesKey(connectionName),
+		consumersKey:     keys.ConsumersKey(connectionName, name),
+		readyKey:         keys.ReadyKey(name),
+		rejectedKey:      keys.RejectedKey(name),
+		rejectedAtKey:    keys.RejectedAtKey(name),
+		rejectReasonsKey: keys.RejectReasonsKey(name),
+		unackedKey:       keys.UnackedKey(connectionName, name),
+		delayedKey:       keys.DelayedKey(name),
+		leasesKey:        keys.LeasesKey(connectionName, name),
+		attemptsKey:      keys.AttemptsKey(name),
+		rateKey:          keys.RateKey(name),
+		activityKey:      keys.ActivityKey(name),
+		redisClient:      redisClient,
+		logger:           stdLogger{},
+		migrateChunkSize: defaultMigrateChunkSize,
+		durableReplicas:  defaultDurableReplicas,
+		durableTimeout:   defaultDurableTimeout,
+		clock:            realClock{},
+		consumerStats:    map[string]*consumerCounters{},
+		reconfigureChan:  make(chan reconfigureRequest),
+		successors:       map[chan Delivery]chan Delivery{},
+		uniqueTags:       map[string]bool{},
+		polls:            &pollCounters{},
+	}
+
+	for _, option := range options {
+		option(queue)
 	}
 	return queue
 }
@@ -101,18 +283,443 @@ func (queue *redisQueue) String() string {
 
 // Publish adds a delivery with the given payload to the queue
 func (queue *redisQueue) Publish(payload string) bool {
-	// debug(fmt.Sprintf("publish %s %s", payload, queue)) // COMMENTOUT
-	return !redisErrIsNil(queue.redisClient.LPush(context.Background(), queue.readyKey, payload))
+	if queue.isClosed() {
+		return false
+	}
+	queue.debugf("publish %s %s", payload, queue)
+	queue.touch()
+	if queue.shedding() {
+		return queue.PublishOnDelay(payload, queue.clock.Now().Add(randomDuration(queue.sheddingSpread)))
+	}
+	published := !redisErrIsNil(queue.redisClient.LPush(context.Background(), queue.readyKey, queue.wrap(payload)))
+	queue.refreshTTL()
+	return published
+}
+
+// refreshTTL resets the expiry of the keys of temporary queues, see
+// OpenTemporaryQueue
+func (queue *redisQueue) refreshTTL() {
+	if queue.readyTTL <= 0 {
+		return
+	}
+	queue.redisClient.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		queue.refreshTTLPipe(pipe)
+		return nil
+	})
+}
+
+// refreshTTLPipe queues resetting the expiry of the keys of temporary queues
+// on the given pipeline, so publishes on a pipeline refresh it together with
+// their write. Keys which don't exist (yet) are left alone
+func (queue *redisQueue) refreshTTLPipe(pipe redis.Pipeliner) {
+	if queue.readyTTL <= 0 {
+		return
+	}
+	for _, key := range []string{queue.readyKey, queue.delayedKey, queue.unackedKey, queue.rejectedKey, queue.rejectedAtKey, queue.rejectReasonsKey} {
+		pipe.Expire(context.Background(), key, queue.readyTTL)
+	}
+}
+
+// PublishE is like Publish, but returns an error instead of panicking, and
+// ErrQueueClosed if the queue got closed
+func (queue *redisQueue) PublishE(payload string) error {
+	if queue.isClosed() {
+		return ErrQueueClosed
+	}
+	queue.touch()
+	if queue.shedding() {
+		return queue.PublishOnDelayE(payload, queue.clock.Now().Add(randomDuration(queue.sheddingSpread)))
+	}
+	if err := queue.redisClient.LPush(context.Background(), queue.readyKey, queue.wrap(payload)).Err(); err != nil {
+		return err
+	}
+	queue.refreshTTL()
+	return nil
+}
+
+// PublishN is like PublishE, but also returns the length of the ready list
+// after the publish, so producers can throttle themselves without another round
+// trip. If the delivery got delayed by WithReadyShedding, it returns the length
+// the ready list has without it
+func (queue *redisQueue) PublishN(payload string) (int64, error) {
+	if queue.isClosed() {
+		return 0, ErrQueueClosed
+	}
+	queue.touch()
+	if queue.shedding() {
+		if err := queue.PublishOnDelayE(payload, queue.clock.Now().Add(randomDuration(queue.sheddingSpread))); err != nil {
+			return 0, err
+		}
+		return queue.redisClient.LLen(context.Background(), queue.readyKey).Result()
+	}
+	newLen, err := queue.redisClient.LPush(context.Background(), queue.readyKey, queue.wrap(payload)).Result()
+	if err != nil {
+		return 0, err
+	}
+	queue.refreshTTL()
+	return newLen, nil
+}
+
+// shedding returns true if ready shedding is enabled and the ready list holds
+// more deliveries than the soft cap
+func (queue *redisQueue) shedding() bool {
+	if queue.sheddingCap <= 0 {
+		return false
+	}
+	count, err := queue.redisClient.LLen(context.Background(), queue.readyKey).Result()
+	return err == nil && int(count) > queue.sheddingCap
+}
+
+// PublishBlocking adds a delivery with the given payload to the queue once the
+// ready list holds fewer deliveries than set by WithMaxReady, so a fast
+// producer slows down to the pace of the consumers. It checks the ready count
+// again every 50ms and returns the error of ctx if it's done before there was
+// space. Without WithMaxReady it publishes right away
+func (queue *redisQueue) PublishBlocking(ctx context.Context, payload string) error {
+	if queue.isClosed() {
+		return ErrQueueClosed
+	}
+	queue.touch()
+	value := queue.wrap(payload)
+	for {
+		published, err := publishCappedScript.Run(ctx, queue.redisClient,
+			[]string{queue.readyKey},
+			queue.maxReady,
+			value,
+		).Int()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if published == 1 {
+			queue.refreshTTL()
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(blockingPollInterval):
+		}
+	}
+}
+
+// PublishAndAwaitReply publishes payload with a new correlation id in its
+// headers, together with the name of replyQueue, and waits for the reply with
+// that id on replyQueue, which the consumer of the request publishes with
+// Reply. Returns the payload of the reply, or ErrNoReply if it didn't arrive
+// within timeout. Other replies on replyQueue are left for their requests, so
+// several requests can share a reply queue
+func (queue *redisQueue) PublishAndAwaitReply(ctx context.Context, payload string, replyQueue Queue, timeout time.Duration) (string, error) {
+	return publishAndAwaitReply(ctx, queue, payload, replyQueue, timeout)
 }
 
+// randomDuration returns a random duration in [0, max)
+func randomDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// PublishWithHeaders adds a delivery with the given payload and headers to the
+// queue. The delivery gets wrapped in an envelope to carry the headers even if
+// the queue wasn't opened WithEnvelope
+func (queue *redisQueue) PublishWithHeaders(payload string, headers map[string]string) error {
+	if queue.isClosed() {
+		return ErrQueueClosed
+	}
+	queue.touch()
+	if err := queue.redisClient.LPush(context.Background(), queue.readyKey, encodeEnvelopeWithHeaders(payload, headers)).Err(); err != nil {
+		return err
+	}
+	queue.refreshTTL()
+	return nil
+}
+
+// PublishIndexed adds a delivery with the given payload to the queue and adds
+// it to the index of each of the given keys and values, so FindByIndex can
+// find it while it's ready or delayed
+func (queue *redisQueue) PublishIndexed(payload string, indexKeys map[string]string) error {
+	if queue.isClosed() {
+		return ErrQueueClosed
+	}
+	queue.touch()
+	value := queue.wrap(payload)
+	_, err := queue.redisClient.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.LPush(context.Background(), queue.readyKey, value)
+		for key, indexValue := range indexKeys {
+			pipe.SAdd(context.Background(), queue.keys.IndexKey(queue.name, key, indexValue), value)
+		}
+		queue.refreshTTLPipe(pipe)
+		return nil
+	})
+	return err
+}
+
+// FindByIndex returns the payloads of the ready and delayed deliveries which
+// were published with PublishIndexed and the given index key and value. Index
+// entries of deliveries which left the ready list and the delayed set get
+// removed on the way. Requires Redis 6.0.6 or later
+func (queue *redisQueue) FindByIndex(key, value string) ([]string, error) {
+	val, err := findByIndexScript.Run(context.Background(), queue.redisClient,
+		[]string{queue.keys.IndexKey(queue.name, key, value), queue.readyKey, queue.delayedKey},
+	).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	found, _ := val.([]interface{})
+	payloads := make([]string, 0, len(found))
+	for _, stored := range found {
+		payloads = append(payloads, queue.unwrap(stored.(string)).Payload)
+	}
+	return payloads, nil
+}
+
+// PublishOnDelay adds a delivery with the given payload to the delayed set of
+// the queue, it gets moved to the ready list once delayedAt passed. Deliveries
+// due at the same time get moved in the order they were published
 func (queue *redisQueue) PublishOnDelay(payload string, delayedAt time.Time) bool {
+	if queue.isClosed() {
+		return false
+	}
+	if queue.maxDelayed > 0 {
+		return queue.PublishOnDelayE(payload, delayedAt) == nil
+	}
+
+	queue.touch()
 	z := redis.Z{
-		Score:  float64(delayedAt.Unix()),
-		Member: payload,
+		Score:  delayedScore(delayedAt),
+		Member: queue.wrap(payload),
 	}
 
 	result := queue.redisClient.ZAdd(context.Background(), queue.delayedKey, &z)
-	return !redisErrIsNil(result)
+	published := !redisErrIsNil(result)
+	queue.refreshTTL()
+	return published
+}
+
+// PublishOnDelayE is like PublishOnDelay, but returns an error instead of
+// panicking. Returns ErrDelayedFull if the delayed set of a queue opened
+// WithMaxDelayed is full
+func (queue *redisQueue) PublishOnDelayE(payload string, delayedAt time.Time) error {
+	if queue.isClosed() {
+		return ErrQueueClosed
+	}
+	queue.touch()
+	if _, err := queue.addDelayed(&redis.Z{
+		Score:  delayedScore(delayedAt),
+		Member: queue.wrap(payload),
+	}); err != nil {
+		return err
+	}
+	queue.refreshTTL()
+	return nil
+}
+
+// PublishOnDelayWithMode is like PublishOnDelayE, but mode controls what
+// happens if the payload is delayed already, like the flags of ZADD. Returns
+// whether the delivery got added or rescheduled. For example DelayLT keeps the
+// earliest time a payload was scheduled for
+func (queue *redisQueue) PublishOnDelayWithMode(payload string, delayedAt time.Time, mode DelayMode) (bool, error) {
+	if queue.isClosed() {
+		return false, ErrQueueClosed
+	}
+	queue.touch()
+	result, err := delayWithModeScript.Run(context.Background(), queue.redisClient,
+		[]string{queue.delayedKey},
+		queue.maxDelayed,
+		mode.flag(),
+		delayedScore(delayedAt),
+		queue.wrap(payload),
+	).Int()
+	if err != nil {
+		return false, err
+	}
+	if result < 0 {
+		return false, ErrDelayedFull
+	}
+	queue.refreshTTL()
+	return result == 1, nil
+}
+
+// addDelayed adds the given members to the delayed set and returns the number
+// of added members. If the queue limits the delayed set size, the members only
+// get added if they all fit
+func (queue *redisQueue) addDelayed(members ...*redis.Z) (int, error) {
+	ctx := context.Background()
+	if queue.maxDelayed <= 0 {
+		added, err := queue.redisClient.ZAdd(ctx, queue.delayedKey, members...).Result()
+		return int(added), err
+	}
+
+	args := make([]interface{}, 0, 1+2*len(members))
+	args = append(args, queue.maxDelayed)
+	for _, member := range members {
+		args = append(args, member.Score, member.Member)
+	}
+	added, err := addDelayedScript.Run(ctx, queue.redisClient, []string{queue.delayedKey}, args...).Int()
+	if err != nil {
+		return 0, err
+	}
+	if added < 0 {
+		return 0, ErrDelayedFull
+	}
+	return added, nil
+}
+
+// PublishBatch adds deliveries with the given payloads to the queue using a
+// single LPUSH, they get consumed in the order of the slice
+func (queue *redisQueue) PublishBatch(payloads []string) error {
+	if queue.isClosed() {
+		return ErrQueueClosed
+	}
+	queue.touch()
+	if len(payloads) == 0 {
+		return nil
+	}
+
+	values := make([]interface{}, len(payloads))
+	for i, payload := range payloads {
+		values[i] = queue.wrap(payload)
+	}
+	if err := queue.redisClient.LPush(context.Background(), queue.readyKey, values...).Err(); err != nil {
+		return err
+	}
+	queue.refreshTTL()
+	return nil
+}
+
+// PublishDurable adds a delivery with the given payload to the queue and waits
+// until the write got replicated to the number of replicas set by
+// WithDurability, one by default. Returns ErrNotReplicated if not enough
+// replicas acknowledged the write in time, the delivery is published anyway
+func (queue *redisQueue) PublishDurable(ctx context.Context, payload string) error {
+	if queue.isClosed() {
+		return ErrQueueClosed
+	}
+	queue.touch()
+	return queue.publishDurable(ctx, func(pipe redis.Pipeliner) {
+		pipe.LPush(ctx, queue.readyKey, queue.wrap(payload))
+		queue.refreshTTLPipe(pipe)
+	})
+}
+
+// publishDurable runs publish and WAIT on the same pipeline, so WAIT waits for
+// the publish to get replicated
+func (queue *redisQueue) publishDurable(ctx context.Context, publish func(pipe redis.Pipeliner)) error {
+	var wait *redis.Cmd
+	_, err := queue.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		publish(pipe)
+		wait = pipe.Do(ctx, "wait", queue.durableReplicas, queue.durableTimeout.Milliseconds())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	replicas, err := wait.Int()
+	if err != nil {
+		return err
+	}
+	if replicas < queue.durableReplicas {
+		return ErrNotReplicated
+	}
+	return nil
+}
+
+// DelayedItem is a payload to be published on delay at the given time
+type DelayedItem struct {
+	Payload string
+	At      time.Time
+}
+
+// DelayMode controls how PublishOnDelayWithMode treats payloads which are
+// delayed already, following the flags of ZADD
+type DelayMode int
+
+const (
+	DelayAlways DelayMode = iota // add or reschedule, like PublishOnDelay
+	DelayNX                      // only add payloads which aren't delayed yet
+	DelayXX                      // only reschedule payloads which are delayed already
+	DelayGT                      // add, or reschedule if the new time is later
+	DelayLT                      // add, or reschedule if the new time is earlier
+)
+
+func (mode DelayMode) flag() string {
+	switch mode {
+	case DelayNX:
+		return "NX"
+	case DelayXX:
+		return "XX"
+	case DelayGT:
+		return "GT"
+	case DelayLT:
+		return "LT"
+	}
+	return ""
+}
+
+// PublishBatchOnDelay adds deliveries with the given payloads to the delayed
+// set using a single ZADD, each gets moved to the ready list once its time
+// passed. Returns the number of added deliveries, which is lower than
+// len(items) if some payloads were delayed already. Returns ErrDelayedFull and
+// adds nothing if not all items fit into the delayed set
+func (queue *redisQueue) PublishBatchOnDelay(items []DelayedItem) (int, error) {
+	if queue.isClosed() {
+		return 0, ErrQueueClosed
+	}
+	queue.touch()
+	if len(items) == 0 {
+		return 0, nil
+	}
+
+	members := make([]*redis.Z, len(items))
+	for i, item := range items {
+		members[i] = &redis.Z{
+			Score:  delayedScore(item.At),
+			Member: queue.wrap(item.Payload),
+		}
+	}
+	added, err := queue.addDelayed(members...)
+	if err != nil {
+		return 0, err
+	}
+	queue.refreshTTL()
+	return added, nil
+}
+
+// PublishPipe queues the publish of a delivery with the given payload on the
+// given pipeline without executing it, the delivery gets added once the caller
+// executes the pipeline
+func (queue *redisQueue) PublishPipe(pipe redis.Pipeliner, payload string) {
+	pipe.LPush(context.Background(), queue.readyKey, queue.wrap(payload))
+	queue.refreshTTLPipe(pipe)
+}
+
+// wrap returns the value to store for the payload, which is the payload itself
+// unless the queue uses envelopes
+func (queue *redisQueue) wrap(payload string) string {
+	if queue.laravelJob != "" {
+		return encodeLaravel(payload, queue.laravelJob)
+	}
+	if !queue.useEnvelope {
+		return payload
+	}
+	return encodeEnvelope(payload)
+}
+
+// unwrap returns the envelope of a stored value, which is a Laravel job if the
+// queue uses Laravel's format
+func (queue *redisQueue) unwrap(value string) envelope {
+	if queue.laravelJob != "" {
+		if decoded, ok := decodeLaravel(value); ok {
+			return decoded
+		}
+	}
+	return decodeEnvelope(value)
 }
 
 // PublishBytes just casts the bytes and calls Publish
@@ -124,7 +731,8 @@ func (queue *redisQueue) PublishBytesOnDelay(payload []byte, delayedAt time.Time
 	return queue.PublishOnDelay(string(payload), delayedAt)
 }
 
-// Publish rejected job to rejected queue
+// PublishRejected moves an unacked delivery with the given payload to the
+// rejected list. Use AppendRejected to add a payload which isn't unacked
 func (queue *redisQueue) PublishRejected(payload string) bool {
 	if redisErrIsNil(queue.redisClient.LPush(context.Background(), queue.rejectedKey, payload)) {
 		return false
@@ -134,34 +742,191 @@ func (queue *redisQueue) PublishRejected(payload string) bool {
 		return false
 	}
 
+	stampRejected(queue.redisClient, queue.rejectedAtKey, queue.rejectReasonsKey, payload, "")
 	return true
 }
 
+// AppendRejected adds the given payload to the rejected list without touching
+// the unacked list, for example to import failures from elsewhere. Use
+// PublishRejected to reject a delivery which is currently unacked
+func (queue *redisQueue) AppendRejected(payload string) error {
+	wrapped := queue.wrap(payload)
+	if err := queue.redisClient.LPush(context.Background(), queue.rejectedKey, wrapped).Err(); err != nil {
+		return err
+	}
+	stampRejected(queue.redisClient, queue.rejectedAtKey, queue.rejectReasonsKey, wrapped, "")
+	return nil
+}
+
 // PurgeReady removes all ready deliveries from the queue and returns the number of purged deliveries
 func (queue *redisQueue) PurgeReady() int {
 	return queue.deleteRedisList(queue.readyKey)
 }
 
+// RemoveReady removes ready deliveries with the given payload before they get
+// consumed and returns the number of removed deliveries. Like for LREM, count
+// limits the number of removed deliveries, starting with the youngest for
+// count > 0 and the oldest for count < 0. Zero removes all
+func (queue *redisQueue) RemoveReady(payload string, count int) (int, error) {
+	removed, err := queue.redisClient.LRem(context.Background(), queue.readyKey, int64(count), queue.wrap(payload)).Result()
+	return int(removed), err
+}
+
+// TrimReady drops all but the newest keep ready deliveries and returns the
+// number of dropped deliveries. Deliveries get published to the left of the
+// ready list and consumed from its right, so the oldest deliveries, which
+// would be consumed next, get dropped
+func (queue *redisQueue) TrimReady(keep int) (int, error) {
+	if keep < 0 {
+		keep = 0
+	}
+
+	ctx := context.Background()
+	var before, after *redis.IntCmd
+	_, err := queue.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		before = pipe.LLen(ctx, queue.readyKey)
+		if keep == 0 {
+			pipe.Del(ctx, queue.readyKey) // LTRIM 0 -1 would keep all
+		} else {
+			pipe.LTrim(ctx, queue.readyKey, 0, int64(keep-1))
+		}
+		after = pipe.LLen(ctx, queue.readyKey)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(before.Val() - after.Val()), nil
+}
+
+// flush purges the ready, rejected and delayed deliveries of the queue, and
+// the stream of the queue if it uses one
+func (queue *redisQueue) flush() error {
+	if _, err := queue.deleteRedisListE(queue.readyKey); err != nil {
+		return err
+	}
+	if err := queue.redisClient.XTrim(context.Background(), queue.keys.StreamKey(queue.name), 0).Err(); err != nil {
+		return err
+	}
+	if _, err := queue.deleteRedisListE(queue.rejectedKey); err != nil {
+		return err
+	}
+	return queue.redisClient.Del(context.Background(), queue.delayedKey, queue.rejectedAtKey, queue.rejectReasonsKey).Err()
+}
+
 // PurgeRejected removes all rejected deliveries from the queue and returns the number of purged deliveries
 func (queue *redisQueue) PurgeRejected() int {
+	queue.dropRejectedStamps()
 	return queue.deleteRedisList(queue.rejectedKey)
 }
 
+// PurgeDelayed removes all delayed deliveries from the queue and returns the number of purged deliveries
 func (queue *redisQueue) PurgeDelayed() int {
-	return queue.deleteRedisSortedSet(queue.rejectedKey)
+	return queue.deleteRedisSortedSet(queue.delayedKey)
+}
+
+// FlushDelayed moves all delayed deliveries to the ready list right away,
+// regardless of when they are due, and returns the number of moved deliveries.
+// Use PurgeDelayed to drop them instead
+func (queue *redisQueue) FlushDelayed() (int, error) {
+	result := migrateScript.Run(context.Background(), queue.redisClient,
+		[]string{queue.delayedKey, queue.readyKey},
+		"+inf",
+		queue.migrateChunkSize,
+		queue.migratePlacement(),
+	)
+	val, err := result.Result()
+	if err != nil {
+		return 0, err
+	}
+	moved, _ := val.([]interface{})
+	return len(moved), nil
 }
 
 // Close purges and removes the queue from the list of queues
+// Deprecated: use ClosePurging to make the purge explicit or CloseEmpty to not lose deliveries
 func (queue *redisQueue) Close() bool {
+	return queue.ClosePurging()
+}
+
+// ClosePurging purges all ready and rejected deliveries and removes the queue
+// from the list of queues
+func (queue *redisQueue) ClosePurging() bool {
+	queue.markClosed()
 	queue.PurgeRejected()
 	queue.PurgeReady()
-	result := queue.redisClient.SRem(context.Background(), queuesKey, queue.name)
+	result := queue.redisClient.SRem(context.Background(), queue.keys.QueuesKey(), queue.name)
 	if redisErrIsNil(result) {
 		return false
 	}
 	return result.Val() > 0
 }
 
+// CloseE purges the rejected and ready deliveries and removes the queue from
+// the set of open queues like ClosePurging, but never panics. It stops at the
+// first failing step and returns an error naming it
+func (queue *redisQueue) CloseE() error {
+	if err := queue.purgeRejectedE(); err != nil {
+		return fmt.Errorf("rmq queue failed to close %s at purge-rejected: %w", queue, err)
+	}
+	if _, err := queue.deleteRedisListE(queue.readyKey); err != nil {
+		return fmt.Errorf("rmq queue failed to close %s at purge-ready: %w", queue, err)
+	}
+	return queue.closeRemove()
+}
+
+// purgeRejectedE removes all rejected deliveries and their rejection times
+func (queue *redisQueue) purgeRejectedE() error {
+	if err := queue.dropRejectedStamps(); err != nil {
+		return err
+	}
+	_, err := queue.deleteRedisListE(queue.rejectedKey)
+	return err
+}
+
+// closeRemove removes the queue from the set of open queues as last step of CloseE
+func (queue *redisQueue) closeRemove() error {
+	if err := queue.redisClient.SRem(context.Background(), queue.keys.QueuesKey(), queue.name).Err(); err != nil {
+		return fmt.Errorf("rmq queue failed to close %s at srem: %w", queue, err)
+	}
+	queue.markClosed()
+	return nil
+}
+
+// markClosed makes all further publishes to this queue fail with
+// ErrQueueClosed, so they can't leave deliveries in a queue which isn't listed
+// anymore, and removes it from the open queues of its connection. Queues opened
+// again afterwards can be published to
+func (queue *redisQueue) markClosed() {
+	atomic.StoreInt32(&queue.closed, 1)
+	if queue.onClose != nil {
+		queue.onClose()
+	}
+}
+
+// isClosed returns true once the queue got closed
+func (queue *redisQueue) isClosed() bool {
+	return atomic.LoadInt32(&queue.closed) == 1
+}
+
+// CloseEmpty removes the queue from the list of queues only if it has no ready
+// and no rejected deliveries, returns ErrQueueNotEmpty otherwise
+func (queue *redisQueue) CloseEmpty() (bool, error) {
+	result := closeEmptyScript.Run(context.Background(), queue.redisClient,
+		[]string{queue.readyKey, queue.rejectedKey, queue.keys.QueuesKey()},
+		queue.name,
+	)
+	removed, err := result.Int()
+	if err != nil {
+		return false, err
+	}
+	if removed < 0 {
+		return false, ErrQueueNotEmpty
+	}
+	queue.markClosed()
+	return removed > 0, nil
+}
+
 func (queue *redisQueue) ReadyCount() int {
 	result := queue.redisClient.LLen(context.Background(), queue.readyKey)
 	if redisErrIsNil(result) {
@@ -170,143 +935,869 @@ func (queue *redisQueue) ReadyCount() int {
 	return int(result.Val())
 }
 
+// ReadyBytes returns the approximate memory the ready list uses in bytes, as
+// estimated by MEMORY USAGE from a sample of its deliveries. Together with the
+// ready count it tells whether a queue holds few large or many small payloads
+func (queue *redisQueue) ReadyBytes() (int64, error) {
+	return memoryUsage(queue.redisClient, queue.readyKey)
+}
+
+// memoryUsage returns the estimated memory usage of key, zero if it doesn't exist
+func memoryUsage(redisClient *redis.Client, key string) (int64, error) {
+	bytes, err := redisClient.MemoryUsage(context.Background(), key, readyBytesSamples).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return bytes, err
+}
+
 func (queue *redisQueue) UnackedCount() int {
 	result := queue.redisClient.LLen(context.Background(), queue.unackedKey)
 	if redisErrIsNil(result) {
 		return 0
 	}
-	return int(result.Val())
+	return int(result.Val())
+}
+
+func (queue *redisQueue) RejectedCount() int {
+	result := queue.redisClient.LLen(context.Background(), queue.rejectedKey)
+	if redisErrIsNil(result) {
+		return 0
+	}
+	return int(result.Val())
+}
+
+// RejectedReasons returns up to count of the oldest rejections of the rejected
+// deliveries, with the reasons they got rejected with. Deliveries rejected
+// before rejection times were recorded are missing
+func (queue *redisQueue) RejectedReasons(count int) ([]RejectedReason, error) {
+	if count <= 0 {
+		return nil, nil
+	}
+
+	ctx := context.Background()
+	rejections, err := queue.redisClient.ZRangeWithScores(ctx, queue.rejectedAtKey, 0, int64(count-1)).Result()
+	if err != nil || len(rejections) == 0 {
+		return nil, err
+	}
+	members := make([]string, len(rejections))
+	for i, rejection := range rejections {
+		members[i], _ = rejection.Member.(string)
+	}
+	reasons, err := queue.redisClient.HMGet(ctx, queue.rejectReasonsKey, members...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]RejectedReason, 0, len(rejections))
+	for i, rejection := range rejections {
+		if len(members[i]) <= rejectedTokenLength {
+			continue // not written by stampRejected
+		}
+		reason, _ := reasons[i].(string)
+		result = append(result, RejectedReason{
+			Payload:    queue.unwrap(members[i][rejectedTokenLength+1:]).Payload,
+			Reason:     reason,
+			RejectedAt: time.Unix(0, int64(rejection.Score)*int64(time.Millisecond)),
+		})
+	}
+	return result, nil
+}
+
+func (queue *redisQueue) DelayedCount() int {
+	result := queue.redisClient.ZCount(context.Background(), queue.delayedKey, "-inf", "+inf")
+	if redisErrIsNil(result) {
+		return 0
+	}
+	return int(result.Val())
+}
+
+// Stats returns the ready, rejected, delayed and unacked counts and the
+// consumers of the queue, all read in a single round trip
+func (queue *redisQueue) Stats() (QueueStat, error) {
+	ctx := context.Background()
+	pipe := queue.redisClient.Pipeline()
+	readyCount := pipe.LLen(ctx, queue.readyKey)
+	rejectedCount := pipe.LLen(ctx, queue.rejectedKey)
+	delayedCount := pipe.ZCard(ctx, queue.delayedKey)
+	unackedCount := pipe.LLen(ctx, queue.unackedKey)
+	consumers := pipe.SMembers(ctx, queue.consumersKey)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return QueueStat{}, err
+	}
+
+	stat := NewQueueStat(int(readyCount.Val()), int(rejectedCount.Val()))
+	stat.DelayedCount = int(delayedCount.Val())
+	stat.Polls = queue.PollStats()
+	stat.connectionStats[queue.connectionName] = ConnectionStat{
+		active:       true,
+		unackedCount: int(unackedCount.Val()),
+		consumers:    consumers.Val(),
+	}
+	return stat, nil
+}
+
+// WaitUntilEmpty blocks until the queue has no ready, delayed or unacked
+// deliveries, checking the stats every pollInterval. Only unacked deliveries of
+// this connection are considered. Returns the context error if ctx is done first
+func (queue *redisQueue) WaitUntilEmpty(ctx context.Context, pollInterval time.Duration) error {
+	return waitUntilEmpty(ctx, pollInterval, queue.Stats)
+}
+
+// waitUntilEmpty polls the given stats until they are empty or ctx is done
+func waitUntilEmpty(ctx context.Context, pollInterval time.Duration, stats func() (QueueStat, error)) error {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		stat, err := stats()
+		if err != nil {
+			return err
+		}
+		if stat.ReadyCount == 0 && stat.DelayedCount == 0 && stat.UnackedCount() == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// StatsHistory returns the recorded stats snapshots, oldest first
+// returns nil if the history wasn't enabled with WithStatsHistory
+func (queue *redisQueue) StatsHistory() []TimestampedStats {
+	if queue.statsHistory == nil {
+		return nil
+	}
+	return queue.statsHistory.snapshots()
+}
+
+// ReturnAllUnackedE moves all unacked deliveries back to the ready list like
+// ReturnAllUnacked, but returns redis errors instead of panicking. The move is
+// atomic, so after an error no delivery was moved and it can be retried
+func (queue *redisQueue) ReturnAllUnackedE() (int, error) {
+	placement := "front"
+	if queue.strictFIFO {
+		placement = "end"
+	}
+	return queue.returnAllUnacked(placement)
+}
+
+// ReturnAllUnacked atomically moves all unacked deliveries back to the front of
+// the ready list and deletes the unacked key afterwards, returns number of
+// returned deliveries. The returned deliveries keep the order they were
+// consumed in, so they get consumed again in that order before the other ready
+// deliveries. Queues opened WithStrictFIFO return them to the end instead
+func (queue *redisQueue) ReturnAllUnacked() int {
+	returned, err := queue.ReturnAllUnackedE()
+	if err != nil {
+		log.Panicf("rmq redis error is not nil %s", err)
+	}
+	return returned
+}
+
+// ReturnAllUnackedToFront is like ReturnAllUnackedE, but returns ErrStrictFIFO
+// if the queue was opened WithStrictFIFO rather than moving the deliveries to
+// the end of the ready list
+func (queue *redisQueue) ReturnAllUnackedToFront() (int, error) {
+	if queue.strictFIFO {
+		return 0, ErrStrictFIFO
+	}
+	return queue.returnAllUnacked("front")
+}
+
+// returnAllUnacked runs returnUnackedScript with the given placement, front or
+// end of the ready list
+func (queue *redisQueue) returnAllUnacked(placement string) (int, error) {
+	return returnUnackedScript.Run(context.Background(), queue.redisClient,
+		[]string{queue.unackedKey, queue.readyKey, queue.leasesKey},
+		queue.migrateChunkSize,
+		placement,
+	).Int()
+}
+
+// ReturnAllRejected moves all rejected deliveries back to the ready
+// list and returns the number of returned deliveries
+func (queue *redisQueue) ReturnAllRejected() int {
+	result := queue.redisClient.LLen(context.Background(), queue.rejectedKey)
+	if redisErrIsNil(result) {
+		return 0
+	}
+
+	rejectedCount := int(result.Val())
+	returned := queue.ReturnRejected(rejectedCount)
+	queue.dropRejectedStamps()
+	return returned
+}
+
+// ReturnRejectedSince moves the deliveries which got rejected after since
+// back to the ready list and returns the number of returned deliveries.
+// Deliveries rejected before this was supported have no rejection time and
+// are never returned
+func (queue *redisQueue) ReturnRejectedSince(since time.Time) (int, error) {
+	return queue.returnRejectedSince(since, queue.readyKey, "list")
+}
+
+// returnRejectedSince moves the deliveries which got rejected after since to
+// the list or stream key, depending on kind. It runs returnRejectedSinceScript
+// in chunks, so it doesn't block Redis for long when many got rejected
+func (queue *redisQueue) returnRejectedSince(since time.Time, key, kind string) (int, error) {
+	returned := 0
+	for {
+		result, err := returnRejectedSinceScript.Run(context.Background(), queue.redisClient,
+			[]string{queue.rejectedAtKey, queue.rejectedKey, key, queue.rejectReasonsKey},
+			rejectedScore(since),
+			kind,
+			queue.migrateChunkSize,
+			rejectedTokenLength,
+		).Result()
+		if err != nil {
+			return returned, err
+		}
+
+		counts, _ := result.([]interface{})
+		if len(counts) != 2 {
+			return returned, fmt.Errorf("rmq queue failed to return rejected %s: unexpected result %v", queue, result)
+		}
+		chunkReturned, _ := counts[0].(int64)
+		scanned, _ := counts[1].(int64)
+		returned += int(chunkReturned)
+		if int(scanned) < queue.migrateChunkSize {
+			return returned, nil
+		}
+	}
+}
+
+// ReturnRejectedWithDelay moves up to count rejected deliveries to the delayed
+// set, due after delay, and returns the number of moved deliveries. Use it to
+// retry failures once a downstream outage is likely over, instead of failing
+// them again right away like ReturnRejected would. Stops early once the delayed
+// set is full, see WithMaxDelayed. Rejected deliveries whose payload is delayed
+// already stay rejected and aren't counted
+func (queue *redisQueue) ReturnRejectedWithDelay(count int, delay time.Duration) (int, error) {
+	if count <= 0 {
+		return 0, nil
+	}
+
+	return returnRejectedDelayedScript.Run(context.Background(), queue.redisClient,
+		[]string{queue.rejectedKey, queue.delayedKey, queue.rejectedAtKey, queue.rejectReasonsKey},
+		count,
+		delayedScore(queue.clock.Now().Add(delay)),
+		queue.maxDelayed,
+		rejectedTokenLength,
+	).Int()
+}
+
+// ReturnRejected tries to return count rejected deliveries back to
+// the ready list and returns the number of returned deliveries
+func (queue *redisQueue) ReturnRejected(count int) int {
+	if count == 0 {
+		return 0
+	}
+
+	return queue.returnRejected(count, queue.readyKey, "list")
+}
+
+// returnRejected moves up to count of the oldest rejected deliveries to the
+// end of the list or stream key, depending on kind, together with dropping
+// their rejection times
+func (queue *redisQueue) returnRejected(count int, key, kind string) int {
+	result := returnRejectedScript.Run(context.Background(), queue.redisClient,
+		[]string{queue.rejectedKey, key, queue.rejectedAtKey, queue.rejectReasonsKey},
+		count,
+		kind,
+		rejectedTokenLength,
+	)
+	if redisErrIsNil(result) {
+		return 0
+	}
+	returned, _ := result.Val().(int64)
+	queue.debugf("rmq queue returned %d rejected deliveries %s", returned, key)
+	return int(returned)
+}
+
+// CloseInConnection closes the queue in the associated connection by removing
+// all related keys, including the consumers of a queue which didn't stop
+// consuming cleanly
+func (queue *redisQueue) CloseInConnection() {
+	redisErrIsNil(queue.redisClient.Del(context.Background(), queue.unackedKey))
+	redisErrIsNil(queue.redisClient.Del(context.Background(), queue.leasesKey))
+	redisErrIsNil(queue.redisClient.Del(context.Background(), queue.consumersKey))
+	redisErrIsNil(queue.redisClient.SRem(context.Background(), queue.queuesKey, queue.name))
+	atomic.StoreInt32(&queue.pullRegistered, 0)
+}
+
+// SetPushQueue sets the queue deliveries get moved to on Push, returns
+// ErrUnsupportedPushQueue if deliveries can't be moved to the given queue
+func (queue *redisQueue) SetPushQueue(pushQueue Queue) error {
+	if pushQueue == DiscardQueue {
+		queue.pushKey = ""
+		queue.pushDiscard = true
+		return nil
+	}
+
+	target, ok := pushTargetOf(pushQueue)
+	if !ok {
+		return ErrUnsupportedPushQueue
+	}
+
+	queue.pushKey = target.readyKeyName()
+	queue.pushDiscard = false
+	return nil
+}
+
+// DiscardQueue can be set as push queue with SetPushQueue to make Push discard
+// deliveries, which acks them without storing their payload anywhere. It's
+// only meant as push target, using it otherwise works like a TestQueue which
+// records nothing, so publishing to it drops the payloads
+var DiscardQueue Queue = &discardQueue{&TestQueue{name: "rmq-discard", discard: true, uniqueTags: map[string]bool{}}}
+
+type discardQueue struct {
+	*TestQueue
+}
+
+// pushTarget is implemented by queues deliveries can be moved to
+type pushTarget interface {
+	readyKeyName() string
+	wrap(payload string) string
+}
+
+// pushTargetOf returns the queue as push target if deliveries can be pushed to
+// it, which is the case for list queues but not for stream queues and test
+// queues, which don't store deliveries in Redis
+func pushTargetOf(queue Queue) (pushTarget, bool) {
+	if _, ok := queue.(*streamQueue); ok {
+		return nil, false
+	}
+	target, ok := queue.(pushTarget)
+	return target, ok
+}
+
+func (queue *redisQueue) readyKeyName() string {
+	return queue.readyKey
+}
+
+// SetRejectRouter sets the router which picks the queue deliveries rejected
+// with RejectWithReason get moved to, should be called before StartConsuming
+func (queue *redisQueue) SetRejectRouter(router RejectRouter) {
+	queue.rejectRouter = router
+}
+
+// SetRetryPolicy sets the policy Delivery.Retry uses for deliveries of this queue
+func (queue *redisQueue) SetRetryPolicy(policy RetryPolicy) {
+	queue.retryPolicy = &policy
+}
+
+// SetPayloadValidator sets a validator which checks each consumed payload
+// before it's handed to a consumer. Deliveries whose payload fails validation
+// get rejected with the validation error as reason and are never consumed
+func (queue *redisQueue) SetPayloadValidator(validator func(payload []byte) error) {
+	queue.payloadValidator = validator
+}
+
+// SetWatermarks makes the consume loop call callback when the ready count rises
+// above high, and then again once it falls below low. The ready count is sampled
+// on every poll, or every interval if WithStatsHistory is used. Should be called
+// before StartConsuming, low should be less than high
+func (queue *redisQueue) SetWatermarks(high, low int, callback func(queue string, count int, crossed Watermark)) {
+	queue.watermarks = &watermarks{
+		high:     high,
+		low:      low,
+		callback: callback,
+	}
+}
+
+// OnDrained makes the consume loop call callback once the ready and unacked
+// deliveries of the queue, as seen by this connection, dropped to zero after
+// there were some. The queue must be observed empty on consecutive polls, so a
+// short gap between two batches doesn't count. A queue which never had
+// deliveries never drains. Should be called before StartConsuming
+func (queue *redisQueue) OnDrained(callback func()) {
+	queue.drained = &drainedWatch{callback: callback}
+}
+
+// observeDrained counts the ready and unacked deliveries for OnDrained
+func (queue *redisQueue) observeDrained() {
+	if queue.drained == nil {
+		return
+	}
+
+	ctx := context.Background()
+	pipe := queue.redisClient.Pipeline()
+	readyCount := pipe.LLen(ctx, queue.readyKey)
+	unackedCount := pipe.LLen(ctx, queue.unackedKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return // try again next poll
+	}
+	queue.drained.observe(int(readyCount.Val() + unackedCount.Val()))
+}
+
+// StartConsuming starts consuming into a channel of size prefetchLimit
+// must be called before consumers can be added!
+// pollDuration is the duration the queue sleeps before checking for new deliveries
+// returns ErrAlreadyConsuming if the queue is already consuming or the redis error
+func (queue *redisQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) error {
+	if err := queue.prepareConsuming(prefetchLimit, pollDuration); err != nil {
+		return err
+	}
+	go queue.consume()
+	return nil
+}
+
+// prepareConsuming sets up everything StartConsuming needs except for running
+// the consume loop
+func (queue *redisQueue) prepareConsuming(prefetchLimit int, pollDuration time.Duration) error {
+	queue.attachMu.Lock()
+	defer queue.attachMu.Unlock()
+	if queue.deliveryChan != nil {
+		return ErrAlreadyConsuming
+	}
+
+	// add queue to list of queues consumed on this connection
+	if err := queue.redisClient.SAdd(context.Background(), queue.queuesKey, queue.name).Err(); err != nil {
+		return err
+	}
+
+	queue.prefetchLimit = prefetchLimit
+	queue.pollDuration = pollDuration
+	queue.deliveryChan = make(chan Delivery, prefetchLimit)
+	queue.consumeCtx, queue.consumeCancel = context.WithCancel(context.Background())
+	queue.consumingSince = time.Now()
+	atomic.StoreInt64(&queue.consumedCount, 0)
+	queue.unsettled = new(int64) // deliveries of an earlier run settle on their own counter
+	queue.resetErrorBudget()
+	// log.Printf("rmq queue started consuming %s %d %s", queue, prefetchLimit, pollDuration)
+	return nil
+}
+
+// StopConsuming stops fetching new deliveries. Consumers end after consuming
+// the already prefetched deliveries. Once the consume loop ended, StartConsuming
+// can be called again, consumers need to be added again afterwards
+func (queue *redisQueue) StopConsuming() bool {
+	queue.attachMu.Lock()
+	if queue.deliveryChan == nil || queue.consumingStopped {
+		queue.attachMu.Unlock()
+		return false // not consuming or already stopped
+	}
+	queue.consumingStopped = true
+	queue.attachMu.Unlock()
+
+	queue.consumeCancel()
+	return true
+}
+
+// ConsumeWithContext starts consuming and runs consumer until ctx is done, then
+// stops consuming and returns once consumer handled the prefetched deliveries.
+// Returns an error if consuming couldn't be started, for example
+// ErrAlreadyConsuming, and nil after ctx is done. This fits supervisors like
+// errgroup better than StartConsuming and AddConsumer
+func (queue *redisQueue) ConsumeWithContext(ctx context.Context, prefetchLimit int, pollDuration time.Duration, consumer Consumer) error {
+	return queue.consumeWithContext(ctx, func() error {
+		return queue.prepareConsuming(prefetchLimit, pollDuration)
+	}, queue.consume, consumer)
+}
+
+// ConsumeN pulls up to n deliveries one at a time and hands each to consumer,
+// which must ack or reject it. It stops early once the queue is empty or ctx is
+// done and returns how many deliveries were consumed, together with the error
+// of ctx or Redis if any. This fits jobs which drain a queue and exit better
+// than StartConsuming. It doesn't need StartConsuming and doesn't wait for new
+// deliveries
+func (queue *redisQueue) ConsumeN(ctx context.Context, n int, consumer Consumer) (int, error) {
+	return consumeN(ctx, queue, n, consumer)
+}
+
+// consumeN pulls up to n deliveries from queue and hands them to consumer
+func consumeN(ctx context.Context, queue Queue, n int, consumer Consumer) (int, error) {
+	processed := 0
+	for processed < n {
+		if err := ctx.Err(); err != nil {
+			return processed, err
+		}
+
+		// pull without the deadline of ctx, which would wait for deliveries
+		delivery, err := queue.Pull(context.Background())
+		if err == ErrNoDelivery {
+			return processed, nil
+		}
+		if err != nil {
+			return processed, err
+		}
+
+		consumer.Consume(delivery)
+		processed++
+	}
+	return processed, nil
+}
+
+// consumeWithContext implements ConsumeWithContext with the given functions to
+// prepare consuming and to run the consume loop. The loop only starts once the
+// consumer is attached, so it can't stop before that
+func (queue *redisQueue) consumeWithContext(ctx context.Context, prepare func() error, loop func(), consumer Consumer) error {
+	if err := prepare(); err != nil {
+		return err
+	}
+
+	name := queue.addConsumer("context")
+	counters := queue.countConsumer(name)
+	done := make(chan struct{})
+	queue.attach(func(deliveryChan chan Delivery) {
+		queue.consumerConsume(deliveryChan, counters, consumer)
+	}, func() { close(done) })
+	go loop()
+
+	select {
+	case <-ctx.Done():
+		queue.StopConsuming()
+		<-done // closed once the consume loop stopped and the channel is drained
+	case <-done: // the consume loop stopped by itself, see WithConsumeErrorBudget
+	}
+	return queue.ConsumeErr()
+}
+
+// Pull moves a single delivery from ready to unacked and returns it, the caller
+// must ack or reject it. If ctx has a deadline Pull blocks until a delivery is
+// ready or the deadline passed, otherwise it returns ErrNoDelivery right away
+// if the queue is empty. Pull can be used with or without StartConsuming
+func (queue *redisQueue) Pull(ctx context.Context) (Delivery, error) {
+	if err := queue.registerPull(ctx); err != nil {
+		return nil, err
+	}
+
+	deadline, blocking := ctx.Deadline()
+	for {
+		delivery, err := queue.pull(ctx, deadline, blocking)
+		if err == nil {
+			queue.touch()
+		}
+		if err == context.DeadlineExceeded {
+			return nil, ErrNoDelivery
+		}
+		if err != ErrNoDelivery || !blocking {
+			return delivery, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, ErrNoDelivery
+		}
+		if remaining > pullPollInterval {
+			remaining = pullPollInterval
+		}
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, ErrNoDelivery
+			}
+			return nil, ctx.Err()
+		case <-time.After(remaining):
+		}
+	}
+}
+
+// pull tries to move a single delivery from ready to unacked once. Without
+// leases and with at least a second left until the deadline it blocks for the
+// whole seconds of it. Redis only blocks for whole seconds and rounds shorter
+// timeouts up, so it could move a delivery after ctx ended and strand it in
+// unacked. Shorter waits and leased pulls poll instead
+func (queue *redisQueue) pull(ctx context.Context, deadline time.Time, blocking bool) (Delivery, error) {
+	if queue.leaseDuration > 0 {
+		delivery, err := queue.consumeLeased(ctx)
+		switch {
+		case err == redis.Nil:
+			return nil, ErrNoDelivery
+		case err != nil:
+			return nil, err
+		}
+		return delivery, nil
+	}
+
+	var result *redis.StringCmd
+	if timeout := time.Until(deadline).Truncate(time.Second); blocking && timeout > 0 {
+		result = queue.redisClient.BRPopLPush(ctx, queue.readyKey, queue.unackedKey, timeout)
+	} else {
+		result = queue.redisClient.RPopLPush(ctx, queue.readyKey, queue.unackedKey)
+	}
+
+	payload, err := result.Result()
+	switch {
+	case err == redis.Nil:
+		return nil, ErrNoDelivery
+	case err != nil && ctx.Err() != nil:
+		return nil, ctx.Err()
+	case err != nil:
+		return nil, err
+	}
+	return newDelivery(payload, "", queue), nil
 }
 
-func (queue *redisQueue) RejectedCount() int {
-	result := queue.redisClient.LLen(context.Background(), queue.rejectedKey)
-	if redisErrIsNil(result) {
-		return 0
+// registerPull adds the queue to the list of queues consumed on this
+// connection the first time it gets pulled from, so the cleaner returns our
+// unacked deliveries if we die
+func (queue *redisQueue) registerPull(ctx context.Context) error {
+	if atomic.LoadInt32(&queue.pullRegistered) == 1 {
+		return nil
 	}
-	return int(result.Val())
+	if err := queue.redisClient.SAdd(ctx, queue.queuesKey, queue.name).Err(); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&queue.pullRegistered, 1)
+	return nil
 }
 
-func (queue *redisQueue) DelayedCount() int {
-	result := queue.redisClient.ZCount(context.Background(), queue.delayedKey, "-inf", "+inf")
-	if redisErrIsNil(result) {
-		return 0
+// PullBatch atomically moves up to max deliveries from ready to unacked and
+// returns them, the caller must ack or reject each of them. It returns
+// ErrNoDelivery if the queue is empty. If ctx has a deadline and the queue is
+// empty, PullBatch blocks like Pull until the first delivery is ready and
+// returns it together with any others which are ready by then. If reading the
+// others fails, it returns the first delivery together with the error, the
+// caller must still settle it
+func (queue *redisQueue) PullBatch(ctx context.Context, max int) ([]Delivery, error) {
+	if max <= 0 {
+		return nil, ErrNoDelivery
 	}
-	return int(result.Val())
+
+	deliveries, err := queue.pullBatch(ctx, max)
+	if err != nil || len(deliveries) > 0 {
+		return deliveries, err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		return nil, ErrNoDelivery
+	}
+
+	first, err := queue.Pull(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := queue.pullBatch(ctx, max-1)
+	if err != nil {
+		// first is already unacked, let the caller settle it
+		return []Delivery{first}, err
+	}
+	return append([]Delivery{first}, rest...), nil
 }
 
-// ReturnAllUnacked moves all unacked deliveries back to the ready
-// queue and deletes the unacked key afterwards, returns number of returned
-// deliveries
-func (queue *redisQueue) ReturnAllUnacked() int {
-	result := queue.redisClient.LLen(context.Background(), queue.unackedKey)
-	if redisErrIsNil(result) {
-		return 0
+// pullBatch runs pullBatchScript for up to max deliveries without blocking
+func (queue *redisQueue) pullBatch(ctx context.Context, max int) ([]Delivery, error) {
+	if max <= 0 {
+		return nil, nil
+	}
+	if err := queue.registerPull(ctx); err != nil {
+		return nil, err
 	}
 
-	unackedCount := int(result.Val())
-	for i := 0; i < unackedCount; i++ {
-		if redisErrIsNil(queue.redisClient.RPopLPush(context.Background(), queue.unackedKey, queue.readyKey)) {
-			return i
+	args := []interface{}{max, ""}
+	var tokens []string
+	var expiry time.Time
+	if queue.leaseDuration > 0 {
+		expiry = time.Now().Add(queue.leaseDuration)
+		args[1] = leaseScore(expiry)
+		tokens = make([]string, max)
+		for i := range tokens {
+			tokens[i] = uniuri.NewLen(leaseTokenLength)
+			args = append(args, tokens[i])
 		}
-		// debug(fmt.Sprintf("rmq queue returned unacked delivery %s %s", result.Val(), queue.readyKey)) // COMMENTOUT
 	}
 
-	return unackedCount
+	val, err := pullBatchScript.Run(ctx, queue.redisClient,
+		[]string{queue.readyKey, queue.unackedKey, queue.leasesKey},
+		args...,
+	).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	payloads, _ := val.([]interface{})
+	if len(payloads) > 0 {
+		queue.touch()
+	}
+
+	deliveries := make([]Delivery, 0, len(payloads))
+	for i, payload := range payloads {
+		token := ""
+		if tokens != nil {
+			token = tokens[i]
+		}
+		delivery := newDelivery(payload.(string), token, queue)
+		delivery.leaseExpiry = expiry
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
 }
 
-// ReturnAllRejected moves all rejected deliveries back to the ready
-// list and returns the number of returned deliveries
-func (queue *redisQueue) ReturnAllRejected() int {
-	result := queue.redisClient.LLen(context.Background(), queue.rejectedKey)
-	if redisErrIsNil(result) {
-		return 0
+// AddConsumer adds a consumer to the queue and returns its internal name
+// panics if StartConsuming wasn't called before!
+func (queue *redisQueue) AddConsumer(tag string, consumer Consumer) string {
+	name := queue.addConsumer(tag)
+	counters := queue.countConsumer(name)
+	queue.attach(func(deliveryChan chan Delivery) { queue.consumerConsume(deliveryChan, counters, consumer) }, nil)
+	return name
+}
+
+// AddConsumerUnique is similar to AddConsumer, but returns
+// ErrDuplicateConsumerTag if a consumer with the same tag was already added
+// with AddConsumerUnique since the queue started consuming. This catches
+// wiring code which accidentally registers a consumer twice
+func (queue *redisQueue) AddConsumerUnique(tag string, consumer Consumer) (string, error) {
+	queue.attachMu.Lock()
+	if queue.uniqueTags[tag] {
+		queue.attachMu.Unlock()
+		return "", ErrDuplicateConsumerTag
 	}
+	queue.uniqueTags[tag] = true
+	queue.attachMu.Unlock()
 
-	rejectedCount := int(result.Val())
-	return queue.ReturnRejected(rejectedCount)
+	return queue.AddConsumer(tag, consumer), nil
 }
 
-// ReturnRejected tries to return count rejected deliveries back to
-// the ready list and returns the number of returned deliveries
-func (queue *redisQueue) ReturnRejected(count int) int {
-	if count == 0 {
-		return 0
+// AddConsumerWithHandle is similar to AddConsumer, but returns a handle which
+// can stop this consumer without stopping the others
+func (queue *redisQueue) AddConsumerWithHandle(tag string, consumer Consumer) *ConsumerHandle {
+	name := queue.addConsumer(tag)
+	handle := newConsumerHandle(name, queue)
+	counters := queue.countConsumer(name)
+	queue.attach(func(deliveryChan chan Delivery) { queue.handleConsume(deliveryChan, counters, consumer, handle) }, handle.finish)
+	return handle
+}
+
+// AddConsumerFunc adds concurrency consumers which all call fn, so up to
+// concurrency deliveries get processed at the same time. Returns the internal
+// names. The prefetch limit passed to StartConsuming only controls how many
+// deliveries get fetched ahead, it should be at least concurrency to keep all
+// consumers busy.
+// panics if StartConsuming wasn't called before or if concurrency < 1!
+func (queue *redisQueue) AddConsumerFunc(tag string, concurrency int, fn func(delivery Delivery)) []string {
+	if concurrency < 1 {
+		log.Panicf("rmq queue failed to add consumer func, need concurrency of at least 1, got %d %s", concurrency, queue)
 	}
 
-	for i := 0; i < count; i++ {
-		result := queue.redisClient.RPopLPush(context.Background(), queue.rejectedKey, queue.readyKey)
-		if redisErrIsNil(result) {
-			return i
-		}
-		// debug(fmt.Sprintf("rmq queue returned rejected delivery %s %s", result.Val(), queue.readyKey)) // COMMENTOUT
+	names := make([]string, concurrency)
+	for i := range names {
+		names[i] = queue.AddConsumer(tag, ConsumerFunc(fn))
 	}
+	return names
+}
 
-	return count
+// AddBatchConsumer is similar to AddConsumer, but for batches of deliveries
+func (queue *redisQueue) AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) string {
+	return queue.AddBatchConsumerWithTimeout(tag, batchSize, defaultBatchTimeout, consumer)
 }
 
-// CloseInConnection closes the queue in the associated connection by removing all related keys
-func (queue *redisQueue) CloseInConnection() {
-	redisErrIsNil(queue.redisClient.Del(context.Background(), queue.unackedKey))
-	redisErrIsNil(queue.redisClient.Del(context.Background(), queue.consumersKey))
-	redisErrIsNil(queue.redisClient.SRem(context.Background(), queue.queuesKey, queue.name))
+// AddBatchConsumerWithTimeout is like AddBatchConsumer, but consumes batches
+// which aren't full once timeout passed since their first delivery. When the
+// delivery channel gets closed, because consuming stopped or the channel got
+// replaced by ReconfigureConsuming, the partial batch is consumed right away
+func (queue *redisQueue) AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) string {
+	name := queue.addConsumer(tag)
+	counters := queue.countConsumer(name)
+	queue.attach(func(deliveryChan chan Delivery) {
+		queue.consumerBatchConsume(deliveryChan, counters, batchSize, timeout, consumer)
+	}, nil)
+	return name
 }
 
-func (queue *redisQueue) SetPushQueue(pushQueue Queue) {
-	redisPushQueue, ok := pushQueue.(*redisQueue)
-	if !ok {
-		return
+// AddFairConsumers adds consumers which get the deliveries in rotation, so each
+// of them consumes the same share in a predictable order. Returns the internal
+// names. Consumers added with AddConsumer instead all receive from the same
+// channel, which lets fast consumers take more deliveries than slow ones and
+// keeps everyone busy. With fair dispatch a slow consumer holds up the
+// rotation instead: the others idle while waiting for its turn, so the
+// throughput is bounded by the slowest consumer.
+// panics if StartConsuming wasn't called before or if consumers is empty!
+func (queue *redisQueue) AddFairConsumers(tag string, consumers []Consumer) []string {
+	if len(consumers) == 0 {
+		log.Panicf("rmq queue failed to add fair consumers, need at least one consumer %s", queue)
+	}
+
+	names := make([]string, len(consumers))
+	turns := make([]chan Delivery, len(consumers))
+	for i, consumer := range consumers {
+		names[i] = queue.addConsumer(tag)
+		turns[i] = make(chan Delivery, 1)
+		turn, counters, consumer := turns[i], queue.countConsumer(names[i]), consumer
+		queue.spawn(func() { queue.partitionConsume(turn, counters, consumer) })
 	}
 
-	queue.pushKey = redisPushQueue.readyKey
+	queue.attach(func(deliveryChan chan Delivery) { queue.rotateDeliveries(deliveryChan, turns) }, func() {
+		for _, turn := range turns {
+			close(turn)
+		}
+	})
+	return names
 }
 
-// StartConsuming starts consuming into a channel of size prefetchLimit
-// must be called before consumers can be added!
-// pollDuration is the duration the queue sleeps before checking for new deliveries
-func (queue *redisQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) bool {
-	if queue.deliveryChan != nil {
-		return false // already consuming
+// AddPartitionedConsumers adds count consumers which each consume their own
+// partition of the deliveries. The partition of a delivery is determined by the
+// hash of the key keyFn returns for its payload, so all deliveries with the same
+// key are consumed in order by the same consumer. Returns the internal names.
+// panics if StartConsuming wasn't called before, if count is less than one or
+// if len(consumers) != count!
+func (queue *redisQueue) AddPartitionedConsumers(tag string, count int, keyFn func(payload string) string, consumers []Consumer) []string {
+	if count < 1 || len(consumers) != count {
+		log.Panicf("rmq queue failed to add partitioned consumers, need %d consumers, got %d %s", count, len(consumers), queue)
 	}
 
-	// add queue to list of queues consumed on this connection
-	if redisErrIsNil(queue.redisClient.SAdd(context.Background(), queue.queuesKey, queue.name)) {
-		log.Panicf("rmq queue failed to start consuming %s", queue)
+	names := make([]string, count)
+	partitions := make([]chan Delivery, count)
+	for i, consumer := range consumers {
+		names[i] = queue.addConsumer(tag)
+		partitions[i] = make(chan Delivery, 1) // like AddFairConsumers, a busy partition backs up into the delivery channel
+		partition, counters, consumer := partitions[i], queue.countConsumer(names[i]), consumer
+		queue.spawn(func() { queue.partitionConsume(partition, counters, consumer) })
 	}
 
-	queue.prefetchLimit = prefetchLimit
-	queue.pollDuration = pollDuration
-	queue.deliveryChan = make(chan Delivery, prefetchLimit)
-	// log.Printf("rmq queue started consuming %s %d %s", queue, prefetchLimit, pollDuration)
-	go queue.consume()
-	return true
+	queue.attach(func(deliveryChan chan Delivery) { queue.partitionDeliveries(deliveryChan, keyFn, partitions) }, func() {
+		for _, partition := range partitions {
+			close(partition)
+		}
+	})
+	return names
 }
 
-func (queue *redisQueue) StopConsuming() bool {
-	if queue.deliveryChan == nil || queue.consumingStopped {
-		return false // not consuming or already stopped
-	}
+// PollStats returns how often the consume loop of the queue polled Redis for
+// deliveries and found none or some since the queue was opened
+func (queue *redisQueue) PollStats() PollStat {
+	return queue.polls.stat()
+}
 
-	queue.consumingStopped = true
-	return true
+// LastBatchSizes returns the number of deliveries the consume loop tried to
+// fetch in each of its 32 most recent polls, oldest first. Sizes at the
+// prefetch limit mean the consumers are the bottleneck, while many small sizes
+// mean the loop mostly waits for Redis
+func (queue *redisQueue) LastBatchSizes() []int {
+	return queue.polls.lastBatchSizes()
 }
 
-// AddConsumer adds a consumer to the queue and returns its internal name
-// panics if StartConsuming wasn't called before!
-func (queue *redisQueue) AddConsumer(tag string, consumer Consumer) string {
-	name := queue.addConsumer(tag)
-	go queue.consumerConsume(consumer)
-	return name
+// ConsumedCount returns how many deliveries the consumers of this queue acked
+// in this process since consuming started, including deliveries acked by
+// WithAutoAck. Unlike the counts read from Redis it only covers this process,
+// which makes it suitable for throughput graphs
+func (queue *redisQueue) ConsumedCount() int64 {
+	return atomic.LoadInt64(&queue.consumedCount)
 }
 
-// AddBatchConsumer is similar to AddConsumer, but for batches of deliveries
-func (queue *redisQueue) AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) string {
-	return queue.AddBatchConsumerWithTimeout(tag, batchSize, defaultBatchTimeout, consumer)
+// ConsumerStats returns the number of deliveries the consumer with the given
+// internal name consumed, acked and rejected since it was added. Returns false
+// if no consumer with that name was added to this queue
+func (queue *redisQueue) ConsumerStats(name string) (ConsumerStat, bool) {
+	queue.consumerStatsMu.Lock()
+	counters, ok := queue.consumerStats[name]
+	queue.consumerStatsMu.Unlock()
+	if !ok {
+		return ConsumerStat{}, false
+	}
+	return counters.stat(), true
 }
 
-func (queue *redisQueue) AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) string {
-	name := queue.addConsumer(tag)
-	go queue.consumerBatchConsume(batchSize, timeout, consumer)
-	return name
+// countConsumer registers and returns the counters of a new consumer
+func (queue *redisQueue) countConsumer(name string) *consumerCounters {
+	counters := &consumerCounters{queueAcked: &queue.consumedCount}
+	queue.consumerStatsMu.Lock()
+	queue.consumerStats[name] = counters
+	queue.consumerStatsMu.Unlock()
+	return counters
 }
 
 func (queue *redisQueue) GetConsumers() []string {
@@ -326,7 +1817,7 @@ func (queue *redisQueue) RemoveConsumer(name string) bool {
 }
 
 func (queue *redisQueue) addConsumer(tag string) string {
-	if queue.deliveryChan == nil {
+	if queue.consumeChan() == nil {
 		log.Panicf("rmq queue failed to add consumer, call StartConsuming first! %s", queue)
 	}
 
@@ -351,53 +1842,241 @@ func (queue *redisQueue) RemoveAllConsumers() int {
 
 func (queue *redisQueue) consume() {
 	for {
-		queue.migrateExpiredDeliveries(queue.delayedKey, queue.readyKey, time.Now())
+		migrated := queue.migrateExpiredDeliveries(queue.delayedKey, queue.readyKey, queue.clock.Now())
+		queue.sampleStats(time.Now())
 
-		batchSize := queue.batchSize()
+		batchSize := queue.takeTokens(queue.pollBatchSize(time.Now()))
+		queue.polls.sized(batchSize)
 		wantMore := queue.consumeBatch(batchSize)
-
-		if !wantMore {
-			time.Sleep(queue.pollDuration)
+		queue.observeDrained()
+
+		// while warming up consume at most one batch per poll, otherwise
+		// deliveries which just became due are consumed without sleeping,
+		// unless nothing could be consumed because prefetch is full or the
+		// release rate is exhausted
+		if batchSize == 0 || (!wantMore && migrated == 0) || queue.warmingUp(time.Now()) {
+			time.Sleep(queue.pollSleepDuration())
 		}
 
-		if queue.consumingStopped {
+		if queue.spendErrorBudget() {
+			queue.stopConsume()
+			return
+		}
+		queue.applyReconfigure()
+		if queue.stopping() {
 			// log.Printf("rmq queue stopped consuming %s", queue)
+			queue.stopConsume()
 			return
 		}
 	}
 }
 
-func (queue *redisQueue) migrateExpiredDeliveries(from string, to string, curr time.Time) bool {
-	cmd := queue.redisClient.Eval(context.Background(),
-		`-- Get all of the jobs with an expired "score"...
-		local val = redis.call('zrangebyscore', KEYS[1], '-inf', ARGV[1])
+// touch stamps the current time as last activity of the queue, at most once
+// per activityInterval. It gets called when deliveries are published or
+// consumed, not when polling finds none. Failing to stamp is ignored
+func (queue *redisQueue) touch() {
+	now := time.Now()
+	last := atomic.LoadInt64(&queue.lastActivity)
+	if now.UnixNano()-last < int64(activityInterval) {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&queue.lastActivity, last, now.UnixNano()) {
+		return // touched concurrently
+	}
+	queue.redisClient.Set(context.Background(), queue.activityKey, now.UnixNano()/int64(time.Millisecond), 0)
+}
+
+// takeTokens takes up to count tokens from the token bucket of the queue and
+// returns how many it got, count if the queue isn't rate limited. Tokens which
+// aren't used because the queue has fewer ready deliveries are lost
+func (queue *redisQueue) takeTokens(count int) int {
+	if queue.rateLimit <= 0 || count == 0 {
+		return count
+	}
+
+	taken, err := takeTokensScript.Run(context.Background(), queue.redisClient,
+		[]string{queue.rateKey},
+		queue.rateLimit,
+		queue.rateBurst,
+		time.Now().UnixNano()/int64(time.Millisecond),
+		count,
+	).Int()
+	if err != nil {
+		queue.consumeFailed(err)
+		return 0
+	}
+	return taken
+}
+
+// stopConsume closes the delivery channel, which ends all consumers once they
+// consumed the prefetched deliveries, removes the consumers from the consumers
+// set and resets the queue so StartConsuming can be called again
+func (queue *redisQueue) stopConsume() {
+	// removed before the consumers end, so they are gone once ConsumeWithContext
+	// returns. If redis is down they stay until the cleaner removes them
+	queue.redisClient.Del(context.Background(), queue.consumersKey)
+	queue.attachMu.Lock()
+	close(queue.deliveryChan)
+	queue.deliveryChan = nil
+	queue.successors = map[chan Delivery]chan Delivery{}
+	queue.uniqueTags = map[string]bool{}
+	queue.consumingStopped = false
+	queue.attachMu.Unlock()
+}
 
-		-- If we have values in the array, we will remove them from the first queue
-		-- and add them onto the destination queue in chunks of 100, which moves
-		-- all of the appropriate jobs onto the destination queue very safely.
-		if(next(val) ~= nil) then
-			redis.call('zremrangebyrank', KEYS[1], 0, #val - 1)
+// consumeChan returns the current delivery channel, nil if the queue isn't
+// consuming. ReconfigureConsuming replaces it while consuming
+func (queue *redisQueue) consumeChan() chan Delivery {
+	queue.attachMu.Lock()
+	defer queue.attachMu.Unlock()
+	return queue.deliveryChan
+}
 
-			for i = 1, #val, 100 do
-				redis.call('rpush', KEYS[2], unpack(val, i, math.min(i+99, #val)))
-			end
-		end
+// stopping returns whether StopConsuming or the error budget asked the consume
+// loop to stop
+func (queue *redisQueue) stopping() bool {
+	queue.attachMu.Lock()
+	defer queue.attachMu.Unlock()
+	return queue.consumingStopped
+}
 
-		return val`,
-		[]string{from, to},
-		curr.Unix(),
-	)
-	return redisErrIsNil(cmd)
+// migratePlacement returns where migrateScript puts due deliveries, the front
+// of the ready list unless the queue is strict FIFO
+func (queue *redisQueue) migratePlacement() string {
+	if queue.strictFIFO {
+		return "end"
+	}
+	return "front"
+}
+
+// migrateExpiredDeliveries moves the deliveries which are due at curr and
+// returns how many were moved
+func (queue *redisQueue) migrateExpiredDeliveries(from string, to string, curr time.Time) int {
+	args := []interface{}{dueScore(curr), queue.migrateChunkSize, queue.migratePlacement()}
+	if queue.releaseRate > 0 {
+		limit := queue.releaseLimit(curr)
+		if limit == 0 {
+			return 0
+		}
+		args = append(args, limit)
+	}
+
+	cmd := migrateScript.Run(context.Background(), queue.redisClient, []string{from, to}, args...)
+	if err := cmd.Err(); err == redis.Nil {
+		return 0
+	} else if err != nil {
+		queue.consumeFailed(err)
+		return 0
+	}
+	moved, _ := cmd.Val().([]interface{})
+	queue.releaseCredit -= float64(len(moved))
+	return len(moved)
 }
 
-func (queue *redisQueue) batchSize() int {
-	prefetchCount := len(queue.deliveryChan)
-	prefetchLimit := queue.prefetchLimit - prefetchCount
+// releaseLimit returns how many delayed deliveries may be migrated at curr
+// under WithDelayedReleaseRate. The credit grows by the rate per elapsed
+// second up to one second's worth, so a pause doesn't build up a spike
+func (queue *redisQueue) releaseLimit(curr time.Time) int {
+	max := math.Max(queue.releaseRate, 1)
+	if queue.releasedAt.IsZero() {
+		queue.releaseCredit = max
+	} else if elapsed := curr.Sub(queue.releasedAt); elapsed > 0 {
+		queue.releaseCredit = math.Min(max, queue.releaseCredit+elapsed.Seconds()*queue.releaseRate)
+	}
+	queue.releasedAt = curr
+	return int(math.Max(queue.releaseCredit, 0))
+}
+
+// pollSleepDuration returns pollDuration varied by up to ± pollJitter of it,
+// so consumers with the same pollDuration don't poll in sync
+func (queue *redisQueue) pollSleepDuration() time.Duration {
+	if queue.pollJitter == 0 {
+		return queue.pollDuration
+	}
+
+	jitter := (rand.Float64()*2 - 1) * queue.pollJitter * float64(queue.pollDuration)
+	return queue.pollDuration + time.Duration(jitter)
+}
+
+// sampleStats samples the stats for the history and the watermarks if any of
+// them is enabled and the last sample is at least statsInterval old
+func (queue *redisQueue) sampleStats(now time.Time) {
+	if queue.statsHistory == nil && queue.watermarks == nil {
+		return
+	}
+	if now.Sub(queue.lastStatsSample) < queue.statsInterval {
+		return
+	}
+
+	stat, err := queue.Stats()
+	if err != nil {
+		return // try again on the next iteration
+	}
+	queue.lastStatsSample = now
+
+	if queue.statsHistory != nil {
+		queue.statsHistory.add(TimestampedStats{Time: now, Stats: stat})
+	}
+	if queue.watermarks != nil {
+		queue.watermarks.observe(queue.name, stat.ReadyCount)
+	}
+}
+
+// pollBatchSize returns the batch size for the next poll, a poll which found
+// the ready list empty counts as empty in the poll stats
+func (queue *redisQueue) pollBatchSize(now time.Time) int {
+	batchSize, readyEmpty := queue.batchSize(now)
+	if readyEmpty {
+		queue.polls.polled(0)
+	}
+	return batchSize
+}
+
+// batchSize returns how many deliveries to consume next and whether the
+// ready list was empty, which is only checked if the prefetch limit allows
+// consuming any
+func (queue *redisQueue) batchSize(now time.Time) (int, bool) {
+	prefetchCount := len(queue.consumeChan())
+	if queue.countsUnsettled() {
+		prefetchCount = int(atomic.LoadInt64(queue.unsettled))
+	}
+	prefetchLimit := queue.warmedUpPrefetchLimit(now) - prefetchCount
+	if prefetchLimit <= 0 {
+		return 0, false
+	}
 	// TODO: ignore ready count here and just return prefetchLimit?
-	if readyCount := queue.ReadyCount(); readyCount < prefetchLimit {
-		return readyCount
+	readyCount, err := queue.redisClient.LLen(context.Background(), queue.readyKey).Result()
+	if err != nil {
+		queue.consumeFailed(err)
+		return 0, false
+	}
+	if int(readyCount) < prefetchLimit {
+		return int(readyCount), readyCount == 0
 	}
-	return prefetchLimit
+	return prefetchLimit, false
+}
+
+// countsUnsettled returns true if deliveries count towards the prefetch limit
+// until they are settled, see WithHardPrefetchLimit. Auto acked deliveries are
+// settled before the consumers get them, so they only count while prefetched
+func (queue *redisQueue) countsUnsettled() bool {
+	return queue.hardPrefetch && !queue.autoAck
+}
+
+// warmingUp returns true during the warm up window after consuming started
+func (queue *redisQueue) warmingUp(now time.Time) bool {
+	return now.Sub(queue.consumingSince) < queue.warmUp
+}
+
+// warmedUpPrefetchLimit returns the prefetch limit, which grows linearly from
+// 1 to prefetchLimit during the warm up window after consuming started
+func (queue *redisQueue) warmedUpPrefetchLimit(now time.Time) int {
+	if !queue.warmingUp(now) || queue.prefetchLimit <= 1 {
+		return queue.prefetchLimit
+	}
+
+	progress := float64(now.Sub(queue.consumingSince)) / float64(queue.warmUp)
+	return 1 + int(float64(queue.prefetchLimit-1)*progress)
 }
 
 // consumeBatch tries to read batchSize deliveries, returns true if any and all were consumed
@@ -407,67 +2086,256 @@ func (queue *redisQueue) consumeBatch(batchSize int) bool {
 	}
 
 	for i := 0; i < batchSize; i++ {
+		if !queue.inFlight.acquire(queue.consumeCtx) {
+			queue.polls.polled(i) // stopped consuming while waiting for a slot
+			return false
+		}
+
+		if queue.leaseDuration > 0 {
+			delivery, err := queue.consumeLeased(context.Background())
+			if err != nil {
+				if err != redis.Nil {
+					queue.consumeFailed(err)
+				}
+				queue.inFlight.release()
+				queue.polls.polled(i)
+				return false
+			}
+			queue.deliver(delivery)
+			continue
+		}
+
 		result := queue.redisClient.RPopLPush(context.Background(), queue.readyKey, queue.unackedKey)
-		if redisErrIsNil(result) {
-			// debug(fmt.Sprintf("rmq queue consumed last batch %s %d", queue, i)) // COMMENTOUT
+		if err := result.Err(); err != nil {
+			if err != redis.Nil {
+				queue.consumeFailed(err)
+			}
+			queue.debugf("rmq queue consumed last batch %s %d", queue, i)
+			queue.inFlight.release()
+			queue.polls.polled(i)
 			return false
 		}
 
-		// debug(fmt.Sprintf("consume %d/%d %s %s", i, batchSize, result.Val(), queue)) // COMMENTOUT
-		queue.deliveryChan <- newDelivery(result.Val(), queue.unackedKey, queue.rejectedKey, queue.pushKey, queue.delayedKey, queue.redisClient)
+		queue.debugf("consume %d/%d %s %s", i, batchSize, result.Val(), queue)
+		queue.deliver(newDelivery(result.Val(), "", queue))
 	}
 
-	// debug(fmt.Sprintf("rmq queue consumed batch %s %d", queue, batchSize)) // COMMENTOUT
+	queue.debugf("rmq queue consumed batch %s %d", queue, batchSize)
+	queue.polls.polled(batchSize)
 	return true
 }
 
-func (queue *redisQueue) consumerConsume(consumer Consumer) {
-	for delivery := range queue.deliveryChan {
-		// debug(fmt.Sprintf("consumer consume %s %s", delivery, consumer)) // COMMENTOUT
+// deliver hands the delivery to the consumers, unless its payload fails
+// validation, in which case it gets rejected
+func (queue *redisQueue) deliver(delivery *wrapDelivery) {
+	queue.touch()
+	delivery.inFlight = queue.inFlight
+	delivery.loopFailed = queue.consumeFailed
+	if queue.countsUnsettled() {
+		atomic.AddInt64(queue.unsettled, 1)
+		delivery.unsettled = queue.unsettled
+	}
+	queue.drained.consumed()
+	if queue.handlePoison(delivery.payload, delivery) {
+		return
+	}
+	if queue.payloadValidator != nil {
+		if err := queue.payloadValidator([]byte(delivery.Payload())); err != nil {
+			delivery.RejectWithReason(err.Error())
+			return
+		}
+	}
+
+	if queue.autoAck && delivery.ack() {
+		atomic.AddInt64(&queue.consumedCount, 1) // no consumer counters yet to count the ack
+	}
+	delivery.loopFailed = nil
+	delivery.ctx = queue.consumeCtx
+	queue.consumeChan() <- delivery
+}
+
+// consumeLeased moves one delivery from ready to unacked and leases it in a
+// single step, returns redis.Nil if there was no ready delivery
+func (queue *redisQueue) consumeLeased(ctx context.Context) (*wrapDelivery, error) {
+	token := uniuri.NewLen(leaseTokenLength)
+	expiry := time.Now().Add(queue.leaseDuration)
+	result := consumeLeasedScript.Run(ctx, queue.redisClient,
+		[]string{queue.readyKey, queue.unackedKey, queue.leasesKey},
+		leaseScore(expiry),
+		token,
+	)
+	payload, err := result.Text()
+	if err != nil {
+		return nil, err
+	}
+	delivery := newDelivery(payload, token, queue)
+	delivery.leaseExpiry = expiry
+	return delivery, nil
+}
+
+// ReturnExpiredLeases moves all unacked deliveries of the queue whose lease
+// expired back to the ready list and returns the number of returned
+// deliveries. Like the cleaner it checks the leases of all connections, so
+// leases held by a stuck consumer of another connection get reclaimed too.
+// Acking or rejecting a returned delivery afterwards fails, so it can't be
+// processed twice
+func (queue *redisQueue) ReturnExpiredLeases() (int, error) {
+	connectionNames, err := queue.redisClient.SMembers(context.Background(), queue.keys.ConnectionsKey()).Result()
+	if err != nil {
+		return 0, err
+	}
+	own := false
+	for _, connectionName := range connectionNames {
+		own = own || connectionName == queue.connectionName
+	}
+	if !own { // not registered anymore, still reap its own leases
+		connectionNames = append(connectionNames, queue.connectionName)
+	}
+
+	now := leaseScore(time.Now())
+	total := 0
+	for _, connectionName := range connectionNames {
+		result := returnExpiredLeasesScript.Run(context.Background(), queue.redisClient,
+			[]string{
+				queue.keys.LeasesKey(connectionName, queue.name),
+				queue.keys.UnackedKey(connectionName, queue.name),
+				queue.readyKey,
+			},
+			now,
+			leaseTokenLength,
+		)
+		returned, err := result.Int()
+		if err != nil {
+			return total, err
+		}
+		total += returned
+	}
+	return total, nil
+}
+
+func (queue *redisQueue) consumerConsume(deliveryChan chan Delivery, counters *consumerCounters, consumer Consumer) {
+	for delivery := range deliveryChan {
+		queue.debugf("consumer consume %s %v", delivery, consumer)
+		counters.consumed(delivery)
+		consumer.Consume(delivery)
+	}
+}
+
+// spawn runs fn on the executor of the queue, or in a new goroutine if it has none
+func (queue *redisQueue) spawn(fn func()) {
+	if queue.executor != nil {
+		queue.executor.Submit(fn)
+		return
+	}
+	go fn()
+}
+
+// handleConsume consumes like consumerConsume until the handle gets stopped
+func (queue *redisQueue) handleConsume(deliveryChan chan Delivery, counters *consumerCounters, consumer Consumer, handle *ConsumerHandle) {
+	for !handle.stopped() {
+		select {
+		case <-handle.stop:
+			return
+		case delivery, ok := <-deliveryChan:
+			if !ok {
+				return
+			}
+			if handle.stopped() { // stopped while waiting, hand the delivery to the others
+				requeue(delivery)
+				return
+			}
+			counters.consumed(delivery)
+			consumer.Consume(delivery)
+		}
+	}
+}
+
+// partitionDeliveries routes each delivery to the partition of its key
+func (queue *redisQueue) partitionDeliveries(deliveryChan chan Delivery, keyFn func(payload string) string, partitions []chan Delivery) {
+	for delivery := range deliveryChan {
+		hash := fnv.New32a()
+		hash.Write([]byte(keyFn(delivery.Payload())))
+		partitions[hash.Sum32()%uint32(len(partitions))] <- delivery
+	}
+}
+
+// rotateDeliveries hands the deliveries to the given channels in rotation
+func (queue *redisQueue) rotateDeliveries(deliveryChan chan Delivery, turns []chan Delivery) {
+	next := 0
+	for delivery := range deliveryChan {
+		turns[next] <- delivery
+		next = (next + 1) % len(turns)
+	}
+}
+
+func (queue *redisQueue) partitionConsume(partition chan Delivery, counters *consumerCounters, consumer Consumer) {
+	for delivery := range partition {
+		counters.consumed(delivery)
 		consumer.Consume(delivery)
 	}
 }
 
-func (queue *redisQueue) consumerBatchConsume(batchSize int, timeout time.Duration, consumer BatchConsumer) {
+func (queue *redisQueue) consumerBatchConsume(deliveryChan chan Delivery, counters *consumerCounters, batchSize int, timeout time.Duration, consumer BatchConsumer) {
 	batch := []Delivery{}
 	timer := time.NewTimer(timeout)
 	stopTimer(timer) // timer not active yet
 
 	for {
+		flushedByTimeout := false
+
 		select {
 		case <-timer.C:
-			// debug("batch timer fired") // COMMENTOUT
+			queue.debugf("batch timer fired")
+			flushedByTimeout = true
 			// consume batch below
 
-		case delivery, ok := <-queue.deliveryChan:
+		case delivery, ok := <-deliveryChan:
 			if !ok {
-				// debug("batch channel closed") // COMMENTOUT
+				queue.debugf("batch channel closed")
+				// flush the partial batch, its deliveries are unacked already
+				if len(batch) > 0 {
+					consumeBatchWith(consumer, batch, false)
+				}
 				return
 			}
 
+			counters.consumed(delivery)
 			batch = append(batch, delivery)
-			// debug(fmt.Sprintf("batch consume added delivery %d", len(batch))) // COMMENTOUT
+			queue.debugf("batch consume added delivery %d", len(batch))
 
 			if len(batch) == 1 { // added first delivery
 				timer.Reset(timeout) // set timer to fire
 			}
 
 			if len(batch) < batchSize {
-				// debug(fmt.Sprintf("batch consume wait %d < %d", len(batch), batchSize)) // COMMENTOUT
+				queue.debugf("batch consume wait %d < %d", len(batch), batchSize)
 				continue
 			}
 
 			// consume batch below
 		}
 
-		// debug(fmt.Sprintf("batch consume consume %d", len(batch))) // COMMENTOUT
-		consumer.Consume(batch)
+		queue.debugf("batch consume consume %d", len(batch))
+		consumeBatchWith(consumer, batch, flushedByTimeout)
 
 		batch = batch[:0] // reset batch
 		stopTimer(timer)  // stop and drain the timer if it fired in between
 	}
 }
 
+// consumeBatchWith passes the batch to the consumer via the most specific
+// interface it implements
+func consumeBatchWith(consumer BatchConsumer, batch Deliveries, flushedByTimeout bool) {
+	switch c := consumer.(type) {
+	case ProgressBatchConsumer:
+		settleProgress(batch, c.ConsumeProgress(batch))
+	case FlushAwareBatchConsumer:
+		c.ConsumeBatch(Batch{deliveries: batch, flushedByTimeout: flushedByTimeout})
+	default:
+		c.Consume(batch)
+	}
+}
+
 func stopTimer(timer *time.Timer) {
 	if timer.Stop() {
 		return
@@ -482,10 +2350,19 @@ func stopTimer(timer *time.Timer) {
 // return number of deleted list items
 // https://www.redisgreen.net/blog/deleting-large-lists
 func (queue *redisQueue) deleteRedisList(key string) int {
+	total, _ := queue.deleteRedisListE(key)
+	return total
+}
+
+// deleteRedisListE is like deleteRedisList, but returns the first redis error
+func (queue *redisQueue) deleteRedisListE(key string) (int, error) {
 	llenResult := queue.redisClient.LLen(context.Background(), key)
+	if err := llenResult.Err(); err != nil {
+		return 0, err
+	}
 	total := int(llenResult.Val())
 	if total == 0 {
-		return 0 // nothing to do
+		return 0, nil // nothing to do
 	}
 
 	// delete elements without blocking
@@ -497,10 +2374,12 @@ func (queue *redisQueue) deleteRedisList(key string) int {
 		}
 
 		// remove one batch
-		queue.redisClient.LTrim(context.Background(), key, 0, int64(-1-batchSize))
+		if err := queue.redisClient.LTrim(context.Background(), key, 0, int64(-1-batchSize)).Err(); err != nil {
+			return total - todo, err
+		}
 	}
 
-	return total
+	return total, nil
 }
 
 func (queue *redisQueue) deleteRedisSortedSet(key string) int {
@@ -519,12 +2398,118 @@ func (queue *redisQueue) deleteRedisSortedSet(key string) int {
 		}
 
 		// remove one batch
-		queue.redisClient.ZRemRangeByRank(context.Background(), key, 0, int64(-1-batchSize))
+		queue.redisClient.ZRemRangeByRank(context.Background(), key, 0, int64(batchSize-1))
 	}
 
 	return total
 }
 
+// delayedSlotsKept is how long the slots of a millisecond are kept after it was due
+const delayedSlotsKept = time.Minute
+
+// delayedSlots breaks ties between deliveries delayed to the same millisecond
+var delayedSlots = struct {
+	sync.Mutex
+	next   map[int64]int64 // next free microsecond by millisecond
+	pruned time.Time       // when due milliseconds got dropped from next last
+}{next: map[int64]int64{}}
+
+// delayedScore returns the score of a delivery delayed to delayedAt in seconds.
+// The milliseconds of delayedAt make up the first three decimals, the next
+// three are the slot of the delivery within that millisecond, so deliveries
+// published by this process for the same millisecond keep their publish order.
+// Once the 1000 slots of a millisecond are taken, further deliveries spill over
+// to the slots of the following milliseconds, after what got delayed to those.
+// Milliseconds which are due for more than delayedSlotsKept are forgotten
+func delayedScore(delayedAt time.Time) float64 {
+	millis := delayedAt.UnixNano() / int64(time.Millisecond)
+
+	delayedSlots.Lock()
+	defer delayedSlots.Unlock()
+
+	if now := time.Now(); now.Sub(delayedSlots.pruned) > time.Second {
+		keptMillis := now.Add(-delayedSlotsKept).UnixNano() / int64(time.Millisecond)
+		for slotMillis := range delayedSlots.next {
+			if slotMillis < keptMillis {
+				delete(delayedSlots.next, slotMillis)
+			}
+		}
+		delayedSlots.pruned = now
+	}
+
+	micros := millis * 1000
+	if next := delayedSlots.next[millis]; next > micros {
+		micros = next
+	}
+	for micros/1000 > millis && delayedSlots.next[micros/1000] > micros {
+		micros = delayedSlots.next[micros/1000]
+	}
+	delayedSlots.next[millis] = micros + 1
+	if spilled := micros / 1000; spilled > millis {
+		delayedSlots.next[spilled] = micros + 1
+	}
+	return float64(micros) / 1e6
+}
+
+// dueScore returns the score up to which delayed deliveries are due at now
+func dueScore(now time.Time) float64 {
+	micros := now.UnixNano()/int64(time.Millisecond)*1000 + 999
+	return float64(micros) / 1e6
+}
+
+// leaseContextMargin returns how long before its lease expires the context of
+// a delivery ends, a tenth of the lease duration unless set WithLeaseMargin
+func (queue *redisQueue) leaseContextMargin() time.Duration {
+	if queue.leaseMargin > 0 {
+		return queue.leaseMargin
+	}
+	return queue.leaseDuration / 10
+}
+
+// leaseMember returns the member of a leased delivery in the leases set
+func leaseMember(token, payload string) string {
+	return token + ":" + payload
+}
+
+// stampRejected records when the rejected delivery with the given payload got
+// rejected and the reason, unless it's empty. A failure only keeps it from
+// being returned by ReturnRejectedSince and RejectedReasons. Each rejection
+// gets its own member, so deliveries with equal payloads keep their own
+// rejection times and reasons
+func stampRejected(redisClient *redis.Client, rejectedAtKey, rejectReasonsKey, payload, reason string) {
+	member := rejectedMember(uniuri.NewLen(rejectedTokenLength), payload)
+	z := redis.Z{Score: float64(rejectedScore(time.Now())), Member: member}
+	ctx := context.Background()
+	redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, rejectedAtKey, &z)
+		if reason != "" {
+			pipe.HSet(ctx, rejectReasonsKey, member, reason)
+		}
+		return nil
+	})
+}
+
+// dropRejectedStamps removes the rejection times and reasons of all rejected
+// deliveries
+func (queue *redisQueue) dropRejectedStamps() error {
+	return queue.redisClient.Del(context.Background(), queue.rejectedAtKey, queue.rejectReasonsKey).Err()
+}
+
+// rejectedMember returns the member of a rejection in the rejected_at set
+func rejectedMember(token, payload string) string {
+	return token + ":" + payload
+}
+
+// rejectedScore returns the score of deliveries rejected at the given time
+func rejectedScore(at time.Time) int64 {
+	return at.UnixNano() / int64(time.Millisecond)
+}
+
+// leaseScore returns the score of a lease expiring at expiry, in milliseconds
+func leaseScore(expiry time.Time) int64 {
+	return expiry.UnixNano() / int64(time.Millisecond)
+}
+
 // redisErrIsNil returns false if there is no error, true if the result error is nil and panics if there's another error
 func redisErrIsNil(result redis.Cmder) bool {
 	switch result.Err() {
@@ -537,7 +2522,3 @@ func redisErrIsNil(result redis.Cmder) bool {
 		return false
 	}
 }
-
-func debug(message string) {
-	// log.Printf("rmq debug: %s", message) // COMMENTOUT
-}
@@ -1,11 +1,21 @@
 package rmq
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	. "github.com/adjust/gocheck"
+	"github.com/go-redis/redis/v8"
 )
 
 func TestQueueSuite(t *testing.T) {
@@ -55,12 +65,25 @@ func (suite *QueueSuite) TestConnectionQueues(c *C) {
 	connection.CloseAllQueues()
 	c.Check(connection.GetOpenQueues(), HasLen, 0)
 
+	exists, err := connection.QueueExists("conn-q-q1")
+	c.Check(err, IsNil)
+	c.Check(exists, Equals, false)
+
 	queue1 := connection.OpenQueue("conn-q-q1").(*redisQueue)
 	c.Assert(queue1, NotNil)
 	c.Check(connection.GetOpenQueues(), DeepEquals, []string{"conn-q-q1"})
+	exists, err = connection.QueueExists("conn-q-q1")
+	c.Check(err, IsNil)
+	c.Check(exists, Equals, true)
 	c.Check(connection.GetConsumingQueues(), HasLen, 0)
+	opened, err := connection.OpenedQueues()
+	c.Check(err, IsNil)
+	c.Check(opened, HasLen, 0)
 	queue1.StartConsuming(1, time.Millisecond)
 	c.Check(connection.GetConsumingQueues(), DeepEquals, []string{"conn-q-q1"})
+	opened, err = connection.OpenedQueues()
+	c.Check(err, IsNil)
+	c.Check(opened, DeepEquals, []string{"conn-q-q1"})
 
 	queue2 := connection.OpenQueue("conn-q-q2").(*redisQueue)
 	c.Assert(queue2, NotNil)
@@ -81,6 +104,9 @@ func (suite *QueueSuite) TestConnectionQueues(c *C) {
 
 	queue1.Close()
 	c.Check(connection.GetOpenQueues(), DeepEquals, []string{"conn-q-q2"})
+	exists, err = connection.QueueExists("conn-q-q1")
+	c.Check(err, IsNil)
+	c.Check(exists, Equals, false)
 	c.Check(connection.GetConsumingQueues(), HasLen, 0)
 
 	connection.StopHeartbeat()
@@ -105,8 +131,8 @@ func (suite *QueueSuite) TestQueue(c *C) {
 	queue.RemoveAllConsumers()
 	c.Check(queue.GetConsumers(), HasLen, 0)
 	c.Check(connection.GetConsumingQueues(), HasLen, 0)
-	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, true)
-	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, false)
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, ErrAlreadyConsuming)
 	cons1name := queue.AddConsumer("queue-cons1", NewTestConsumer("queue-A"))
 	time.Sleep(time.Millisecond)
 	c.Check(connection.GetConsumingQueues(), HasLen, 1)
@@ -238,6 +264,83 @@ func (suite *QueueSuite) TestMulti(c *C) {
 	connection.StopHeartbeat()
 }
 
+func (suite *QueueSuite) TestHardPrefetchLimit(c *C) {
+	connection := OpenConnection("hard-prefetch-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("hard-prefetch-q", WithHardPrefetchLimit()).(*redisQueue)
+	queue.PurgeReady()
+
+	for i := 0; i < 20; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("hard-prefetch-d%d", i)), Equals, true)
+	}
+
+	queue.StartConsuming(10, time.Millisecond)
+	consumer := NewTestConsumer("hard-prefetch-cons")
+	consumer.AutoAck = false
+	consumer.AutoFinish = false
+	queue.AddConsumer("hard-prefetch-cons", consumer)
+
+	// the delivery being processed counts towards the limit
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.ReadyCount(), Equals, 10)
+	c.Check(queue.UnackedCount(), Equals, 10)
+
+	c.Check(consumer.LastDelivery.Ack(), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.ReadyCount(), Equals, 9)
+	c.Check(queue.UnackedCount(), Equals, 10)
+
+	consumer.Finish()
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.ReadyCount(), Equals, 9)
+	c.Check(queue.UnackedCount(), Equals, 10)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestHardPrefetchLimitReclaimed(c *C) {
+	connection := OpenConnection("hard-prefetch-reclaim-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("hard-prefetch-reclaim-q", WithHardPrefetchLimit(), WithLeases(20*time.Millisecond)).(*redisQueue)
+	queue.PurgeReady()
+	for i := 0; i < 3; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("hard-prefetch-reclaim-d%d", i)), Equals, true)
+	}
+
+	queue.StartConsuming(1, time.Millisecond)
+	consumer := NewTestConsumer("hard-prefetch-reclaim-cons")
+	consumer.AutoAck = false
+	queue.AddConsumer("hard-prefetch-reclaim-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+
+	// the lease got reclaimed, the failed ack frees the slot
+	time.Sleep(30 * time.Millisecond)
+	returned, err := queue.ReturnExpiredLeases()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1)
+	c.Check(consumer.LastDeliveries[0].Ack(), Equals, false)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+
+	// restarting doesn't count the unsettled delivery of the earlier run
+	queue.StopConsuming()
+	started := false
+	for i := 0; i < 100 && !started; i++ {
+		time.Sleep(time.Millisecond)
+		started = queue.StartConsuming(1, time.Millisecond) == nil
+	}
+	c.Assert(started, Equals, true)
+	restarted := NewTestConsumer("hard-prefetch-reclaim-cons2")
+	restarted.AutoAck = false
+	queue.AddConsumer("hard-prefetch-reclaim-cons2", restarted)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(restarted.LastDeliveries, HasLen, 1)
+
+	queue.StopConsuming()
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
 func (suite *QueueSuite) TestBatch(c *C) {
 	connection := OpenConnection("batch-conn", "tcp", "localhost:6379", 1)
 	queue := connection.OpenQueue("batch-q").(*redisQueue)
@@ -256,6 +359,7 @@ func (suite *QueueSuite) TestBatch(c *C) {
 	queue.AddBatchConsumerWithTimeout("batch-cons", 2, 10*time.Millisecond, consumer)
 	time.Sleep(2 * time.Millisecond)
 	c.Assert(consumer.LastBatch, HasLen, 2)
+	c.Check(consumer.LastFlushedByTimeout, Equals, false)
 	c.Check(consumer.LastBatch[0].Payload(), Equals, "batch-d0")
 	c.Check(consumer.LastBatch[1].Payload(), Equals, "batch-d1")
 	c.Check(consumer.LastBatch[0].Reject(), Equals, true)
@@ -281,6 +385,7 @@ func (suite *QueueSuite) TestBatch(c *C) {
 
 	time.Sleep(15 * time.Millisecond)
 	c.Assert(consumer.LastBatch, HasLen, 1)
+	c.Check(consumer.LastFlushedByTimeout, Equals, true)
 	c.Check(consumer.LastBatch[0].Payload(), Equals, "batch-d4")
 	c.Check(consumer.LastBatch[0].Reject(), Equals, true)
 	c.Check(queue.UnackedCount(), Equals, 0)
@@ -347,7 +452,9 @@ func (suite *QueueSuite) TestPushQueue(c *C) {
 	connection := OpenConnection("push", "tcp", "localhost:6379", 1)
 	queue1 := connection.OpenQueue("queue1").(*redisQueue)
 	queue2 := connection.OpenQueue("queue2").(*redisQueue)
-	queue1.SetPushQueue(queue2)
+	c.Check(queue1.SetPushQueue(NewTestQueue("test-queue")), Equals, ErrUnsupportedPushQueue)
+	c.Check(queue1.pushKey, Equals, "")
+	c.Check(queue1.SetPushQueue(queue2), IsNil)
 	c.Check(queue1.pushKey, Equals, queue2.readyKey)
 
 	consumer1 := NewTestConsumer("push-cons")
@@ -457,3 +564,2816 @@ func (suite *QueueSuite) BenchmarkQueue(c *C) {
 
 	connection.StopHeartbeat()
 }
+
+func (suite *QueueSuite) TestDelayMigrateChunkSize(c *C) {
+	connection := OpenConnection("chunk-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("chunk-q", WithMigrateChunkSize(50)).(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+	c.Check(queue.migrateChunkSize, Equals, 50)
+	capped := connection.OpenQueue("chunk-capped-q", WithMigrateChunkSize(100000)).(*redisQueue)
+	c.Check(capped.migrateChunkSize, Equals, maxMigrateChunkSize)
+
+	delayedAt := time.Now().Add(-time.Second)
+	for i := 0; i < 250; i++ {
+		c.Check(queue.PublishOnDelay(fmt.Sprintf("chunk-d%d", i), delayedAt), Equals, true)
+	}
+	c.Check(queue.DelayedCount(), Equals, 250)
+
+	queue.migrateExpiredDeliveries(queue.delayedKey, queue.readyKey, time.Now())
+	c.Check(queue.DelayedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 250)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestNack(c *C) {
+	connection := OpenConnection("nack-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("nack-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	consumer := NewTestConsumer("nack-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("nack-cons", consumer)
+
+	c.Check(queue.Publish("nack-d1"), Equals, true)
+	time.Sleep(2 * time.Millisecond)
+	c.Assert(consumer.LastDelivery, NotNil)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "nack-d1")
+	c.Check(queue.UnackedCount(), Equals, 1)
+
+	queue.StopConsuming()
+	time.Sleep(2 * time.Millisecond)
+	c.Check(queue.Publish("nack-d2"), Equals, true)
+
+	c.Check(consumer.LastDelivery.Nack(), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 0)
+	c.Check(consumer.LastDelivery.Nack(), Equals, false)
+
+	// the nacked delivery is queued behind the delivery which was already ready
+	result := queue.redisClient.LRange(context.Background(), queue.readyKey, 0, -1)
+	c.Check(result.Val(), DeepEquals, []string{"nack-d1", "nack-d2"})
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReserve(c *C) {
+	connection := OpenConnection("reserve-conn", "tcp", "localhost:6379", 1)
+	plain := connection.OpenQueue("reserve-plain-q")
+	_, err := plain.Reserve(context.Background())
+	c.Check(err, Equals, ErrNotLeased)
+
+	queue := connection.OpenQueue("reserve-q", WithLeases(20*time.Millisecond)).(*redisQueue)
+	queue.PurgeReady()
+	c.Check(queue.PublishBatch([]string{"reserve-d1", "reserve-d2"}), IsNil)
+
+	first, err := queue.Reserve(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(first.Payload, Equals, "reserve-d1")
+	second, err := queue.Reserve(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(queue.UnackedCount(), Equals, 2)
+
+	c.Check(queue.Commit(first.Token), IsNil)
+	c.Check(queue.Commit(first.Token), Equals, ErrNotUnacked)
+	c.Check(queue.Rollback(second.Token), IsNil)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.Commit("bogus"), Equals, ErrInvalidReservation)
+
+	// a reclaimed reservation can't be committed anymore
+	third, err := queue.Reserve(context.Background())
+	c.Assert(err, IsNil)
+	time.Sleep(30 * time.Millisecond)
+	returned, err := queue.ReturnExpiredLeases()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1)
+	fourth, err := queue.Reserve(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(fourth.Payload, Equals, third.Payload)
+	c.Check(queue.Commit(third.Token), Equals, ErrNotUnacked)
+	c.Check(queue.Commit(fourth.Token), IsNil)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	_, err = queue.Reserve(context.Background())
+	c.Check(err, Equals, ErrNoDelivery)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestLeaseContext(c *C) {
+	connection := OpenConnection("lease-ctx-conn", "tcp", "localhost:6379", 1)
+	plain := connection.OpenQueue("lease-ctx-plain-q")
+	plain.PurgeReady()
+	c.Check(plain.Publish("lease-ctx-d1"), Equals, true)
+	delivery, err := plain.Pull(context.Background())
+	c.Assert(err, IsNil)
+	_, ok := delivery.Context().Deadline()
+	c.Check(ok, Equals, false)
+	c.Check(delivery.Ack(), Equals, true)
+
+	queue := connection.OpenQueue("lease-ctx-q", WithLeases(time.Second), WithLeaseMargin(200*time.Millisecond))
+	queue.PurgeReady()
+	c.Check(queue.Publish("lease-ctx-d2"), Equals, true)
+	pulledAt := time.Now()
+	delivery, err = queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	ctx := delivery.Context()
+	deadline, ok := ctx.Deadline()
+	c.Assert(ok, Equals, true)
+	c.Check(deadline.After(pulledAt.Add(700*time.Millisecond)), Equals, true)
+	c.Check(deadline.Before(time.Now().Add(800*time.Millisecond)), Equals, true)
+
+	c.Check(delivery.ExtendLease(2*time.Second), IsNil)
+	extended, _ := delivery.Context().Deadline()
+	c.Check(extended.After(deadline.Add(900*time.Millisecond)), Equals, true)
+
+	// settling cancels the context
+	c.Check(delivery.Ack(), Equals, true)
+	c.Check(delivery.Context().Err(), Equals, context.Canceled)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestLeases(c *C) {
+	connection := OpenConnection("lease-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("lease-q", WithLeases(20*time.Millisecond)).(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	consumer := NewTestConsumer("lease-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("lease-cons", consumer)
+
+	c.Check(queue.Publish("lease-d1"), Equals, true)
+	c.Check(queue.Publish("lease-d2"), Equals, true)
+	time.Sleep(5 * time.Millisecond)
+	queue.StopConsuming()
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+	c.Check(queue.UnackedCount(), Equals, 2)
+	c.Check(queue.redisClient.ZCard(context.Background(), queue.leasesKey).Val(), Equals, int64(2))
+
+	// lease still held
+	returned, err := queue.ReturnExpiredLeases()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 0)
+	c.Check(consumer.LastDeliveries[0].Ack(), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 1)
+
+	// lease expired and delivery got reclaimed
+	time.Sleep(30 * time.Millisecond)
+	returned, err = queue.ReturnExpiredLeases()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(consumer.LastDeliveries[1].Reject(), Equals, false)
+	c.Check(consumer.LastDeliveries[1].Ack(), Equals, false)
+	c.Check(queue.RejectedCount(), Equals, 0)
+	c.Check(queue.redisClient.ZCard(context.Background(), queue.leasesKey).Val(), Equals, int64(0))
+
+	// expired leases of other connections get reclaimed too
+	c.Check(queue.Publish("lease-d3"), Equals, true)
+	pulled, err := queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	other := OpenConnection("lease-other-conn", "tcp", "localhost:6379", 1)
+	otherQueue := other.OpenQueue("lease-q", WithLeases(20*time.Millisecond)).(*redisQueue)
+	time.Sleep(30 * time.Millisecond)
+	returned, err = otherQueue.ReturnExpiredLeases()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(pulled.Ack(), Equals, false)
+
+	queue.PurgeReady()
+	other.StopHeartbeat()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPartitionedConsumers(c *C) {
+	connection := OpenConnection("partition-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("partition-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.RemoveAllConsumers()
+
+	for i := 0; i < 30; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("user%d:partition-d%d", i%3, i)), Equals, true)
+	}
+
+	consumers := []*TestConsumer{NewTestConsumer("partition-A"), NewTestConsumer("partition-B")}
+	keyFn := func(payload string) string {
+		return strings.SplitN(payload, ":", 2)[0]
+	}
+	queue.StartConsuming(10, time.Millisecond)
+	names := queue.AddPartitionedConsumers("partition-cons", 2, keyFn, []Consumer{consumers[0], consumers[1]})
+	c.Check(names, HasLen, 2)
+	c.Check(queue.GetConsumers(), HasLen, 2)
+	time.Sleep(20 * time.Millisecond)
+	c.Check(len(consumers[0].LastDeliveries)+len(consumers[1].LastDeliveries), Equals, 30)
+
+	// every key is consumed by a single consumer in publish order
+	owners := map[string]*TestConsumer{}
+	for _, consumer := range consumers {
+		last := map[string]int{}
+		for _, delivery := range consumer.LastDeliveries {
+			var user string
+			var i int
+			fmt.Sscanf(strings.Replace(delivery.Payload(), ":partition-d", " ", 1), "%s %d", &user, &i)
+			if owner, ok := owners[user]; ok {
+				c.Check(owner, Equals, consumer)
+			}
+			owners[user] = consumer
+			if previous, ok := last[user]; ok {
+				c.Check(previous < i, Equals, true)
+			}
+			last[user] = i
+		}
+	}
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestFairConsumers(c *C) {
+	connection := OpenConnection("fair-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("fair-q").(*redisQueue)
+	queue.PurgeReady()
+
+	for i := 0; i < 6; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("fair-d%d", i)), Equals, true)
+	}
+
+	consumers := []*TestConsumer{NewTestConsumer("fair-A"), NewTestConsumer("fair-B"), NewTestConsumer("fair-C")}
+	consumers[0].SleepDuration = 5 * time.Millisecond // a slow consumer still gets its share
+	queue.StartConsuming(10, time.Millisecond)
+	names := queue.AddFairConsumers("fair-cons", []Consumer{consumers[0], consumers[1], consumers[2]})
+	c.Check(names, HasLen, 3)
+	c.Check(queue.GetConsumers(), HasLen, 3)
+	time.Sleep(50 * time.Millisecond)
+
+	for i, consumer := range consumers {
+		c.Assert(consumer.LastDeliveries, HasLen, 2)
+		c.Check(consumer.LastDeliveries[0].Payload(), Equals, fmt.Sprintf("fair-d%d", i))
+		c.Check(consumer.LastDeliveries[1].Payload(), Equals, fmt.Sprintf("fair-d%d", i+3))
+	}
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumeN(c *C) {
+	connection := OpenConnection("consume-n-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("consume-n-q").(*redisQueue)
+	queue.PurgeReady()
+	c.Check(queue.PublishBatch([]string{"consume-n-d1", "consume-n-d2", "consume-n-d3"}), IsNil)
+
+	consumer := NewTestConsumer("consume-n-cons")
+	processed, err := queue.ConsumeN(context.Background(), 2, consumer)
+	c.Check(err, IsNil)
+	c.Check(processed, Equals, 2)
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+	c.Check(consumer.LastDeliveries[0].Payload(), Equals, "consume-n-d1")
+	c.Check(consumer.LastDeliveries[1].Payload(), Equals, "consume-n-d2")
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	// stops once the queue is empty
+	processed, err = queue.ConsumeN(context.Background(), 5, consumer)
+	c.Check(err, IsNil)
+	c.Check(processed, Equals, 1)
+
+	c.Check(queue.Publish("consume-n-d4"), Equals, true)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	processed, err = queue.ConsumeN(ctx, 5, consumer)
+	c.Check(err, Equals, context.Canceled)
+	c.Check(processed, Equals, 0)
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDebug(c *C) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	connection := OpenConnection("debug-conn", "tcp", "localhost:6379", 1)
+	quiet := connection.OpenQueue("debug-quiet-q")
+	quiet.Publish("debug-d1")
+	if !debugEnv {
+		c.Check(buf.String(), Equals, "")
+	}
+
+	queue := connection.OpenQueue("debug-q", WithDebug(true))
+	queue.PurgeReady()
+	queue.Publish("debug-d2")
+	c.Check(strings.Contains(buf.String(), "rmq debug: publish debug-d2"), Equals, true)
+
+	quiet.PurgeReady()
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestCloseEmpty(c *C) {
+	connection := OpenConnection("close-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("close-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	c.Check(queue.Publish("close-d1"), Equals, true)
+	closed, err := queue.CloseEmpty()
+	c.Check(err, Equals, ErrQueueNotEmpty)
+	c.Check(closed, Equals, false)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	exists, _ := connection.QueueExists("close-q")
+	c.Check(exists, Equals, true)
+
+	c.Check(queue.PurgeReady(), Equals, 1)
+	closed, err = queue.CloseEmpty()
+	c.Check(err, IsNil)
+	c.Check(closed, Equals, true)
+	exists, _ = connection.QueueExists("close-q")
+	c.Check(exists, Equals, false)
+
+	// closed queues can't be published to until they get opened again
+	c.Check(queue.Publish("close-d2"), Equals, false)
+	queue = connection.OpenQueue("close-q").(*redisQueue)
+	c.Check(queue.Publish("close-d2"), Equals, true)
+	c.Check(queue.ClosePurging(), Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 0)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishN(c *C) {
+	connection := OpenConnection("publish-n-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("publish-n-q").(*redisQueue)
+	queue.PurgeReady()
+
+	newLen, err := queue.PublishN("publish-n-d1")
+	c.Check(err, IsNil)
+	c.Check(newLen, Equals, int64(1))
+	newLen, err = queue.PublishN("publish-n-d2")
+	c.Check(err, IsNil)
+	c.Check(newLen, Equals, int64(2))
+	c.Check(queue.ReadyCount(), Equals, 2)
+
+	c.Check(queue.ClosePurging(), Equals, true)
+	_, err = queue.PublishN("publish-n-d3")
+	c.Check(err, Equals, ErrQueueClosed)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishAfterClose(c *C) {
+	connection := OpenConnection("publish-closed-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("publish-closed-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+
+	c.Check(queue.ClosePurging(), Equals, true)
+	c.Check(queue.PublishE("publish-closed-d1"), Equals, ErrQueueClosed)
+	c.Check(queue.Publish("publish-closed-d2"), Equals, false)
+	c.Check(queue.PublishBatch([]string{"publish-closed-d3"}), Equals, ErrQueueClosed)
+	c.Check(queue.PublishOnDelayE("publish-closed-d4", time.Now().Add(time.Hour)), Equals, ErrQueueClosed)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.DelayedCount(), Equals, 0)
+	exists, err := connection.QueueExists("publish-closed-q")
+	c.Check(err, IsNil)
+	c.Check(exists, Equals, false)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPull(c *C) {
+	connection := OpenConnection("pull-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("pull-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	delivery, err := queue.Pull(context.Background())
+	c.Check(err, Equals, ErrNoDelivery)
+	c.Check(delivery, IsNil)
+
+	c.Check(queue.Publish("pull-d1"), Equals, true)
+	c.Check(queue.Publish("pull-d2"), Equals, true)
+	delivery, err = queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Payload(), Equals, "pull-d1")
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 1)
+	c.Check(connection.GetConsumingQueues(), DeepEquals, []string{"pull-q"})
+	c.Check(delivery.Ack(), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	delivery, err = queue.Pull(ctx)
+	c.Assert(err, IsNil)
+	c.Check(delivery.Payload(), Equals, "pull-d2")
+	c.Check(delivery.Reject(), Equals, true)
+	c.Check(queue.RejectedCount(), Equals, 1)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		queue.Publish("pull-d3")
+	}()
+	delivery, err = queue.Pull(ctx)
+	c.Assert(err, IsNil)
+	c.Check(delivery.Payload(), Equals, "pull-d3")
+	c.Check(delivery.Ack(), Equals, true)
+
+	// sub-second deadlines return in time and don't strand a late delivery
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shortCancel()
+	start := time.Now()
+	delivery, err = queue.Pull(shortCtx)
+	c.Check(err, Equals, ErrNoDelivery)
+	c.Check(delivery, IsNil)
+	c.Check(time.Since(start) < 500*time.Millisecond, Equals, true)
+	c.Check(queue.Publish("pull-d4"), Equals, true)
+	time.Sleep(20 * time.Millisecond)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	queue.PurgeReady()
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPullLeasedDeadline(c *C) {
+	connection := OpenConnection("pull-leased-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("pull-leased-q", WithLeases(time.Minute)).(*redisQueue)
+	queue.PurgeReady()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		queue.Publish("pull-leased-d1")
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	delivery, err := queue.Pull(ctx)
+	c.Assert(err, IsNil)
+	c.Check(delivery.Payload(), Equals, "pull-leased-d1")
+	c.Check(delivery.Ack(), Equals, true)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumeWithContext(c *C) {
+	connection := OpenConnection("consume-ctx-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("consume-ctx-q").(*redisQueue)
+	queue.PurgeReady()
+
+	consumer := NewTestConsumer("consume-ctx-cons")
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() { errChan <- queue.ConsumeWithContext(ctx, 10, time.Millisecond, consumer) }()
+
+	c.Check(queue.Publish("consume-ctx-d1"), Equals, true)
+	time.Sleep(20 * time.Millisecond)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "consume-ctx-d1")
+	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, ErrAlreadyConsuming)
+
+	cancel()
+	select {
+	case err := <-errChan:
+		c.Check(err, IsNil)
+	case <-time.After(time.Second):
+		c.Fatal("ConsumeWithContext didn't return after cancel")
+	}
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishBlocking(c *C) {
+	connection := OpenConnection("blocking-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("blocking-q", WithMaxReady(2)).(*redisQueue)
+	queue.PurgeReady()
+
+	c.Check(queue.PublishBlocking(context.Background(), "blocking-d1"), IsNil)
+	c.Check(queue.PublishBlocking(context.Background(), "blocking-d2"), IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c.Check(queue.PublishBlocking(ctx, "blocking-d3"), Equals, context.DeadlineExceeded)
+	c.Check(queue.ReadyCount(), Equals, 2)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		delivery, err := queue.Pull(context.Background())
+		c.Check(err, IsNil)
+		delivery.Ack()
+	}()
+	start := time.Now()
+	c.Check(queue.PublishBlocking(context.Background(), "blocking-d3"), IsNil)
+	c.Check(time.Since(start) >= 100*time.Millisecond, Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 2)
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishAndAwaitReply(c *C) {
+	connection := OpenConnection("reply-conn", "tcp", "localhost:6379", 1)
+	requests := connection.OpenQueue("reply-requests").(*redisQueue)
+	// skipping the reply to another request doesn't count as a requeue
+	replies := connection.OpenQueue("reply-replies", WithMaxRequeues(1, nil)).(*redisQueue)
+	requests.PurgeReady()
+	replies.PurgeReady()
+	replies.PurgeRejected()
+
+	// a reply to another request stays for that request
+	c.Check(replies.PublishWithHeaders("other", map[string]string{CorrelationIDHeader: "other"}), IsNil)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		request, err := requests.Pull(ctx)
+		c.Assert(err, IsNil)
+		c.Check(request.Headers()[ReplyToHeader], Equals, "reply-replies")
+		c.Check(Reply(request, replies, "pong:"+request.Payload()), IsNil)
+		c.Check(request.Ack(), Equals, true)
+	}()
+
+	reply, err := requests.PublishAndAwaitReply(context.Background(), "ping", replies, time.Second)
+	c.Check(err, IsNil)
+	c.Check(reply, Equals, "pong:ping")
+	c.Check(replies.ReadyCount(), Equals, 1)
+	c.Check(replies.UnackedCount(), Equals, 0)
+
+	reply, err = requests.PublishAndAwaitReply(context.Background(), "lost", replies, 50*time.Millisecond)
+	c.Check(err, Equals, ErrNoReply)
+	c.Check(reply, Equals, "")
+	c.Check(replies.ReadyCount(), Equals, 1)
+	c.Check(replies.RejectedCount(), Equals, 0)
+
+	requests.PurgeReady()
+	replies.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishIndexed(c *C) {
+	connection := OpenConnection("indexed-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("indexed-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.redisClient.Del(context.Background(), IndexKey("indexed-q", "order", "12345"))
+
+	c.Check(queue.PublishIndexed("indexed-d1", map[string]string{"order": "12345", "user": "7"}), IsNil)
+	c.Check(queue.PublishIndexed("indexed-d2", map[string]string{"order": "12345"}), IsNil)
+	c.Check(queue.PublishIndexed("indexed-d3", map[string]string{"order": "67890"}), IsNil)
+	c.Check(queue.ReadyCount(), Equals, 3)
+
+	found, err := queue.FindByIndex("order", "12345")
+	c.Check(err, IsNil)
+	sort.Strings(found)
+	c.Check(found, DeepEquals, []string{"indexed-d1", "indexed-d2"})
+	found, err = queue.FindByIndex("user", "7")
+	c.Check(err, IsNil)
+	c.Check(found, DeepEquals, []string{"indexed-d1"})
+
+	// consumed deliveries drop out of the index
+	delivery, err := queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Payload(), Equals, "indexed-d1")
+	c.Check(delivery.Ack(), Equals, true)
+	found, err = queue.FindByIndex("order", "12345")
+	c.Check(err, IsNil)
+	c.Check(found, DeepEquals, []string{"indexed-d2"})
+	c.Check(queue.redisClient.SCard(context.Background(), IndexKey("indexed-q", "order", "12345")).Val(), Equals, int64(1))
+
+	found, err = queue.FindByIndex("order", "none")
+	c.Check(err, IsNil)
+	c.Check(found, HasLen, 0)
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReconfigureConsuming(c *C) {
+	connection := OpenConnection("reconfigure-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("reconfigure-q").(*redisQueue)
+	queue.PurgeReady()
+	c.Check(queue.ReconfigureConsuming(5, time.Millisecond), Equals, ErrNotConsuming)
+
+	c.Check(queue.StartConsuming(2, time.Millisecond), IsNil)
+	c.Check(queue.PublishBatch([]string{"reconfigure-d1", "reconfigure-d2", "reconfigure-d3"}), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 2)
+
+	// the prefetched deliveries get returned and fetched again into the new channel
+	c.Check(queue.ReconfigureConsuming(5, time.Millisecond), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(cap(queue.deliveryChan), Equals, 5)
+	c.Check(len(queue.deliveryChan), Equals, 3)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 3)
+
+	consumer := NewTestConsumer("reconfigure-cons")
+	name := queue.AddConsumer("reconfigure-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(consumer.LastDeliveries, HasLen, 3)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	// consumers keep consuming from the new channel under their names
+	c.Check(queue.ReconfigureConsuming(1, time.Millisecond), IsNil)
+	c.Check(queue.Publish("reconfigure-d4"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 4)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "reconfigure-d4")
+	c.Check(queue.GetConsumers(), DeepEquals, []string{name})
+
+	c.Check(queue.StopConsuming(), Equals, true)
+	c.Check(queue.ReconfigureConsuming(5, time.Millisecond), Equals, ErrNotConsuming)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReconfigureConsumingSlowConsumer(c *C) {
+	connection := OpenConnection("reconfigure-slow-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("reconfigure-slow-q").(*redisQueue)
+	queue.PurgeReady()
+	c.Check(queue.StartConsuming(1, time.Millisecond), IsNil)
+	c.Check(queue.ReconfigureConsuming(-1, time.Millisecond), Equals, ErrInvalidPrefetchLimit)
+
+	var running, overlaps, consumed int32
+	queue.AddConsumerFunc("reconfigure-slow-cons", 1, func(delivery Delivery) {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&consumed, 1)
+		delivery.Ack()
+	})
+
+	c.Check(queue.PublishBatch([]string{"reconfigure-slow-d1", "reconfigure-slow-d2", "reconfigure-slow-d3"}), IsNil)
+	time.Sleep(5 * time.Millisecond)
+	// the consumer is still in Consume, it continues on the new channel afterwards
+	c.Check(queue.ReconfigureConsuming(2, time.Millisecond), IsNil)
+	c.Check(queue.ReconfigureConsuming(3, time.Millisecond), IsNil)
+	time.Sleep(100 * time.Millisecond)
+	c.Check(atomic.LoadInt32(&overlaps), Equals, int32(0))
+	c.Check(atomic.LoadInt32(&consumed), Equals, int32(3))
+
+	c.Check(queue.StopConsuming(), Equals, true)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestStopConsumingRemovesConsumers(c *C) {
+	connection := OpenConnection("stop-consumers-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("stop-consumers-q").(*redisQueue)
+	queue.PurgeReady()
+
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	first := NewTestConsumer("stop-consumers-cons")
+	second := NewTestConsumer("stop-consumers-cons")
+	queue.AddConsumer("stop-consumers-cons", first)
+	queue.AddConsumer("stop-consumers-cons", second)
+	c.Check(queue.GetConsumers(), HasLen, 2)
+
+	c.Check(queue.PublishBatch([]string{"stop-consumers-d1", "stop-consumers-d2"}), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.StopConsuming(), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(len(first.LastDeliveries)+len(second.LastDeliveries), Equals, 2)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.GetConsumers(), HasLen, 0)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestAddConsumerUnique(c *C) {
+	connection := OpenConnection("unique-consumer-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("unique-consumer-q").(*redisQueue)
+
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	name, err := queue.AddConsumerUnique("unique-consumer-cons", NewTestConsumer("unique-consumer-cons"))
+	c.Check(err, IsNil)
+	c.Check(name, Matches, "unique-consumer-cons-.*")
+	_, err = queue.AddConsumerUnique("unique-consumer-cons", NewTestConsumer("unique-consumer-cons"))
+	c.Check(err, Equals, ErrDuplicateConsumerTag)
+	_, err = queue.AddConsumerUnique("unique-consumer-other", NewTestConsumer("unique-consumer-other"))
+	c.Check(err, IsNil)
+	c.Check(queue.GetConsumers(), HasLen, 2)
+
+	// tags can be added again once consuming stopped
+	c.Check(queue.StopConsuming(), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err = queue.AddConsumerUnique("unique-consumer-cons", NewTestConsumer("unique-consumer-cons"))
+	c.Check(err, IsNil)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestOpenTemporaryQueue(c *C) {
+	connection := OpenConnection("temporary-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenTemporaryQueue("temporary-q", time.Minute).(*redisQueue)
+	persistent := connection.OpenQueue("temporary-persistent-q").(*redisQueue)
+	queue.PurgeReady()
+	persistent.PurgeReady()
+
+	c.Check(queue.Publish("temporary-d1"), Equals, true)
+	c.Check(persistent.Publish("temporary-d2"), Equals, true)
+	ttl, err := connection.redisClient.TTL(context.Background(), queue.readyKey).Result()
+	c.Check(err, IsNil)
+	c.Check(ttl > 50*time.Second, Equals, true)
+	ttl, err = connection.redisClient.TTL(context.Background(), persistent.readyKey).Result()
+	c.Check(err, IsNil)
+	c.Check(ttl < 0, Equals, true) // no expiry
+
+	exists, err := connection.QueueExists("temporary-q")
+	c.Check(err, IsNil)
+	c.Check(exists, Equals, false)
+
+	// all publish paths refresh the expiry of all keys of the queue
+	queue.PurgeReady()
+	c.Check(queue.AppendRejected("temporary-d3"), IsNil)
+	c.Check(queue.PublishOnDelay("temporary-d4", time.Now().Add(time.Hour)), Equals, true)
+	for _, key := range []string{queue.delayedKey, queue.rejectedKey} {
+		ttl, err = connection.redisClient.TTL(context.Background(), key).Result()
+		c.Check(err, IsNil)
+		c.Check(ttl > 50*time.Second, Equals, true)
+	}
+	pipe := connection.redisClient.Pipeline()
+	queue.PublishPipe(pipe, "temporary-d5")
+	_, err = pipe.Exec(context.Background())
+	c.Check(err, IsNil)
+	ttl, err = connection.redisClient.TTL(context.Background(), queue.readyKey).Result()
+	c.Check(err, IsNil)
+	c.Check(ttl > 50*time.Second, Equals, true)
+
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	queue.PurgeDelayed()
+	persistent.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestAutoAck(c *C) {
+	connection := OpenConnection("auto-ack-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("auto-ack-q", WithAutoAck()).(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	consumer := NewTestConsumer("auto-ack-cons")
+	consumer.AutoAck = false
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	queue.AddConsumer("auto-ack-cons", consumer)
+	c.Check(queue.Publish("auto-ack-d1"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(consumer.LastDelivery.Reject(), Equals, false)
+	c.Check(queue.RejectedCount(), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReadyBytes(c *C) {
+	connection := OpenConnection("ready-bytes-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("ready-bytes-q").(*redisQueue)
+	queue.PurgeReady()
+
+	bytes, err := queue.ReadyBytes()
+	c.Check(err, IsNil)
+	c.Check(bytes, Equals, int64(0))
+
+	c.Check(queue.Publish(strings.Repeat("x", 1000)), Equals, true)
+	small, err := queue.ReadyBytes()
+	c.Check(err, IsNil)
+	c.Check(small > 1000, Equals, true)
+
+	c.Check(queue.Publish(strings.Repeat("y", 10000)), Equals, true)
+	large, err := queue.ReadyBytes()
+	c.Check(err, IsNil)
+	c.Check(large > small+10000, Equals, true)
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDiscard(c *C) {
+	connection := OpenConnection("discard-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("discard-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	c.Check(queue.Publish("discard-d1"), Equals, true)
+	delivery, err := queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Discard(), IsNil)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(delivery.Discard(), Equals, ErrNotUnacked)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPullBatch(c *C) {
+	connection := OpenConnection("pull-batch-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("pull-batch-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	deliveries, err := queue.PullBatch(context.Background(), 2)
+	c.Check(err, Equals, ErrNoDelivery)
+	c.Check(deliveries, HasLen, 0)
+
+	c.Check(queue.PublishBatch([]string{"pull-batch-d1", "pull-batch-d2", "pull-batch-d3"}), IsNil)
+	deliveries, err = queue.PullBatch(context.Background(), 2)
+	c.Assert(err, IsNil)
+	c.Assert(deliveries, HasLen, 2)
+	c.Check(deliveries[0].Payload(), Equals, "pull-batch-d1")
+	c.Check(deliveries[1].Payload(), Equals, "pull-batch-d2")
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 2)
+	c.Check(connection.GetConsumingQueues(), DeepEquals, []string{"pull-batch-q"})
+	c.Check(deliveries[0].Ack(), Equals, true)
+	c.Check(deliveries[1].Reject(), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 1)
+
+	deliveries, err = queue.PullBatch(context.Background(), 5)
+	c.Assert(err, IsNil)
+	c.Assert(deliveries, HasLen, 1)
+	c.Check(deliveries[0].Payload(), Equals, "pull-batch-d3")
+	c.Check(deliveries[0].Ack(), Equals, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		queue.Publish("pull-batch-d4")
+	}()
+	deliveries, err = queue.PullBatch(ctx, 2)
+	c.Assert(err, IsNil)
+	c.Assert(deliveries, HasLen, 1)
+	c.Check(deliveries[0].Payload(), Equals, "pull-batch-d4")
+	c.Check(deliveries[0].Ack(), Equals, true)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestRejectRouter(c *C) {
+	connection := OpenConnection("router-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("router-q").(*redisQueue)
+	validationQueue := connection.OpenQueue("router-validation").(*redisQueue)
+	streamQueue := connection.OpenQueue("router-stream", WithStreams(time.Minute))
+	for _, q := range []*redisQueue{queue, validationQueue} {
+		q.PurgeReady()
+		q.PurgeRejected()
+	}
+
+	queue.SetRejectRouter(func(delivery Delivery, reason string) (Queue, bool) {
+		switch reason {
+		case "validation":
+			return validationQueue, true
+		case "stream":
+			return streamQueue, true
+		}
+		return nil, false
+	})
+
+	consumer := NewTestConsumer("router-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("router-cons", consumer)
+	queue.Publish("router-d1")
+	queue.Publish("router-d2")
+	time.Sleep(5 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+
+	c.Check(consumer.LastDeliveries[0].RejectWithReason("validation"), Equals, true)
+	c.Check(validationQueue.ReadyCount(), Equals, 1)
+	c.Check(queue.RejectedCount(), Equals, 0)
+
+	c.Check(consumer.LastDeliveries[1].RejectWithReason("timeout"), Equals, true)
+	c.Check(validationQueue.ReadyCount(), Equals, 1)
+	c.Check(queue.RejectedCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	// the reason is kept with the rejection and dropped once returned
+	reasons, err := queue.RejectedReasons(10)
+	c.Assert(err, IsNil)
+	c.Assert(reasons, HasLen, 1)
+	c.Check(reasons[0].Payload, Equals, "router-d2")
+	c.Check(reasons[0].Reason, Equals, "timeout")
+	c.Check(time.Since(reasons[0].RejectedAt) < time.Minute, Equals, true)
+	c.Check(queue.ReturnRejected(1), Equals, 1)
+	c.Check(queue.redisClient.HLen(context.Background(), queue.rejectReasonsKey).Val(), Equals, int64(0))
+	queue.PurgeReady()
+
+	// stream queues can't take deliveries of list queues
+	c.Check(queue.Publish("router-d3"), Equals, true)
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 3)
+	c.Check(consumer.LastDeliveries[2].RejectWithReasonE("stream"), Equals, ErrUnsupportedPushQueue)
+	c.Check(queue.UnackedCount(), Equals, 1)
+	c.Check(consumer.LastDeliveries[2].Ack(), Equals, true)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPollJitter(c *C) {
+	queue := newQueue("jitter-q", "jitter-conn", defaultKeys, nil)
+	queue.pollDuration = 100 * time.Millisecond
+	c.Check(queue.pollSleepDuration(), Equals, 100*time.Millisecond)
+
+	queue = newQueue("jitter-q", "jitter-conn", defaultKeys, nil, WithPollJitter(0.2))
+	queue.pollDuration = 100 * time.Millisecond
+	varied := false
+	for i := 0; i < 100; i++ {
+		duration := queue.pollSleepDuration()
+		c.Check(duration >= 80*time.Millisecond, Equals, true)
+		c.Check(duration <= 120*time.Millisecond, Equals, true)
+		varied = varied || duration != 100*time.Millisecond
+	}
+	c.Check(varied, Equals, true)
+}
+
+// scriptRecorder records the names of all script commands
+type scriptRecorder struct {
+	mutex sync.Mutex
+	names []string
+}
+
+func (recorder *scriptRecorder) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if name := cmd.Name(); strings.HasPrefix(name, "eval") {
+		recorder.mutex.Lock()
+		recorder.names = append(recorder.names, name)
+		recorder.mutex.Unlock()
+	}
+	return ctx, nil
+}
+
+func (recorder *scriptRecorder) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (recorder *scriptRecorder) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (recorder *scriptRecorder) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+// failingHook fails all commands with the given name
+type failingHook struct {
+	name string
+}
+
+func (hook failingHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if cmd.Name() == hook.name {
+		return ctx, errors.New("failing hook")
+	}
+	return ctx, nil
+}
+
+func (hook failingHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (hook failingHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (hook failingHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func (suite *QueueSuite) TestConsumeErrorBudget(c *C) {
+	connection := OpenConnection("error-budget-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("error-budget-q", WithConsumeErrorBudget(3)).(*redisQueue)
+	queue.PurgeReady()
+	c.Check(queue.Publish("error-budget-d1"), Equals, true)
+	connection.AddRedisHook(failingHook{name: "rpoplpush"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	consumer := NewTestConsumer("error-budget-cons")
+	err := queue.ConsumeWithContext(ctx, 10, time.Millisecond, consumer)
+	c.Check(errors.Is(err, ErrErrorBudget), Equals, true)
+	c.Check(ctx.Err(), IsNil) // stopped by the error budget, not the context
+	c.Check(queue.ConsumeErr(), Equals, err)
+	c.Check(queue.GetConsumers(), HasLen, 0)
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumeErrorBudgetUnreachable(c *C) {
+	redisClient := redis.NewClient(&redis.Options{Network: "tcp", Addr: "localhost:1", MaxRetries: -1})
+	queue := newQueue("error-budget-unreachable-q", "error-budget-unreachable-conn", defaultKeys, redisClient, WithConsumeErrorBudget(3))
+
+	// StartConsuming fails without redis, so start the consume loop by hand
+	queue.prefetchLimit = 10
+	queue.pollDuration = time.Millisecond
+	queue.deliveryChan = make(chan Delivery, 10)
+	queue.consumeCtx, queue.consumeCancel = context.WithCancel(context.Background())
+	queue.unsettled = new(int64)
+	done := make(chan struct{})
+	go func() {
+		queue.consume()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("consume loop didn't stop")
+	}
+	c.Check(errors.Is(queue.ConsumeErr(), ErrErrorBudget), Equals, true)
+}
+
+func (suite *QueueSuite) TestScriptCaching(c *C) {
+	redisClient := redis.NewClient(&redis.Options{Network: "tcp", Addr: "localhost:6379", DB: 1})
+	recorder := &scriptRecorder{}
+	redisClient.AddHook(recorder)
+	c.Assert(redisClient.ScriptFlush(context.Background()).Err(), IsNil)
+
+	connection := OpenConnectionWithRedisClient("script-conn", redisClient)
+	queue := connection.OpenQueue("script-q").(*redisQueue)
+	c.Check(queue.migrateExpiredDeliveries(queue.delayedKey, queue.readyKey, time.Now()), Equals, 0)
+	c.Check(queue.migrateExpiredDeliveries(queue.delayedKey, queue.readyKey, time.Now()), Equals, 0)
+
+	// the script gets loaded on the first call and run by its hash afterwards
+	recorder.mutex.Lock()
+	c.Check(recorder.names, DeepEquals, []string{"evalsha", "eval", "evalsha"})
+	recorder.mutex.Unlock()
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestAddRedisHook(c *C) {
+	connection := OpenConnection("hook-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("hook-q").(*redisQueue)
+	recorder := &scriptRecorder{}
+	connection.AddRedisHook(recorder)
+
+	_, err := queue.FlushDelayed()
+	c.Check(err, IsNil)
+	recorder.mutex.Lock()
+	c.Check(recorder.names, Not(HasLen), 0)
+	recorder.mutex.Unlock()
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDelayOrder(c *C) {
+	connection := OpenConnection("delay-order-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("delay-order-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+
+	// same due time and payloads in reverse lexicographic order
+	delayedAt := time.Now().Add(-time.Second)
+	c.Check(queue.PublishOnDelay("delay-order-c", delayedAt), Equals, true)
+	c.Check(queue.PublishOnDelay("delay-order-b", delayedAt), Equals, true)
+	c.Check(queue.PublishOnDelay("delay-order-a", delayedAt), Equals, true)
+	c.Check(queue.PublishOnDelay("delay-order-later", delayedAt.Add(500*time.Millisecond)), Equals, true)
+	c.Check(queue.PublishOnDelay("delay-order-future", time.Now().Add(time.Hour)), Equals, true)
+
+	// due deliveries go to the front of the ready list
+	c.Check(queue.Publish("delay-order-ready"), Equals, true)
+	c.Check(queue.migrateExpiredDeliveries(queue.delayedKey, queue.readyKey, time.Now()), Equals, 4)
+	c.Check(queue.DelayedCount(), Equals, 1)
+	c.Check(queue.ReadyCount(), Equals, 5)
+
+	consumer := NewTestConsumer("delay-order-cons")
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("delay-order-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 5)
+	c.Check(consumer.LastDeliveries[0].Payload(), Equals, "delay-order-c")
+	c.Check(consumer.LastDeliveries[1].Payload(), Equals, "delay-order-b")
+	c.Check(consumer.LastDeliveries[2].Payload(), Equals, "delay-order-a")
+	c.Check(consumer.LastDeliveries[3].Payload(), Equals, "delay-order-later")
+	c.Check(consumer.LastDeliveries[4].Payload(), Equals, "delay-order-ready")
+
+	queue.StopConsuming()
+	queue.PurgeDelayed()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDelayedScoreOrder(c *C) {
+	// more deliveries than slots in a millisecond keep their order and stay
+	// before deliveries which were delayed to the next millisecond already
+	delayedAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	next := delayedScore(delayedAt.Add(time.Millisecond))
+	last := delayedScore(delayedAt)
+	for i := 0; i < 2500; i++ {
+		score := delayedScore(delayedAt)
+		c.Assert(score > last, Equals, true)
+		c.Assert(score != next, Equals, true)
+		last = score
+	}
+	c.Check(delayedScore(delayedAt.Add(time.Millisecond)) > last, Equals, true)
+}
+
+func (suite *QueueSuite) TestAppendRejected(c *C) {
+	connection := OpenConnection("append-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("append-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	c.Check(queue.AppendRejected("append-d1"), IsNil)
+	c.Check(queue.AppendRejected("append-d2"), IsNil)
+	c.Check(queue.RejectedCount(), Equals, 2)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	c.Check(queue.ReturnAllRejected(), Equals, 2)
+	c.Check(queue.ReadyCount(), Equals, 2)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestRestartConsuming(c *C) {
+	connection := OpenConnection("restart-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("restart-q").(*redisQueue)
+	queue.PurgeReady()
+
+	consumer := NewTestConsumer("restart-A")
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	queue.AddConsumer("restart-cons", consumer)
+	c.Check(queue.Publish("restart-d1"), Equals, true)
+	time.Sleep(5 * time.Millisecond)
+	c.Check(consumer.LastDeliveries, HasLen, 1)
+
+	c.Check(queue.StopConsuming(), Equals, true)
+	time.Sleep(5 * time.Millisecond) // wait for the consume loop to end
+	c.Check(queue.StopConsuming(), Equals, false)
+
+	consumer = NewTestConsumer("restart-B")
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	queue.AddConsumer("restart-cons", consumer)
+	c.Check(queue.Publish("restart-d2"), Equals, true)
+	time.Sleep(5 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "restart-d2")
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestAckWith(c *C) {
+	connection := OpenConnection("ack-with-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("ack-with-q").(*redisQueue)
+	queue.PurgeReady()
+	processedKey := "rmq::test::ack-with::processed"
+	queue.redisClient.Del(context.Background(), processedKey)
+
+	consumer := NewTestConsumer("ack-with-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("ack-with-cons", consumer)
+	queue.Publish("ack-with-d1")
+	time.Sleep(5 * time.Millisecond)
+	c.Assert(consumer.LastDelivery, NotNil)
+	delivery := consumer.LastDelivery
+
+	// failing fn leaves the delivery unacked
+	failure := fmt.Errorf("failed")
+	c.Check(delivery.AckWith(func(pipe redis.Pipeliner) error {
+		pipe.SAdd(context.Background(), processedKey, delivery.Payload())
+		return failure
+	}), Equals, failure)
+	c.Check(queue.UnackedCount(), Equals, 1)
+	c.Check(queue.redisClient.SCard(context.Background(), processedKey).Val(), Equals, int64(0))
+
+	c.Check(delivery.AckWith(func(pipe redis.Pipeliner) error {
+		pipe.SAdd(context.Background(), processedKey, delivery.Payload())
+		return nil
+	}), IsNil)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.redisClient.SCard(context.Background(), processedKey).Val(), Equals, int64(1))
+
+	c.Check(delivery.AckWith(func(pipe redis.Pipeliner) error { return nil }), Equals, ErrNotUnacked)
+	queue.StopConsuming()
+
+	// a lost lease applies nothing and keeps the copy consumed again
+	leased := connection.OpenQueue("ack-with-leased-q", WithLeases(20*time.Millisecond)).(*redisQueue)
+	leased.PurgeReady()
+	leased.Publish("ack-with-d2")
+	lost, err := leased.Pull(context.Background())
+	c.Assert(err, IsNil)
+	time.Sleep(30 * time.Millisecond)
+	returned, err := leased.ReturnExpiredLeases()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1)
+	again, err := leased.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(lost.AckWith(func(pipe redis.Pipeliner) error {
+		pipe.SAdd(context.Background(), processedKey, lost.Payload())
+		return nil
+	}), Equals, ErrNotUnacked)
+	c.Check(leased.UnackedCount(), Equals, 1)
+	c.Check(queue.redisClient.SCard(context.Background(), processedKey).Val(), Equals, int64(1))
+	c.Check(again.AckWith(func(pipe redis.Pipeliner) error {
+		pipe.SAdd(context.Background(), processedKey, again.Payload())
+		return nil
+	}), IsNil)
+	c.Check(leased.UnackedCount(), Equals, 0)
+	c.Check(queue.redisClient.SCard(context.Background(), processedKey).Val(), Equals, int64(2))
+
+	queue.redisClient.Del(context.Background(), processedKey)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestAckAndPublish(c *C) {
+	connection := OpenConnection("ack-publish-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("ack-publish-q").(*redisQueue)
+	next := connection.OpenQueue("ack-publish-next-q").(*redisQueue)
+	queue.PurgeReady()
+	next.PurgeReady()
+
+	queue.Publish("ack-publish-d1")
+	delivery, err := queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+
+	c.Check(delivery.AckAndPublish(next, "ack-publish-d2"), IsNil)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(next.ReadyCount(), Equals, 1)
+
+	// a settled delivery publishes nothing
+	c.Check(delivery.AckAndPublish(next, "ack-publish-d3"), Equals, ErrNotUnacked)
+	c.Check(next.ReadyCount(), Equals, 1)
+
+	published, err := next.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(published.Payload(), Equals, "ack-publish-d2")
+	c.Check(published.Ack(), Equals, true)
+
+	// test queues can't be published to, the delivery stays unacked
+	queue.Publish("ack-publish-d4")
+	delivery, err = queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.AckAndPublish(NewTestQueue("ack-publish-test-q"), "ack-publish-d5"), Equals, ErrUnsupportedPushQueue)
+	c.Check(queue.UnackedCount(), Equals, 1)
+	c.Check(delivery.Ack(), Equals, true)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishPipe(c *C) {
+	connection := OpenConnection("publish-pipe-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("publish-pipe-q").(*redisQueue)
+	queue.PurgeReady()
+
+	pipe := queue.redisClient.Pipeline()
+	queue.PublishPipe(pipe, "publish-pipe-d1")
+	queue.PublishPipe(pipe, "publish-pipe-d2")
+	c.Check(queue.ReadyCount(), Equals, 0) // not executed yet
+
+	_, err := pipe.Exec(context.Background())
+	c.Check(err, IsNil)
+	c.Check(queue.ReadyCount(), Equals, 2)
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestFlushDelayed(c *C) {
+	connection := OpenConnection("flush-delayed-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("flush-delayed-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+
+	queue.PublishOnDelay("flush-delayed-d1", time.Now().Add(time.Hour))
+	queue.PublishOnDelay("flush-delayed-d2", time.Now().Add(2*time.Hour))
+	c.Check(queue.DelayedCount(), Equals, 2)
+
+	flushed, err := queue.FlushDelayed()
+	c.Check(err, IsNil)
+	c.Check(flushed, Equals, 2)
+	c.Check(queue.DelayedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 2)
+
+	flushed, err = queue.FlushDelayed()
+	c.Check(err, IsNil)
+	c.Check(flushed, Equals, 0)
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPayloadValidator(c *C) {
+	connection := OpenConnection("validator-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("validator-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	reasons := make(chan string, 1)
+	queue.SetRejectRouter(func(delivery Delivery, reason string) (Queue, bool) {
+		reasons <- reason
+		return nil, false
+	})
+	queue.SetPayloadValidator(func(payload []byte) error {
+		if !strings.HasPrefix(string(payload), "{") {
+			return fmt.Errorf("not an object")
+		}
+		return nil
+	})
+
+	consumer := NewTestConsumer("validator-cons")
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("validator-cons", consumer)
+	queue.Publish("invalid")
+	queue.Publish("{}")
+	time.Sleep(5 * time.Millisecond)
+
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "{}")
+	c.Check(queue.RejectedCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(<-reasons, Equals, "not an object")
+
+	queue.StopConsuming()
+	queue.PurgeRejected()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestMaxRequeues(c *C) {
+	connection := OpenConnection("requeues-conn", "tcp", "localhost:6379", 1)
+	exceeded := []string{}
+	queue := connection.OpenQueue("requeues-q", WithMaxRequeues(2, func(delivery Delivery) {
+		exceeded = append(exceeded, delivery.Payload())
+	})).(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	queue.redisClient.Del(context.Background(), queue.attemptsKey)
+
+	queue.Publish("requeues-d1")
+	for i := 0; i < 2; i++ {
+		delivery, err := queue.Pull(context.Background())
+		c.Assert(err, IsNil)
+		c.Check(delivery.Nack(), Equals, true)
+		c.Check(queue.ReadyCount(), Equals, 1)
+	}
+
+	delivery, err := queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Nack(), Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 1)
+	c.Check(exceeded, DeepEquals, []string{"requeues-d1"})
+
+	// acking forgets the requeues
+	queue.Publish("requeues-d2")
+	delivery, err = queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Nack(), Equals, true)
+	delivery, err = queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Ack(), Equals, true)
+	c.Check(queue.redisClient.HLen(context.Background(), queue.attemptsKey).Val(), Equals, int64(0))
+
+	// neither nacks of settled deliveries nor the library's requeues count
+	queue.Publish("requeues-d3")
+	delivery, err = queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Nack(), Equals, true)
+	c.Check(delivery.Nack(), Equals, false)
+	delivery, err = queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(requeue(delivery), IsNil)
+	c.Check(queue.redisClient.HGet(context.Background(), queue.attemptsKey, "requeues-d3").Val(), Equals, "1")
+	queue.PurgeReady()
+
+	queue.PurgeRejected()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPoisonHandler(c *C) {
+	connection := OpenConnection("poison-conn", "tcp", "localhost:6379", 1)
+	corrupt := envelopePrefix + "{broken"
+
+	// unparseable envelopes get rejected by default
+	queue := connection.OpenQueue("poison-q", WithEnvelope()).(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	reasons := make(chan string, 1)
+	queue.SetRejectRouter(func(delivery Delivery, reason string) (Queue, bool) {
+		reasons <- reason
+		return nil, false
+	})
+	consumer := NewTestConsumer("poison-cons")
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("poison-cons", consumer)
+	queue.redisClient.LPush(context.Background(), queue.readyKey, corrupt)
+	queue.Publish("poison-d1")
+	time.Sleep(5 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "poison-d1")
+	c.Check(queue.RejectedCount(), Equals, 1)
+	c.Check(<-reasons, Equals, poisonReason)
+	queue.StopConsuming()
+	queue.PurgeRejected()
+
+	// the handler gets the raw value and can let it through
+	raws := make(chan string, 1)
+	salvaging := connection.OpenQueue("poison-salvage-q", WithEnvelope(), WithPoisonHandler(func(raw string) Action {
+		raws <- raw
+		return ActionDeliver
+	})).(*redisQueue)
+	salvaging.PurgeReady()
+	consumer = NewTestConsumer("poison-salvage-cons")
+	salvaging.StartConsuming(10, time.Millisecond)
+	salvaging.AddConsumer("poison-salvage-cons", consumer)
+	salvaging.redisClient.LPush(context.Background(), salvaging.readyKey, corrupt)
+	time.Sleep(5 * time.Millisecond)
+	c.Check(<-raws, Equals, corrupt)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(consumer.LastDelivery.Payload(), Equals, corrupt)
+	c.Check(salvaging.RejectedCount(), Equals, 0)
+
+	salvaging.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestWaitUntilEmpty(c *C) {
+	connection := OpenConnection("wait-empty-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("wait-empty-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+
+	c.Check(queue.WaitUntilEmpty(context.Background(), time.Millisecond), IsNil)
+
+	queue.Publish("wait-empty-d1")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	c.Check(queue.WaitUntilEmpty(ctx, time.Millisecond), Equals, context.DeadlineExceeded)
+	cancel()
+
+	consumer := NewTestConsumer("wait-empty-cons")
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("wait-empty-cons", consumer)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	c.Check(queue.WaitUntilEmpty(ctx, time.Millisecond), IsNil)
+	cancel()
+	c.Check(consumer.LastDeliveries, HasLen, 1)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDeliveryContext(c *C) {
+	connection := OpenConnection("delivery-ctx-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("delivery-ctx-q").(*redisQueue)
+	queue.PurgeReady()
+
+	consumer := NewTestConsumer("delivery-ctx-cons")
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("delivery-ctx-cons", consumer)
+	queue.Publish("delivery-ctx-d1")
+	time.Sleep(5 * time.Millisecond)
+	c.Assert(consumer.LastDelivery, NotNil)
+	ctx := consumer.LastDelivery.Context()
+	c.Check(ctx.Err(), IsNil)
+
+	queue.StopConsuming()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		c.Error("delivery context not cancelled")
+	}
+	c.Check(ctx.Err(), Equals, context.Canceled)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReturnAllUnackedToFront(c *C) {
+	connection := OpenConnection("to-front-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("to-front-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.redisClient.Del(context.Background(), queue.unackedKey)
+
+	returned, err := queue.ReturnAllUnackedToFront()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 0)
+
+	c.Check(queue.PublishBatch([]string{"a", "b", "c", "d"}), IsNil)
+	for i := 0; i < 2; i++ { // consume a and b
+		queue.redisClient.RPopLPush(context.Background(), queue.readyKey, queue.unackedKey)
+	}
+	c.Check(queue.UnackedCount(), Equals, 2)
+
+	returned, err = queue.ReturnAllUnackedToFront()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 2)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	ready := queue.redisClient.LRange(context.Background(), queue.readyKey, 0, -1).Val()
+	c.Check(ready, DeepEquals, []string{"d", "c", "b", "a"}) // a gets consumed first again
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestMaxInFlight(c *C) {
+	connection := OpenConnection("in-flight-conn", "tcp", "localhost:6379", 1)
+	connection.SetMaxInFlight(2)
+	queue1 := connection.OpenQueue("in-flight-q1").(*redisQueue)
+	queue2 := connection.OpenQueue("in-flight-q2").(*redisQueue)
+	consumer1 := NewTestConsumer("in-flight-cons1")
+	consumer1.AutoAck = false
+	consumer2 := NewTestConsumer("in-flight-cons2")
+	consumer2.AutoAck = false
+
+	for _, queue := range []*redisQueue{queue1, queue2} {
+		queue.PurgeReady()
+		queue.Publish("in-flight-d1")
+		queue.Publish("in-flight-d2")
+		queue.StartConsuming(10, time.Millisecond)
+	}
+	queue1.AddConsumer("in-flight-cons1", consumer1)
+	queue2.AddConsumer("in-flight-cons2", consumer2)
+
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue1.UnackedCount()+queue2.UnackedCount(), Equals, 2)
+	c.Check(queue1.ReadyCount()+queue2.ReadyCount(), Equals, 2)
+
+	ackAll := func() {
+		for _, consumer := range []*TestConsumer{consumer1, consumer2} {
+			for _, delivery := range consumer.LastDeliveries {
+				delivery.Ack()
+			}
+		}
+	}
+	ackAll()
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue1.UnackedCount()+queue2.UnackedCount(), Equals, 2)
+	c.Check(queue1.ReadyCount()+queue2.ReadyCount(), Equals, 0)
+
+	ackAll()
+	c.Check(queue1.UnackedCount()+queue2.UnackedCount(), Equals, 0)
+	c.Check(len(consumer1.LastDeliveries)+len(consumer2.LastDeliveries), Equals, 4)
+
+	queue1.StopConsuming()
+	queue2.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestMaxInFlightReclaimed(c *C) {
+	connection := OpenConnection("in-flight-reclaim-conn", "tcp", "localhost:6379", 1)
+	connection.SetMaxInFlight(1)
+	queue := connection.OpenQueue("in-flight-reclaim-q", WithLeases(20*time.Millisecond)).(*redisQueue)
+	queue.PurgeReady()
+	queue.Publish("in-flight-reclaim-d1")
+	queue.Publish("in-flight-reclaim-d2")
+	consumer := NewTestConsumer("in-flight-reclaim-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("in-flight-reclaim-cons", consumer)
+
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+
+	// the lease got reclaimed, the failed ack still frees the slot
+	time.Sleep(30 * time.Millisecond)
+	returned, err := queue.ReturnExpiredLeases()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1)
+	c.Check(consumer.LastDeliveries[0].Ack(), Equals, false)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+
+	// stopping while waiting for a slot ends the consume loop
+	c.Check(queue.StopConsuming(), Equals, true)
+	stopped := false
+	for i := 0; i < 100 && !stopped; i++ {
+		time.Sleep(time.Millisecond)
+		stopped = queue.StartConsuming(10, time.Millisecond) == nil
+	}
+	c.Check(stopped, Equals, true)
+
+	queue.StopConsuming()
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestRetry(c *C) {
+	connection := OpenConnection("retry-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("retry-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	queue.PurgeDelayed()
+	queue.redisClient.Del(context.Background(), queue.attemptsKey)
+
+	exhausted := make(chan Delivery, 1)
+	queue.SetRetryPolicy(RetryPolicy{
+		MaxAttempts: 2,
+		Backoff:     func(attempt int) time.Duration { return 0 },
+		OnExhausted: func(delivery Delivery) {
+			delivery.Reject()
+			exhausted <- delivery
+		},
+	})
+
+	consumer := NewTestConsumer("retry-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("retry-cons", consumer)
+	queue.Publish("retry-d1")
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		time.Sleep(10 * time.Millisecond)
+		c.Assert(consumer.LastDeliveries, HasLen, attempt)
+		c.Check(consumer.LastDelivery.Retry(), IsNil)
+	}
+
+	select {
+	case delivery := <-exhausted:
+		c.Check(delivery.Payload(), Equals, "retry-d1")
+	case <-time.After(time.Second):
+		c.Error("retries not exhausted")
+	}
+	c.Check(queue.RejectedCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.DelayedCount(), Equals, 0)
+	c.Check(consumer.LastDelivery.Retry(), Equals, ErrNotUnacked)
+
+	queue.StopConsuming()
+	queue.PurgeRejected()
+
+	other := connection.OpenQueue("retry-no-policy-q").(*redisQueue)
+	other.Publish("retry-d2")
+	delivery, err := other.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Retry(), Equals, ErrNoRetryPolicy)
+	c.Check(delivery.Ack(), Equals, true)
+	connection.StopHeartbeat()
+}
+
+// progressConsumer processes every other delivery of its first batch and all
+// deliveries of later batches
+type progressConsumer struct {
+	mu      sync.Mutex
+	batches [][]string
+}
+
+func (consumer *progressConsumer) Consume(batch Deliveries) {
+	panic("ConsumeProgress should be called instead")
+}
+
+func (consumer *progressConsumer) ConsumeProgress(batch Deliveries) []int {
+	consumer.mu.Lock()
+	defer consumer.mu.Unlock()
+
+	payloads := []string{}
+	processed := []int{}
+	for i, delivery := range batch {
+		payloads = append(payloads, delivery.Payload())
+		if len(consumer.batches) > 0 || i%2 == 0 {
+			processed = append(processed, i)
+		}
+	}
+	consumer.batches = append(consumer.batches, payloads)
+	return processed
+}
+
+func (suite *QueueSuite) TestBatchProgress(c *C) {
+	connection := OpenConnection("batch-progress-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("batch-progress-q").(*redisQueue)
+	queue.PurgeReady()
+	c.Check(queue.PublishBatch([]string{"p0", "p1", "p2", "p3"}), IsNil)
+
+	consumer := &progressConsumer{}
+	queue.StartConsuming(4, time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	queue.AddBatchConsumerWithTimeout("batch-progress-cons", 4, 5*time.Millisecond, consumer)
+	time.Sleep(20 * time.Millisecond)
+
+	consumer.mu.Lock()
+	c.Check(consumer.batches, DeepEquals, [][]string{{"p0", "p1", "p2", "p3"}, {"p1", "p3"}})
+	consumer.mu.Unlock()
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestWarmUp(c *C) {
+	start := time.Now()
+	queue := newQueue("warm-up-q", "warm-up-conn", defaultKeys, nil)
+	queue.prefetchLimit = 11
+	queue.consumingSince = start
+	c.Check(queue.warmingUp(start), Equals, false)
+	c.Check(queue.warmedUpPrefetchLimit(start), Equals, 11)
+
+	queue = newQueue("warm-up-q", "warm-up-conn", defaultKeys, nil, WithWarmUp(10*time.Second))
+	queue.prefetchLimit = 11
+	queue.consumingSince = start
+	c.Check(queue.warmingUp(start), Equals, true)
+	c.Check(queue.warmedUpPrefetchLimit(start), Equals, 1)
+	c.Check(queue.warmedUpPrefetchLimit(start.Add(5*time.Second)), Equals, 6)
+	c.Check(queue.warmingUp(start.Add(10*time.Second)), Equals, false)
+	c.Check(queue.warmedUpPrefetchLimit(start.Add(10*time.Second)), Equals, 11)
+}
+
+func (suite *QueueSuite) TestReturnAllUnackedE(c *C) {
+	connection := OpenConnection("return-e-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("return-e-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.redisClient.Del(context.Background(), queue.unackedKey)
+
+	c.Check(queue.PublishBatch([]string{"return-e-d1", "return-e-d2"}), IsNil)
+	for i := 0; i < 2; i++ {
+		queue.redisClient.RPopLPush(context.Background(), queue.readyKey, queue.unackedKey)
+	}
+
+	returned, err := queue.ReturnAllUnackedE()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 2)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 2)
+
+	// a broken connection returns the error instead of panicking
+	broken := newQueue("return-e-q", "return-e-conn", defaultKeys, redis.NewClient(&redis.Options{Addr: "localhost:1"}))
+	returned, err = broken.ReturnAllUnackedE()
+	c.Check(err, NotNil)
+	c.Check(returned, Equals, 0)
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReturnAllUnackedOrder(c *C) {
+	connection := OpenConnection("return-order-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("return-order-q").(*redisQueue)
+	queue.PurgeReady()
+
+	c.Check(queue.PublishBatch([]string{"A", "B", "C"}), IsNil)
+	for _, payload := range []string{"A", "B", "C"} {
+		delivery, err := queue.Pull(context.Background())
+		c.Assert(err, IsNil)
+		c.Check(delivery.Payload(), Equals, payload)
+	}
+	c.Check(queue.Publish("D"), Equals, true)
+	queue.migrateChunkSize = 2 // returned in more than one chunk
+	c.Check(queue.ReturnAllUnacked(), Equals, 3)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	for _, payload := range []string{"A", "B", "C", "D"} {
+		delivery, err := queue.Pull(context.Background())
+		c.Assert(err, IsNil)
+		c.Check(delivery.Payload(), Equals, payload)
+		c.Check(delivery.Ack(), Equals, true)
+	}
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestOpenConnectionWithConfig(c *C) {
+	clock := NewTestClock(time.Now())
+	connection := OpenConnectionWithConfig(Options{
+		Tag:   "config-conn",
+		Addr:  "localhost:6379",
+		DB:    1,
+		Clock: clock,
+	})
+	c.Check(strings.HasPrefix(connection.Name, "config-conn-"), Equals, true)
+	c.Check(connection.Check(), Equals, true)
+	c.Check(connection.clock, Equals, Clock(clock))
+
+	queue := connection.OpenQueue("config-q").(*redisQueue)
+	c.Check(queue.clock, Equals, Clock(clock))
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestOpenConnectionWithNamespace(c *C) {
+	var logs bytes.Buffer
+	var handled []error
+	connection := OpenConnectionWithConfig(Options{
+		Tag:          "namespace-conn",
+		Addr:         "localhost:6379",
+		DB:           1,
+		Namespace:    "namespace-test",
+		Logger:       log.New(&logs, "", 0),
+		ErrorHandler: func(err error) { handled = append(handled, err) },
+	})
+	c.Check(connection.heartbeatKey, Equals, "namespace-test::connection::"+connection.Name+"::heartbeat")
+	c.Check(connection.Check(), Equals, true)
+
+	queue := connection.OpenQueue("namespace-q", WithDebug(true)).(*redisQueue)
+	queue.PurgeReady()
+	c.Check(queue.readyKey, Equals, "namespace-test::queue::[namespace-q]::ready")
+	c.Check(queue.unackedKey, Equals, "namespace-test::connection::"+connection.Name+"::queue::[namespace-q]::unacked")
+	c.Check(queue.Publish("namespace-d1"), Equals, true)
+	c.Check(queue.redisClient.LLen(context.Background(), "namespace-test::queue::[namespace-q]::ready").Val(), Equals, int64(1))
+	c.Check(connection.GetOpenQueues(), DeepEquals, []string{"namespace-q"})
+
+	// the default namespace doesn't see the queue
+	other := OpenConnection("namespace-other-conn", "tcp", "localhost:6379", 1)
+	exists, err := other.QueueExists("namespace-q")
+	c.Check(err, IsNil)
+	c.Check(exists, Equals, false)
+	c.Check(other.OpenQueue("namespace-q").ReadyCount(), Equals, 0)
+
+	delivery, err := queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Ack(), Equals, true)
+	c.Check(strings.Contains(logs.String(), "rmq debug: delivery ack"), Equals, true)
+
+	// redis errors of the consume loop go to the error handler instead of panicking
+	queue.consumeFailed(ErrNotSupported)
+	c.Check(handled, DeepEquals, []error{ErrNotSupported})
+	c.Check(queue.spendErrorBudget(), Equals, false)
+
+	queue.Close()
+	other.StopHeartbeat()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestClock(c *C) {
+	start := time.Now()
+	clock := NewTestClock(start)
+	connection := OpenConnection("clock-conn", "tcp", "localhost:6379", 1)
+	connection.SetClock(clock)
+	queue := connection.OpenQueue("clock-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+
+	consumer := NewTestConsumer("clock-cons")
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("clock-cons", consumer)
+	queue.PublishOnDelay("clock-d1", start.Add(time.Hour))
+	time.Sleep(5 * time.Millisecond)
+	c.Check(consumer.LastDeliveries, HasLen, 0)
+	c.Check(queue.DelayedCount(), Equals, 1)
+
+	clock.Advance(time.Hour)
+	time.Sleep(5 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "clock-d1")
+	c.Check(queue.DelayedCount(), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+// TestOrdering documents how each operation orders deliveries. The ready list
+// is consumed from the right, so the rightmost delivery is consumed next:
+//
+//	Publish                 LPUSH ready      -> back
+//	consume / Pull          RPOPLPUSH ready  -> unacked
+//	Reject                  LPUSH rejected
+//	ReturnRejected          RPOPLPUSH rejected -> back of ready, oldest rejected first
+//	Nack                    LPUSH ready      -> back
+//	delayed migration       RPUSH ready      -> front, in due order (back WithStrictFIFO)
+//	ReturnAllUnacked        RPUSH ready      -> front, in consume order (back WithStrictFIFO)
+//	ReturnAllUnackedToFront RPUSH ready      -> front (not allowed WithStrictFIFO)
+func (suite *QueueSuite) TestOrdering(c *C) {
+	connection := OpenConnection("ordering-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("ordering-q", WithStrictFIFO()).(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	ready := func() []string {
+		return queue.redisClient.LRange(context.Background(), queue.readyKey, 0, -1).Val()
+	}
+
+	queue.Publish("A")
+	queue.Publish("B")
+	queue.Publish("C")
+	c.Check(ready(), DeepEquals, []string{"C", "B", "A"})
+
+	a, err := queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(a.Payload(), Equals, "A")
+	c.Check(a.Reject(), Equals, true)
+	queue.Publish("D")
+	c.Check(queue.ReturnRejected(1), Equals, 1)
+	c.Check(ready(), DeepEquals, []string{"A", "D", "C", "B"}) // A after everything published before
+
+	b, err := queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(b.Payload(), Equals, "B")
+	c.Check(b.Nack(), Equals, true)
+	c.Check(ready(), DeepEquals, []string{"B", "A", "D", "C"})
+
+	_, err = queue.Pull(context.Background()) // C
+	c.Assert(err, IsNil)
+	returned, err := queue.ReturnAllUnackedToFront()
+	c.Check(err, Equals, ErrStrictFIFO)
+	c.Check(returned, Equals, 0)
+	c.Check(queue.ReturnAllUnacked(), Equals, 1)
+	c.Check(ready(), DeepEquals, []string{"C", "B", "A", "D"})
+
+	c.Check(queue.PublishOnDelay("E", time.Now().Add(-time.Second)), Equals, true)
+	c.Check(queue.migrateExpiredDeliveries(queue.delayedKey, queue.readyKey, time.Now()), Equals, 1)
+	c.Check(ready(), DeepEquals, []string{"E", "C", "B", "A", "D"})
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestTenantQueue(c *C) {
+	connection := OpenConnection("tenant-conn", "tcp", "localhost:6379", 1)
+	queue1 := connection.OpenTenantQueue("tenant1", "tenant-q").(*redisQueue)
+	queue2 := connection.OpenTenantQueue("tenant2", "tenant-q").(*redisQueue)
+	plain := connection.OpenQueue("tenant-q").(*redisQueue)
+	for _, queue := range []*redisQueue{queue1, queue2, plain} {
+		queue.PurgeReady()
+	}
+
+	c.Check(queue1.name, Equals, "tenant::tenant1::tenant-q")
+	c.Check(queue1.readyKey, Not(Equals), queue2.readyKey)
+	c.Check(queue1.Publish("tenant-d1"), Equals, true)
+	c.Check(queue1.ReadyCount(), Equals, 1)
+	c.Check(queue2.ReadyCount(), Equals, 0)
+	c.Check(plain.ReadyCount(), Equals, 0)
+
+	// separators in the tenant don't make names collide
+	c.Check(TenantQueueName("a::b", "c"), Equals, "tenant::a%3A%3Ab::c")
+	c.Check(TenantQueueName("a::b", "c"), Not(Equals), TenantQueueName("a", "b::c"))
+	c.Check(TenantQueueName("a%3A", "b"), Not(Equals), TenantQueueName("a:", "b"))
+
+	queue1.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestCloseE(c *C) {
+	connection := OpenConnection("close-e-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("close-e-q").(*redisQueue)
+	queue.Publish("close-e-d1")
+	queue.AppendRejected("close-e-d2")
+
+	c.Check(queue.CloseE(), IsNil)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 0)
+	exists, err := connection.QueueExists("close-e-q")
+	c.Check(err, IsNil)
+	c.Check(exists, Equals, false)
+
+	broken := newQueue("close-e-q", "close-e-conn", defaultKeys, redis.NewClient(&redis.Options{Addr: "localhost:1"}))
+	err = broken.CloseE()
+	c.Assert(err, NotNil)
+	c.Check(strings.Contains(err.Error(), "purge-rejected"), Equals, true)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestRemoveReady(c *C) {
+	connection := OpenConnection("remove-ready-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("remove-ready-q").(*redisQueue)
+	queue.PurgeReady()
+
+	c.Check(queue.PublishBatch([]string{"keep", "drop", "drop", "drop"}), IsNil)
+	removed, err := queue.RemoveReady("drop", 2)
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, 2)
+	c.Check(queue.ReadyCount(), Equals, 2)
+
+	removed, err = queue.RemoveReady("drop", 0)
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, 1)
+	removed, err = queue.RemoveReady("missing", 0)
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 1)
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestGracefulShutdown(c *C) {
+	connection := OpenConnection("shutdown-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("shutdown-q").(*redisQueue)
+	queue.PurgeReady()
+
+	consumer := NewTestConsumer("shutdown-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("shutdown-cons", consumer)
+	c.Check(queue.PublishBatch([]string{"shutdown-d1", "shutdown-d2"}), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.UnackedCount(), Equals, 2)
+
+	// the first delivery gets acked within the budget, the second one not
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		consumer.LastDeliveries[0].Ack()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownReserve+200*time.Millisecond)
+	defer cancel()
+	c.Check(connection.GracefulShutdown(ctx), IsNil)
+	c.Check(queue.StopConsuming(), Equals, false) // stopped already
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.Publish("shutdown-d3"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.ReadyCount(), Equals, 2)
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestOpenQueuesTracking(c *C) {
+	connection := OpenConnection("open-queues-conn", "tcp", "localhost:6379", 1)
+	first := connection.OpenQueue("open-queues-q")
+	second := connection.OpenQueue("open-queues-q")
+	other := connection.OpenQueue("open-queues-other-q")
+	c.Check(connection.openQueues, HasLen, 3)
+
+	// closing a queue which was opened again doesn't drop the other handle
+	c.Check(first.CloseE(), IsNil)
+	c.Check(connection.openQueues[second], Equals, true)
+	c.Check(connection.openQueues[first], Equals, false)
+	c.Check(second.CloseE(), IsNil)
+	c.Check(other.CloseE(), IsNil)
+	c.Check(connection.openQueues, HasLen, 0)
+
+	// the shutdown stops a consuming handle of a queue which was opened again
+	consuming := connection.OpenQueue("open-queues-q")
+	publishing := connection.OpenQueue("open-queues-q")
+	c.Check(consuming.StartConsuming(10, time.Millisecond), IsNil)
+	consumer := NewTestConsumer("open-queues-cons")
+	consuming.AddConsumer("open-queues-cons", consumer)
+	c.Check(publishing.Publish("open-queues-d1"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(consumer.Deliveries(), HasLen, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownReserve+100*time.Millisecond)
+	defer cancel()
+	c.Check(connection.GracefulShutdown(ctx), IsNil)
+	c.Check(consuming.StopConsuming(), Equals, false) // stopped already
+	c.Check(publishing.Publish("open-queues-d2"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(consumer.Deliveries(), HasLen, 1)
+	c.Check(consuming.(*redisQueue).ReadyCount(), Equals, 1)
+
+	consuming.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDelayedLatency(c *C) {
+	connection := OpenConnection("latency-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("latency-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+
+	consumer := NewTestConsumer("latency-cons")
+	queue.StartConsuming(10, 50*time.Millisecond)
+	queue.AddConsumer("latency-cons", consumer)
+
+	dueAt := time.Now().Add(time.Second)
+	c.Check(queue.PublishOnDelay("latency-d1", dueAt), Equals, true)
+
+	for consumer.Last() == nil && time.Since(dueAt) < time.Second {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(consumer.Last(), NotNil)
+	// consumed within about one poll of becoming due
+	c.Check(time.Since(dueAt) < 100*time.Millisecond, Equals, true)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReadyShedding(c *C) {
+	connection := OpenConnection("shedding-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("shedding-q", WithReadyShedding(2, time.Second)).(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+
+	for i := 0; i < 5; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("shedding-d%d", i)), Equals, true)
+	}
+	// publishes over the soft cap get delayed by up to the spread
+	c.Check(queue.ReadyCount(), Equals, 3)
+	c.Check(queue.DelayedCount(), Equals, 2)
+	c.Check(queue.migrateExpiredDeliveries(queue.delayedKey, queue.readyKey, time.Now().Add(time.Second)), Equals, 2)
+	c.Check(queue.ReadyCount(), Equals, 5)
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestAddConsumerFunc(c *C) {
+	connection := OpenConnection("func-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("func-q").(*redisQueue)
+	queue.PurgeReady()
+
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	queue.StartConsuming(10, time.Millisecond)
+	names := queue.AddConsumerFunc("func-cons", 3, func(delivery Delivery) {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+		delivery.Ack()
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+	})
+	c.Check(names, HasLen, 3)
+
+	for i := 0; i < 6; i++ {
+		queue.Publish(fmt.Sprintf("func-d%d", i))
+	}
+	time.Sleep(100 * time.Millisecond)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	mutex.Lock()
+	c.Check(maxRunning, Equals, 3)
+	mutex.Unlock()
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPeekAndAckUnacked(c *C) {
+	connection := OpenConnection("peek-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("peek-q", WithEnvelope()).(*redisQueue)
+	queue.PurgeReady()
+	queue.redisClient.Del(context.Background(), queue.unackedKey)
+
+	c.Check(queue.PublishBatch([]string{"peek-d1", "peek-d2", "peek-d3"}), IsNil)
+	for i := 0; i < 3; i++ {
+		queue.redisClient.RPopLPush(context.Background(), queue.readyKey, queue.unackedKey)
+	}
+
+	admin := OpenConnection("peek-admin", "tcp", "localhost:6379", 1)
+	payloads, err := admin.PeekUnacked(connection.Name, "peek-q", 2)
+	c.Check(err, IsNil)
+	c.Check(payloads, DeepEquals, []string{"peek-d3", "peek-d2"})
+
+	c.Check(admin.AckUnackedAt(connection.Name, "peek-q", 1, "peek-d1"), Equals, ErrDeliveryNotFound)
+	raw := queue.redisClient.LIndex(context.Background(), queue.unackedKey, 1).Val()
+	queue.redisClient.HSet(context.Background(), queue.attemptsKey, raw, 2)
+	c.Check(admin.AckUnackedAt(connection.Name, "peek-q", 1, "peek-d2"), IsNil)
+	c.Check(queue.redisClient.HExists(context.Background(), queue.attemptsKey, raw).Val(), Equals, false)
+	payloads, err = admin.PeekUnacked(connection.Name, "peek-q", 10)
+	c.Check(err, IsNil)
+	c.Check(payloads, DeepEquals, []string{"peek-d3", "peek-d1"})
+	// the index is stale once the list changed
+	c.Check(admin.AckUnackedAt(connection.Name, "peek-q", 0, "peek-d1"), Equals, ErrDeliveryNotFound)
+	c.Check(admin.AckUnackedAt(connection.Name, "peek-q", 5, "peek-d1"), Equals, ErrDeliveryNotFound)
+	c.Check(queue.UnackedCount(), Equals, 2)
+
+	queue.redisClient.Del(context.Background(), queue.unackedKey)
+	admin.StopHeartbeat()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishDurable(c *C) {
+	connection := OpenConnection("durable-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("durable-q", WithDurability(0, 10*time.Millisecond)).(*redisQueue)
+	queue.PurgeReady()
+
+	c.Check(queue.PublishDurable(context.Background(), "durable-d1"), IsNil)
+	c.Check(queue.ReadyCount(), Equals, 1)
+
+	// the test redis has no replicas, the delivery gets published anyway
+	unreplicated := connection.OpenQueue("durable-q", WithDurability(1, 10*time.Millisecond)).(*redisQueue)
+	c.Check(unreplicated.PublishDurable(context.Background(), "durable-d2"), Equals, ErrNotReplicated)
+	c.Check(queue.ReadyCount(), Equals, 2)
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestKeys(c *C) {
+	connection := OpenConnection("keys-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("keys-q").(*redisQueue)
+
+	c.Check(ReadyKey("keys-q"), Equals, "rmq::queue::[keys-q]::ready")
+	c.Check(ReadyKey("keys-q"), Equals, queue.readyKey)
+	c.Check(RejectedKey("keys-q"), Equals, queue.rejectedKey)
+	c.Check(DelayedKey("keys-q"), Equals, queue.delayedKey)
+	c.Check(UnackedKey(connection.Name, "keys-q"), Equals, queue.unackedKey)
+	c.Check(UnackedKey(connection.Name, "keys-q"), Equals, "rmq::connection::"+connection.Name+"::queue::[keys-q]::unacked")
+	c.Check(connection.Keys(), Equals, NewKeyBuilder(""))
+
+	// the namespace replaces rmq everywhere
+	keys := NewKeyBuilder("keys-ns")
+	c.Check(keys.ReadyKey("keys-q"), Equals, "keys-ns::queue::[keys-q]::ready")
+	c.Check(keys.UnackedKey("keys-conn", "keys-q"), Equals, "keys-ns::connection::keys-conn::queue::[keys-q]::unacked")
+	c.Check(keys.IndexKey("keys-q", "order", "1"), Equals, "keys-ns::queue::[keys-q]::index::order:1")
+	c.Check(keys.QueuesKey(), Equals, "keys-ns::queues")
+	c.Check(keys.DelayedKey("keys-q"), Equals, "keys-ns::queue::[keys-q]::delayed")
+
+	namespaced := OpenConnectionWithConfig(Options{Tag: "keys-ns-conn", Addr: "localhost:6379", DB: 1, Namespace: "keys-ns"})
+	queue = namespaced.OpenQueue("keys-q").(*redisQueue)
+	c.Check(namespaced.Keys().ReadyKey("keys-q"), Equals, queue.readyKey)
+	c.Check(namespaced.Keys().UnackedKey(namespaced.Name, "keys-q"), Equals, queue.unackedKey)
+
+	namespaced.StopHeartbeat()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishBatchOnDelay(c *C) {
+	connection := OpenConnection("batch-delay-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("batch-delay-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+
+	now := time.Now()
+	added, err := queue.PublishBatchOnDelay([]DelayedItem{
+		{Payload: "batch-delay-d1", At: now.Add(-time.Second)},
+		{Payload: "batch-delay-d2", At: now.Add(-2 * time.Second)},
+		{Payload: "batch-delay-d3", At: now.Add(time.Hour)},
+	})
+	c.Check(err, IsNil)
+	c.Check(added, Equals, 3)
+	c.Check(queue.DelayedCount(), Equals, 3)
+
+	added, err = queue.PublishBatchOnDelay(nil)
+	c.Check(err, IsNil)
+	c.Check(added, Equals, 0)
+
+	c.Check(queue.migrateExpiredDeliveries(queue.delayedKey, queue.readyKey, now), Equals, 2)
+	c.Check(queue.DelayedCount(), Equals, 1)
+	delivery, err := queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Payload(), Equals, "batch-delay-d2")
+	delivery.Ack()
+
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDelayedReleaseRate(c *C) {
+	connection := OpenConnection("release-rate-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("release-rate-q", WithDelayedReleaseRate(4)).(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		c.Check(queue.PublishOnDelay(fmt.Sprintf("release-rate-d%d", i), now.Add(-time.Second)), Equals, true)
+	}
+
+	// starts with one second's worth, then drips with the rate
+	c.Check(queue.migrateExpiredDeliveries(queue.delayedKey, queue.readyKey, now), Equals, 4)
+	c.Check(queue.migrateExpiredDeliveries(queue.delayedKey, queue.readyKey, now), Equals, 0)
+	c.Check(queue.migrateExpiredDeliveries(queue.delayedKey, queue.readyKey, now.Add(500*time.Millisecond)), Equals, 2)
+	// a pause doesn't build up more than one second's worth
+	c.Check(queue.migrateExpiredDeliveries(queue.delayedKey, queue.readyKey, now.Add(time.Hour)), Equals, 4)
+	c.Check(queue.ReadyCount(), Equals, 10)
+	c.Check(queue.DelayedCount(), Equals, 0)
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishOnDelayWithMode(c *C) {
+	connection := OpenConnection("delay-mode-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("delay-mode-q").(*redisQueue)
+	queue.PurgeDelayed()
+
+	now := time.Now()
+	score := func() time.Duration {
+		seconds := queue.redisClient.ZScore(context.Background(), queue.delayedKey, queue.wrap("delay-mode-d")).Val()
+		return time.Unix(0, int64(seconds*1e9)).Sub(now).Round(time.Hour)
+	}
+
+	ok, err := queue.PublishOnDelayWithMode("delay-mode-d", now.Add(2*time.Hour), DelayXX)
+	c.Check(err, IsNil)
+	c.Check(ok, Equals, false)
+	c.Check(queue.DelayedCount(), Equals, 0)
+
+	ok, err = queue.PublishOnDelayWithMode("delay-mode-d", now.Add(2*time.Hour), DelayNX)
+	c.Check(err, IsNil)
+	c.Check(ok, Equals, true)
+	ok, err = queue.PublishOnDelayWithMode("delay-mode-d", now.Add(time.Hour), DelayNX)
+	c.Check(err, IsNil)
+	c.Check(ok, Equals, false)
+	c.Check(score(), Equals, 2*time.Hour)
+
+	ok, err = queue.PublishOnDelayWithMode("delay-mode-d", now.Add(3*time.Hour), DelayLT)
+	c.Check(err, IsNil)
+	c.Check(ok, Equals, false)
+	ok, err = queue.PublishOnDelayWithMode("delay-mode-d", now.Add(time.Hour), DelayLT)
+	c.Check(err, IsNil)
+	c.Check(ok, Equals, true)
+	c.Check(score(), Equals, time.Hour)
+
+	ok, err = queue.PublishOnDelayWithMode("delay-mode-d", now.Add(30*time.Minute), DelayGT)
+	c.Check(err, IsNil)
+	c.Check(ok, Equals, false)
+	ok, err = queue.PublishOnDelayWithMode("delay-mode-d", now.Add(4*time.Hour), DelayGT)
+	c.Check(err, IsNil)
+	c.Check(ok, Equals, true)
+	c.Check(score(), Equals, 4*time.Hour)
+
+	ok, err = queue.PublishOnDelayWithMode("delay-mode-d", now.Add(2*time.Hour), DelayAlways)
+	c.Check(err, IsNil)
+	c.Check(ok, Equals, true)
+	c.Check(score(), Equals, 2*time.Hour)
+	c.Check(queue.DelayedCount(), Equals, 1)
+
+	queue.PurgeDelayed()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestExtendLease(c *C) {
+	connection := OpenConnection("extend-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("extend-q", WithLeases(20*time.Millisecond)).(*redisQueue)
+	queue.PurgeReady()
+
+	c.Check(queue.PublishBatch([]string{"extend-d1", "extend-d2"}), IsNil)
+	extended, err := queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	expiring, err := queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+
+	// only the extended lease is still held after the original duration, the
+	// context in use keeps running with the new deadline
+	ctx := extended.Context()
+	expiringCtx := expiring.Context()
+	c.Check(extended.ExtendLease(time.Hour), IsNil)
+	c.Check(ctx.Err(), IsNil)
+	c.Check(extended.Context(), Equals, ctx)
+	deadline, ok := ctx.Deadline()
+	c.Check(ok, Equals, true)
+	c.Check(time.Until(deadline) > time.Minute, Equals, true)
+	time.Sleep(30 * time.Millisecond)
+	c.Check(ctx.Err(), IsNil)
+	c.Check(expiringCtx.Err(), Equals, context.DeadlineExceeded)
+	returned, err := queue.ReturnExpiredLeases()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1)
+	c.Check(expiring.ExtendLease(time.Hour), Equals, ErrNotUnacked)
+	c.Check(extended.Ack(), Equals, true)
+
+	unleased := connection.OpenQueue("extend-q").(*redisQueue)
+	delivery, err := unleased.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.ExtendLease(time.Hour), Equals, ErrNotLeased)
+	delivery.Ack()
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReturnRejectedWithDelay(c *C) {
+	connection := OpenConnection("rejected-delay-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("rejected-delay-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	queue.PurgeDelayed()
+
+	c.Check(queue.PublishRejected("rejected-delay-d1"), Equals, true)
+	c.Check(queue.PublishRejected("rejected-delay-d2"), Equals, true)
+	c.Check(queue.PublishRejected("rejected-delay-d3"), Equals, true)
+
+	returned, err := queue.ReturnRejectedWithDelay(2, time.Minute)
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 2)
+	c.Check(queue.RejectedCount(), Equals, 1)
+	c.Check(queue.DelayedCount(), Equals, 2)
+	c.Check(queue.ReadyCount(), Equals, 0)
+
+	// not due before the delay passed
+	c.Check(queue.migrateExpiredDeliveries(queue.delayedKey, queue.readyKey, time.Now()), Equals, 0)
+	c.Check(queue.migrateExpiredDeliveries(queue.delayedKey, queue.readyKey, time.Now().Add(time.Minute+time.Second)), Equals, 2)
+	c.Check(queue.ReadyCount(), Equals, 2)
+
+	returned, err = queue.ReturnRejectedWithDelay(5, time.Minute)
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1)
+
+	// duplicate payloads don't collapse in the delayed set
+	c.Check(queue.PublishRejected("rejected-delay-dup"), Equals, true)
+	c.Check(queue.PublishRejected("rejected-delay-dup"), Equals, true)
+	c.Check(queue.PublishRejected("rejected-delay-d4"), Equals, true)
+	returned, err = queue.ReturnRejectedWithDelay(5, time.Minute)
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 2)
+	c.Check(queue.RejectedCount(), Equals, 1)
+	c.Check(queue.DelayedCount(), Equals, 3)
+	c.Check(queue.redisClient.LRange(context.Background(), queue.rejectedKey, 0, -1).Val(), DeepEquals, []string{"rejected-delay-dup"})
+
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	queue.PurgeDelayed()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReturnRejectedSince(c *C) {
+	connection := OpenConnection("since-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("since-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	c.Check(queue.AppendRejected("since-old"), IsNil)
+	time.Sleep(5 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(5 * time.Millisecond)
+
+	c.Check(queue.Publish("since-new"), Equals, true)
+	delivery, err := queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Reject(), Equals, true)
+	c.Check(queue.RejectedCount(), Equals, 2)
+
+	returned, err := queue.ReturnRejectedSince(since)
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1)
+	c.Check(queue.RejectedCount(), Equals, 1)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	delivery, err = queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Payload(), Equals, "since-new")
+	delivery.Ack()
+
+	// duplicates keep their own rejection times
+	c.Check(queue.AppendRejected("since-dup"), IsNil)
+	time.Sleep(5 * time.Millisecond)
+	since = time.Now()
+	time.Sleep(5 * time.Millisecond)
+	c.Check(queue.AppendRejected("since-dup"), IsNil)
+	c.Check(queue.AppendRejected("since-dup"), IsNil)
+	returned, err = queue.ReturnRejectedSince(since)
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 2)
+	c.Check(queue.RejectedCount(), Equals, 2)
+	queue.PurgeReady()
+
+	// ReturnRejected drops the rejection times of the returned deliveries
+	c.Check(queue.ReturnRejected(2), Equals, 2)
+	c.Check(queue.redisClient.ZCard(context.Background(), queue.rejectedAtKey).Val(), Equals, int64(0))
+	queue.PurgeReady()
+
+	c.Check(queue.AppendRejected("since-close"), IsNil)
+	c.Check(queue.CloseE(), IsNil)
+	c.Check(queue.redisClient.Exists(context.Background(), queue.rejectedAtKey).Val(), Equals, int64(0))
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDiscardQueue(c *C) {
+	connection := OpenConnection("discard-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("discard-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	c.Check(queue.PublishBatch([]string{"discard-d1", "discard-d2"}), IsNil)
+
+	// without push queue Push rejects
+	delivery, err := queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Push(), Equals, true)
+	c.Check(queue.RejectedCount(), Equals, 1)
+
+	c.Check(queue.SetPushQueue(DiscardQueue), IsNil)
+	delivery, err = queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Push(), Equals, true)
+	c.Check(delivery.Push(), Equals, false)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 1)
+	c.Check(queue.ReadyCount(), Equals, 0)
+
+	// pushes count in the consumer stats like acks and rejects
+	for _, push := range []Queue{DiscardQueue, connection.OpenQueue("discard-next-q"), nil} {
+		counted := connection.OpenQueue("discard-counted-q").(*redisQueue)
+		if push != nil {
+			c.Check(counted.SetPushQueue(push), IsNil)
+		}
+		consumer := NewTestConsumer("discard-cons")
+		consumer.AutoAck = false
+		counted.StartConsuming(10, time.Millisecond)
+		name := counted.AddConsumer("discard-cons", consumer)
+		counted.Publish("discard-d3")
+		time.Sleep(10 * time.Millisecond)
+		c.Assert(consumer.Deliveries(), HasLen, 1)
+		c.Check(consumer.Last().Push(), Equals, true)
+		stat, ok := counted.ConsumerStats(name)
+		c.Check(ok, Equals, true)
+		c.Check(stat.Acked+stat.Rejected, Equals, int64(1))
+		c.Check(stat.Rejected == 1, Equals, push == nil)
+		counted.StopConsuming()
+		counted.PurgeRejected()
+	}
+	connection.OpenQueue("discard-next-q").PurgeReady()
+
+	// publishing to DiscardQueue stores nothing
+	c.Check(DiscardQueue.Publish("discard-d4"), Equals, true)
+	c.Check(DiscardQueue.(*discardQueue).LastDeliveries, HasLen, 0)
+
+	queue.PurgeRejected()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumerHandle(c *C) {
+	connection := OpenConnection("handle-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("handle-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.RemoveAllConsumers()
+
+	stopped := NewTestConsumer("handle-stopped")
+	running := NewTestConsumer("handle-running")
+	queue.StartConsuming(10, time.Millisecond)
+	handle := queue.AddConsumerWithHandle("handle-stopped", stopped)
+	queue.AddConsumer("handle-running", running)
+	c.Check(queue.GetConsumers(), HasLen, 2)
+
+	c.Check(queue.Publish("handle-d1"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(handle.Stop(), Equals, true)
+	c.Check(handle.Stop(), Equals, false)
+	handle.Wait()
+	c.Check(queue.GetConsumers(), HasLen, 1)
+	consumedBefore := len(stopped.LastDeliveries)
+	c.Check(handle.Stats().Consumed, Equals, int64(consumedBefore))
+
+	// the remaining consumer gets all deliveries
+	for i := 0; i < 5; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("handle-d%d", i+2)), Equals, true)
+	}
+	time.Sleep(20 * time.Millisecond)
+	c.Check(stopped.LastDeliveries, HasLen, consumedBefore)
+	c.Check(len(running.LastDeliveries), Equals, 6-consumedBefore)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	queue.StopConsuming()
+
+	// a consumer can stop itself
+	selfQueue := connection.OpenQueue("handle-self-q").(*redisQueue)
+	selfQueue.PurgeReady()
+	selfQueue.StartConsuming(10, time.Millisecond)
+	added := make(chan struct{})
+	var self *ConsumerHandle
+	self = selfQueue.AddConsumerWithHandle("handle-self", ConsumerFunc(func(delivery Delivery) {
+		<-added
+		delivery.Ack()
+		self.Stop()
+	}))
+	close(added)
+	c.Check(selfQueue.Publish("handle-self-d1"), Equals, true)
+	waited := make(chan struct{})
+	go func() {
+		self.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		c.Fatal("consumer didn't stop itself")
+	}
+	c.Check(selfQueue.GetConsumers(), HasLen, 0)
+
+	selfQueue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestMaxDelayed(c *C) {
+	connection := OpenConnection("max-delayed-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("max-delayed-q", WithMaxDelayed(2)).(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+	queue.SetRetryPolicy(RetryPolicy{Backoff: func(int) time.Duration { return time.Hour }})
+
+	at := time.Now().Add(time.Hour)
+	c.Check(queue.PublishOnDelayE("max-delayed-d1", at), IsNil)
+	_, err := queue.PublishBatchOnDelay([]DelayedItem{
+		{Payload: "max-delayed-d2", At: at},
+		{Payload: "max-delayed-d3", At: at},
+	})
+	c.Check(err, Equals, ErrDelayedFull)
+	c.Check(queue.PublishOnDelay("max-delayed-d2", at), Equals, true)
+	c.Check(queue.PublishOnDelayE("max-delayed-d3", at), Equals, ErrDelayedFull)
+	c.Check(queue.PublishOnDelay("max-delayed-d3", at), Equals, false)
+	c.Check(queue.DelayedCount(), Equals, 2)
+
+	// retries keep the delivery unacked while the delayed set is full
+	c.Check(queue.Publish("max-delayed-d4"), Equals, true)
+	delivery, err := queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Retry(), Equals, ErrDelayedFull)
+	c.Check(queue.UnackedCount(), Equals, 1)
+	c.Check(delivery.Ack(), Equals, true)
+
+	queue.PurgeDelayed()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestCopyReady(c *C) {
+	connection := OpenConnection("copy-conn", "tcp", "localhost:6379", 1)
+	src := connection.OpenQueue("copy-src").(*redisQueue)
+	dst := connection.OpenQueue("copy-dst").(*redisQueue)
+	src.PurgeReady()
+	dst.PurgeReady()
+
+	c.Check(src.PublishBatch([]string{"copy-d1", "copy-d2", "copy-d3"}), IsNil)
+	copied, err := connection.CopyReady("copy-src", dst, 2)
+	c.Check(err, IsNil)
+	c.Check(copied, Equals, 2)
+	c.Check(src.ReadyCount(), Equals, 3)
+	c.Check(dst.ReadyCount(), Equals, 2)
+
+	for _, payload := range []string{"copy-d1", "copy-d2"} {
+		delivery, err := dst.Pull(context.Background())
+		c.Assert(err, IsNil)
+		c.Check(delivery.Payload(), Equals, payload)
+		delivery.Ack()
+	}
+
+	copied, err = connection.CopyReady("copy-src", NewTestQueue("copy-test"), 10)
+	c.Check(err, IsNil)
+	c.Check(copied, Equals, 3)
+
+	src.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDistributedRateLimit(c *C) {
+	connection := OpenConnection("rate-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("rate-q", WithDistributedRateLimit(10, 5)).(*redisQueue)
+	other := connection.OpenQueue("rate-q", WithDistributedRateLimit(10, 5)).(*redisQueue)
+	queue.redisClient.Del(context.Background(), queue.rateKey)
+
+	// both queues share the bucket holding 5 tokens
+	c.Check(queue.takeTokens(3), Equals, 3)
+	c.Check(other.takeTokens(3), Equals, 2)
+	c.Check(queue.takeTokens(3), Equals, 0)
+
+	// it refills with 10 tokens per second
+	time.Sleep(220 * time.Millisecond)
+	c.Check(other.takeTokens(5), Equals, 2)
+
+	unlimited := connection.OpenQueue("rate-q").(*redisQueue)
+	c.Check(unlimited.takeTokens(3), Equals, 3)
+
+	queue.redisClient.Del(context.Background(), queue.rateKey)
+	connection.StopHeartbeat()
+}
+
+type countingExecutor struct {
+	submitted int32
+}
+
+func (executor *countingExecutor) Submit(task func()) {
+	atomic.AddInt32(&executor.submitted, 1)
+	go task()
+}
+
+func (suite *QueueSuite) TestExecutor(c *C) {
+	executor := &countingExecutor{}
+	connection := OpenConnection("executor-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("executor-q", WithExecutor(executor)).(*redisQueue)
+	queue.PurgeReady()
+
+	consumer := NewTestConsumer("executor-cons")
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("executor-cons", consumer)
+	queue.AddBatchConsumer("executor-batch", 2, NewTestBatchConsumer())
+	c.Check(atomic.LoadInt32(&executor.submitted), Equals, int32(2))
+
+	c.Check(queue.Publish("executor-d1"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.ReadyCount(), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestTrimReady(c *C) {
+	connection := OpenConnection("trim-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("trim-q").(*redisQueue)
+	queue.PurgeReady()
+
+	c.Check(queue.PublishBatch([]string{"trim-d1", "trim-d2", "trim-d3", "trim-d4"}), IsNil)
+	dropped, err := queue.TrimReady(2)
+	c.Check(err, IsNil)
+	c.Check(dropped, Equals, 2)
+	c.Check(queue.ReadyCount(), Equals, 2)
+
+	// the newest deliveries are kept
+	delivery, err := queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(delivery.Payload(), Equals, "trim-d3")
+	delivery.Ack()
+
+	dropped, err = queue.TrimReady(5)
+	c.Check(err, IsNil)
+	c.Check(dropped, Equals, 0)
+	dropped, err = queue.TrimReady(0)
+	c.Check(err, IsNil)
+	c.Check(dropped, Equals, 1)
+	c.Check(queue.ReadyCount(), Equals, 0)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDispatcher(c *C) {
+	connection := OpenConnection("dispatch-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("dispatch-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	created := NewTestConsumer("dispatch-created")
+	deleted := NewTestConsumer("dispatch-deleted")
+	dispatcher := NewDispatcher("type")
+	dispatcher.Handle("created", created)
+	dispatcher.Handle("deleted", deleted)
+
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("dispatch-cons", dispatcher)
+	c.Check(queue.PublishWithHeaders("dispatch-d1", map[string]string{"type": "created"}), IsNil)
+	c.Check(queue.PublishWithHeaders("dispatch-d2", map[string]string{"type": "deleted"}), IsNil)
+	c.Check(queue.PublishWithHeaders("dispatch-d3", map[string]string{"type": "updated"}), IsNil)
+	c.Check(queue.Publish("dispatch-d4"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+
+	c.Assert(created.LastDeliveries, HasLen, 1)
+	c.Check(created.LastDelivery.Payload(), Equals, "dispatch-d1")
+	c.Check(created.LastDelivery.Headers(), DeepEquals, map[string]string{"type": "created"})
+	c.Assert(deleted.LastDeliveries, HasLen, 1)
+	c.Check(deleted.LastDelivery.Payload(), Equals, "dispatch-d2")
+	c.Check(queue.RejectedCount(), Equals, 2)
+
+	queue.StopConsuming()
+	queue.PurgeRejected()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestFlushAll(c *C) {
+	connection := OpenConnection("flush-all-conn", "tcp", "localhost:6379", 1)
+	queue1 := connection.OpenQueue("flush-all-q1").(*redisQueue)
+	queue2 := connection.OpenQueue("flush-all-q2").(*redisQueue)
+
+	c.Check(queue1.Publish("flush-all-d1"), Equals, true)
+	c.Check(queue1.AppendRejected("flush-all-d2"), IsNil)
+	c.Check(queue2.PublishOnDelay("flush-all-d3", time.Now().Add(time.Hour)), Equals, true)
+
+	c.Check(connection.FlushAll(false), Equals, ErrNotConfirmed)
+	c.Check(queue1.ReadyCount(), Equals, 1)
+
+	c.Check(connection.FlushAll(true), IsNil)
+	c.Check(queue1.ReadyCount(), Equals, 0)
+	c.Check(queue1.RejectedCount(), Equals, 0)
+	c.Check(queue2.DelayedCount(), Equals, 0)
+
+	errs := QueueErrors{"b": errors.New("boom"), "a": errors.New("bang")}
+	c.Check(errs.Error(), Equals, "rmq: 2 queues failed: a: bang; b: boom")
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestLastActivity(c *C) {
+	connection := OpenConnection("activity-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("activity-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.redisClient.Del(context.Background(), queue.activityKey)
+
+	at, err := connection.LastActivity("activity-q")
+	c.Check(err, IsNil)
+	c.Check(at.IsZero(), Equals, true)
+
+	before := time.Now().Add(-time.Millisecond)
+	c.Check(queue.Publish("activity-d1"), Equals, true)
+	at, err = connection.LastActivity("activity-q")
+	c.Check(err, IsNil)
+	c.Check(at.After(before), Equals, true)
+	c.Check(at.Before(time.Now().Add(time.Millisecond)), Equals, true)
+
+	// stamped at most once per interval
+	c.Check(queue.Publish("activity-d2"), Equals, true)
+	again, err := connection.LastActivity("activity-q")
+	c.Check(err, IsNil)
+	c.Check(again, Equals, at)
+
+	// consuming stamps, polling an empty queue doesn't
+	forget := func() {
+		atomic.StoreInt64(&queue.lastActivity, 0)
+		queue.redisClient.Del(context.Background(), queue.activityKey)
+	}
+	forget()
+	consumer := NewTestConsumer("activity-cons")
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	queue.AddConsumer("activity-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	at, err = connection.LastActivity("activity-q")
+	c.Check(err, IsNil)
+	c.Check(at.IsZero(), Equals, false)
+
+	forget()
+	time.Sleep(20 * time.Millisecond)
+	at, err = connection.LastActivity("activity-q")
+	c.Check(err, IsNil)
+	c.Check(at.IsZero(), Equals, true)
+
+	queue.StopConsuming()
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
@@ -0,0 +1,104 @@
+package rmq
+
+import "time"
+
+// reconfigureRequest asks the consume loop of a queue to switch to a new
+// prefetch limit and poll duration, done gets closed once it did
+type reconfigureRequest struct {
+	prefetchLimit int
+	pollDuration  time.Duration
+	done          chan struct{}
+}
+
+// ReconfigureConsuming changes the prefetch limit and poll duration of a
+// consuming queue. The prefetched deliveries which weren't consumed yet are
+// returned to ready, the delivery channel gets replaced by one of the new size
+// and all consumers continue on it under their names. Consumers finish their
+// current delivery first, so none get lost. Returns ErrNotConsuming if the
+// queue isn't consuming and ErrInvalidPrefetchLimit if prefetchLimit < 0
+func (queue *redisQueue) ReconfigureConsuming(prefetchLimit int, pollDuration time.Duration) error {
+	if prefetchLimit < 0 {
+		return ErrInvalidPrefetchLimit
+	}
+
+	queue.attachMu.Lock()
+	consuming, consumeCtx := queue.deliveryChan != nil, queue.consumeCtx
+	queue.attachMu.Unlock()
+	if !consuming || consumeCtx.Err() != nil {
+		return ErrNotConsuming
+	}
+
+	request := reconfigureRequest{
+		prefetchLimit: prefetchLimit,
+		pollDuration:  pollDuration,
+		done:          make(chan struct{}),
+	}
+	select {
+	case queue.reconfigureChan <- request:
+		<-request.done
+		return nil
+	case <-consumeCtx.Done():
+		return ErrNotConsuming
+	}
+}
+
+// applyReconfigure applies a pending ReconfigureConsuming request, it must be
+// called by the consume loop so no delivery gets sent to the replaced channel
+func (queue *redisQueue) applyReconfigure() {
+	var request reconfigureRequest
+	select {
+	case request = <-queue.reconfigureChan:
+	default:
+		return
+	}
+	defer close(request.done)
+
+	queue.attachMu.Lock()
+	retired := queue.deliveryChan
+	queue.deliveryChan = make(chan Delivery, request.prefetchLimit)
+	queue.successors[retired] = queue.deliveryChan
+	queue.attachMu.Unlock()
+
+	queue.prefetchLimit = request.prefetchLimit
+	queue.pollDuration = request.pollDuration
+
+	for returning := true; returning; {
+		select {
+		case delivery := <-retired:
+			if err := requeue(delivery); err != nil {
+				queue.consumeFailed(err)
+			}
+		default:
+			returning = false
+		}
+	}
+	close(retired) // consumers continue on the new channel once they are done with it
+}
+
+// attach runs a consumer on the delivery channel. Once run returns because the
+// channel got replaced by ReconfigureConsuming, the same goroutine runs it again
+// on the new channel, so a consumer never runs twice at the same time. finish
+// gets called once run returned for good, it may be nil
+func (queue *redisQueue) attach(run func(deliveryChan chan Delivery), finish func()) {
+	queue.attachMu.Lock()
+	deliveryChan := queue.deliveryChan
+	queue.attachMu.Unlock()
+
+	queue.spawn(func() {
+		for deliveryChan != nil {
+			run(deliveryChan)
+			deliveryChan = queue.successor(deliveryChan)
+		}
+		if finish != nil {
+			finish()
+		}
+	})
+}
+
+// successor returns the channel which replaced the closed delivery channel, or
+// nil if it got closed because consuming stopped
+func (queue *redisQueue) successor(deliveryChan chan Delivery) chan Delivery {
+	queue.attachMu.Lock()
+	defer queue.attachMu.Unlock()
+	return queue.successors[deliveryChan]
+}
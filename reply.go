@@ -0,0 +1,83 @@
+package rmq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/adjust/uniuri"
+)
+
+const (
+	// CorrelationIDHeader is the header which ties a reply to its request
+	CorrelationIDHeader = "rmq-correlation-id"
+	// ReplyToHeader is the header which holds the name of the queue a request
+	// expects its reply on
+	ReplyToHeader = "rmq-reply-to"
+
+	correlationIDLength = 16
+	replyPollInterval   = 10 * time.Millisecond // pause after finding no reply or one for another request
+)
+
+// Reply publishes payload to replyQueue as reply to the request delivery, with
+// the correlation id of the request, see PublishAndAwaitReply
+func Reply(request Delivery, replyQueue Queue, payload string) error {
+	return replyQueue.PublishWithHeaders(payload, map[string]string{
+		CorrelationIDHeader: request.Headers()[CorrelationIDHeader],
+	})
+}
+
+// publishAndAwaitReply publishes payload to queue with a new correlation id and
+// pulls replyQueue until the reply with that id arrives. Replies to other
+// requests get returned to replyQueue for the requests waiting for them, this
+// doesn't count towards WithMaxRequeues of replyQueue. The pulls don't block:
+// Redis rounds a blocking pop with a timeout below a second up to a second,
+// which could move a reply to unacked after the pull gave up on it
+func publishAndAwaitReply(ctx context.Context, queue Queue, payload string, replyQueue Queue, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	correlationID := uniuri.NewLen(correlationIDLength)
+	if err := queue.PublishWithHeaders(payload, map[string]string{
+		CorrelationIDHeader: correlationID,
+		ReplyToHeader:       queueName(replyQueue),
+	}); err != nil {
+		return "", err
+	}
+
+	for {
+		reply, err := replyQueue.Pull(context.Background())
+		switch {
+		case err == ErrNoDelivery:
+		case err != nil:
+			return "", err
+		case reply.Headers()[CorrelationIDHeader] == correlationID:
+			reply.Ack()
+			return reply.Payload(), nil
+		default:
+			if err := requeue(reply); err != nil {
+				return "", err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.Canceled {
+				return "", ctx.Err()
+			}
+			return "", ErrNoReply
+		case <-time.After(replyPollInterval):
+		}
+	}
+}
+
+// queueName returns the name of the queue as used by OpenQueue
+func queueName(queue Queue) string {
+	switch queue := queue.(type) {
+	case *redisQueue:
+		return queue.name
+	case *streamQueue:
+		return queue.name
+	}
+	return fmt.Sprint(queue)
+}
@@ -0,0 +1,43 @@
+package rmq
+
+import (
+	"context"
+	"strconv"
+)
+
+// requeueReason is the reason deliveries which were nacked too often get
+// rejected with
+const requeueReason = "rmq: too many requeues"
+
+// requeueLimit limits how often a delivery can be nacked, see WithMaxRequeues
+type requeueLimit struct {
+	max        int
+	onExceeded func(delivery Delivery) // nil if not set
+}
+
+// nackLimited is Nack for queues opened WithMaxRequeues. The release script
+// counts the requeue together with releasing the delivery, so only deliveries
+// which were unacked count. A delivery which was requeued more often than
+// allowed stays unacked and gets rejected with requeueReason instead
+func (delivery *wrapDelivery) nackLimited() bool {
+	result := releaseScript.Run(context.Background(), delivery.redisClient,
+		[]string{delivery.unackedKey, delivery.leasesKey, delivery.readyKey, delivery.attemptsKey},
+		delivery.payload,
+		delivery.leaseMember(),
+		delivery.payload,
+		strconv.Itoa(delivery.requeueLimit.max),
+	)
+	if err := result.Err(); err != nil {
+		delivery.redisFailed(err)
+		return false
+	}
+
+	if result.Val() != int64(2) {
+		delivery.settle()
+		return result.Val() == int64(1)
+	}
+	if delivery.requeueLimit.onExceeded != nil {
+		delivery.requeueLimit.onExceeded(delivery)
+	}
+	return delivery.RejectWithReason(requeueReason)
+}
@@ -0,0 +1,66 @@
+package rmq
+
+import "context"
+
+// Reservation is a delivery reserved by Reserve. Its token has to be passed to
+// Commit or Rollback to settle it
+type Reservation struct {
+	Payload string
+	Token   string
+}
+
+// Reserve pulls a delivery like Pull and returns it as reservation, for
+// consumers which write deliveries to an external store exactly once: write
+// the payload, and only if that succeeded Commit the token, otherwise Rollback.
+// The reservation is backed by the lease of the delivery, so the queue must be
+// opened WithLeases, otherwise ErrNotLeased is returned
+func (queue *redisQueue) Reserve(ctx context.Context) (Reservation, error) {
+	if queue.leaseDuration == 0 {
+		return Reservation{}, ErrNotLeased
+	}
+
+	delivery, err := queue.Pull(ctx)
+	if err != nil {
+		return Reservation{}, err
+	}
+	reserved := delivery.(*wrapDelivery)
+	return Reservation{Payload: reserved.Payload(), Token: reserved.leaseMember()}, nil
+}
+
+// Commit removes the reserved delivery from unacked. The token is checked
+// against the lease in redis in the same step, so it returns ErrNotUnacked
+// if the lease expired and the delivery got returned by ReturnExpiredLeases,
+// in which case it can be reserved and committed again by someone else
+func (queue *redisQueue) Commit(token string) error {
+	delivery, err := queue.reserved(token)
+	if err != nil {
+		return err
+	}
+	if !delivery.ack() {
+		return ErrNotUnacked
+	}
+	delivery.forgetAttempts()
+	return nil
+}
+
+// Rollback returns the reserved delivery to the tail of the ready list, like
+// Nack. Returns ErrNotUnacked if the lease was lost already
+func (queue *redisQueue) Rollback(token string) error {
+	delivery, err := queue.reserved(token)
+	if err != nil {
+		return err
+	}
+	if !delivery.release(queue.readyKey) {
+		return ErrNotUnacked
+	}
+	return nil
+}
+
+// reserved returns the delivery of a reservation token, which is the member
+// of its lease in the leases set
+func (queue *redisQueue) reserved(token string) (*wrapDelivery, error) {
+	if len(token) <= leaseTokenLength || token[leaseTokenLength] != ':' {
+		return nil, ErrInvalidReservation
+	}
+	return newDelivery(token[leaseTokenLength+1:], token[:leaseTokenLength], queue), nil
+}
@@ -0,0 +1,84 @@
+package rmq
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RetryPolicy defines how deliveries of a queue get retried with Delivery.Retry
+type RetryPolicy struct {
+	// MaxAttempts is the number of retries a delivery gets, zero means unlimited
+	MaxAttempts int
+	// Backoff returns how long to delay the given attempt, starting at 1
+	Backoff func(attempt int) time.Duration
+	// OnExhausted gets called instead of retrying once a delivery used up all
+	// its attempts, the delivery gets rejected if it's nil
+	OnExhausted func(delivery Delivery)
+}
+
+// Retry moves the delivery to the delayed set of its queue, so it gets
+// consumed again after the backoff of the retry policy of the queue. Once the
+// delivery was retried MaxAttempts times it gets passed to OnExhausted instead.
+// Returns ErrNoRetryPolicy if the queue has no retry policy, ErrNotUnacked if
+// the delivery wasn't unacked anymore and ErrDelayedFull if the delayed set of
+// the queue is full, the delivery stays unacked then
+func (delivery *wrapDelivery) Retry() error {
+	policy := delivery.retryPolicy
+	if policy == nil {
+		return ErrNoRetryPolicy
+	}
+
+	ctx := context.Background()
+	attempts, err := delivery.redisClient.HGet(ctx, delivery.attemptsKey, delivery.payload).Int()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	attempt := attempts + 1
+	if policy.MaxAttempts > 0 && attempt > policy.MaxAttempts {
+		if err := delivery.redisClient.HDel(ctx, delivery.attemptsKey, delivery.payload).Err(); err != nil {
+			return err
+		}
+		if policy.OnExhausted == nil {
+			delivery.Reject()
+			return nil
+		}
+		policy.OnExhausted(delivery)
+		return nil
+	}
+
+	var backoff time.Duration
+	if policy.Backoff != nil {
+		backoff = policy.Backoff(attempt)
+	}
+
+	retried, err := retryScript.Run(ctx, delivery.redisClient,
+		[]string{delivery.unackedKey, delivery.leasesKey, delivery.delayedKey, delivery.attemptsKey},
+		delivery.payload,
+		delivery.leaseMember(),
+		delayedScore(delivery.clock.Now().Add(backoff)),
+		delivery.maxDelayed,
+	).Int()
+	if err != nil {
+		return err
+	}
+	if retried < 0 {
+		return ErrDelayedFull
+	}
+	if retried == 0 {
+		return ErrNotUnacked
+	}
+
+	delivery.settle()
+	return nil
+}
+
+// forgetAttempts removes the retry attempts and requeues of the delivery once
+// it got acked
+func (delivery *wrapDelivery) forgetAttempts() {
+	if delivery.retryPolicy != nil || delivery.requeueLimit != nil {
+		delivery.redisClient.HDel(context.Background(), delivery.attemptsKey, delivery.payload)
+	}
+}
@@ -0,0 +1,429 @@
+package rmq
+
+import "github.com/go-redis/redis/v8"
+
+// unstampRejectedLua defines the Lua function unstamp, which drops the oldest
+// rejection time of the payload from the sorted set key and its reason from the
+// hash reasonsKey. Its members consist of a token of the given length, a colon
+// and the payload. Returned deliveries are usually the oldest rejected ones, so
+// it only goes through a few members
+const unstampRejectedLua = `local function unstamp(key, reasonsKey, payload, tokenLength)
+		local start = 0
+		while true do
+			local members = redis.call('zrange', key, start, start + 99)
+			if #members == 0 then
+				return
+			end
+			for _, member in ipairs(members) do
+				if string.sub(member, tokenLength + 2) == payload then
+					redis.call('zrem', key, member)
+					redis.call('hdel', reasonsKey, member)
+					return
+				end
+			end
+			start = start + 100
+		end
+	end
+	`
+
+// Lua scripts are loaded once and run via EVALSHA afterwards
+var (
+	// addDelayedScript adds the score and member pairs ARGV[2..] to the delayed
+	// set KEYS[1] unless that would grow it beyond ARGV[1], returns -1 then
+	addDelayedScript = redis.NewScript(`if redis.call('zcard', KEYS[1]) + (#ARGV - 1) / 2 > tonumber(ARGV[1]) then
+		return -1
+	end
+
+	return redis.call('zadd', KEYS[1], unpack(ARGV, 2))`)
+
+	// delayWithModeScript sets the score of member ARGV[4] in the delayed set
+	// KEYS[1] to ARGV[3] following the ZADD flag ARGV[2], which is compared in
+	// Lua so it works on Redis versions without GT and LT. Returns 1 if the
+	// member was added or updated, 0 if the flag prevented it and -1 if adding
+	// would grow the set beyond ARGV[1] (0 means unlimited)
+	delayWithModeScript = redis.NewScript(`local current = redis.call('zscore', KEYS[1], ARGV[4])
+	local score = tonumber(ARGV[3])
+	if current then
+		current = tonumber(current)
+		if ARGV[2] == 'NX' or ARGV[2] == 'GT' and score <= current or ARGV[2] == 'LT' and score >= current then
+			return 0
+		end
+	else
+		if ARGV[2] == 'XX' then
+			return 0
+		end
+		local max = tonumber(ARGV[1])
+		if max > 0 and redis.call('zcard', KEYS[1]) >= max then
+			return -1
+		end
+	end
+
+	redis.call('zadd', KEYS[1], ARGV[3], ARGV[4])
+	return 1`)
+
+	// takeTokensScript takes up to ARGV[4] tokens from the token bucket KEYS[1],
+	// which refills with ARGV[1] tokens per second up to ARGV[2] tokens, and
+	// returns the number of taken tokens. ARGV[3] is the current time in ms
+	takeTokensScript = redis.NewScript(`local rate = tonumber(ARGV[1])
+	local burst = tonumber(ARGV[2])
+	local now = tonumber(ARGV[3])
+
+	local bucket = redis.call('hmget', KEYS[1], 'tokens', 'ts')
+	local tokens = tonumber(bucket[1]) or burst
+	local ts = tonumber(bucket[2]) or now
+	if now > ts then
+		tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+		ts = now
+	end
+
+	local taken = math.min(tonumber(ARGV[4]), math.floor(tokens))
+	redis.call('hmset', KEYS[1], 'tokens', tokens - taken, 'ts', ts)
+	redis.call('pexpire', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+	return taken`)
+
+	// releaseScript removes a delivery from unacked, checking its lease if it has
+	// one, and pushes it to KEYS[3] if given, replaced by ARGV[3] if given. If
+	// the hash of requeues KEYS[4] is given, the release counts as a requeue.
+	// A delivery requeued more than ARGV[4] times stays unacked and its count
+	// gets reset, 2 is returned then
+	releaseScript = redis.NewScript(`-- Only release the delivery if its lease is still held
+	if ARGV[2] ~= '' and not redis.call('zscore', KEYS[2], ARGV[2]) then
+		return 0
+	end
+
+	-- Only move the delivery if it was still unacked
+	if redis.call('lrem', KEYS[1], 1, ARGV[1]) == 0 then
+		if ARGV[2] ~= '' then
+			redis.call('zrem', KEYS[2], ARGV[2])
+		end
+		return 0
+	end
+
+	if KEYS[4] and redis.call('hincrby', KEYS[4], ARGV[1], 1) > tonumber(ARGV[4]) then
+		redis.call('hdel', KEYS[4], ARGV[1])
+		redis.call('lpush', KEYS[1], ARGV[1])
+		return 2
+	end
+
+	if ARGV[2] ~= '' then
+		redis.call('zrem', KEYS[2], ARGV[2])
+	end
+	if KEYS[3] then
+		redis.call('lpush', KEYS[3], ARGV[3] or ARGV[1])
+	end
+	return 1`)
+
+	// closeEmptyScript removes a queue from the set of queues if it is empty
+	closeEmptyScript = redis.NewScript(`if redis.call('llen', KEYS[1]) > 0 or redis.call('llen', KEYS[2]) > 0 then
+		return -1
+	end
+
+	return redis.call('srem', KEYS[3], ARGV[1])`)
+
+	// migrateScript moves all delayed deliveries which are due to the front of
+	// the ready list, or to its end if ARGV[3] is 'end'
+	migrateScript = redis.NewScript(`-- Get all of the jobs with an expired "score", at most ARGV[4] if given...
+	local val
+	if ARGV[4] then
+		val = redis.call('zrangebyscore', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[4])
+	else
+		val = redis.call('zrangebyscore', KEYS[1], '-inf', ARGV[1])
+	end
+
+	-- If we have values in the array, we will remove them from the first queue
+	-- and add them onto the destination queue in chunks of ARGV[2], which moves
+	-- all of the appropriate jobs onto the destination queue very safely.
+	-- They are pushed to the right, which is the front of the ready list, the
+	-- last due first, or to the left, the end, the first due first. Either way
+	-- they get consumed in the order they were due.
+	if(next(val) ~= nil) then
+		redis.call('zremrangebyrank', KEYS[1], 0, #val - 1)
+
+		local chunk = tonumber(ARGV[2])
+		if ARGV[3] == 'end' then
+			for i = 1, #val, chunk do
+				redis.call('lpush', KEYS[2], unpack(val, i, math.min(i+chunk-1, #val)))
+			end
+			return val
+		end
+		for i = #val, 1, -chunk do
+			local reversed = {}
+			for j = i, math.max(i-chunk+1, 1), -1 do
+				table.insert(reversed, val[j])
+			end
+			redis.call('rpush', KEYS[2], unpack(reversed))
+		end
+	end
+
+	return val`)
+
+	// consumeLeasedScript moves a delivery from ready to unacked and leases it
+	consumeLeasedScript = redis.NewScript(`local payload = redis.call('rpoplpush', KEYS[1], KEYS[2])
+	if not payload then
+		return false
+	end
+
+	redis.call('zadd', KEYS[3], ARGV[1], ARGV[2] .. ':' .. payload)
+	return payload`)
+
+	// publishCappedScript pushes ARGV[2] to the ready list KEYS[1] unless it
+	// holds ARGV[1] or more deliveries already (zero means unlimited), returns 1
+	// if it got pushed
+	publishCappedScript = redis.NewScript(`local max = tonumber(ARGV[1])
+	if max > 0 and redis.call('llen', KEYS[1]) >= max then
+		return 0
+	end
+
+	redis.call('lpush', KEYS[1], ARGV[2])
+	return 1`)
+
+	// findByIndexScript returns the members of the index set KEYS[1] which are
+	// in the ready list KEYS[2] or the delayed set KEYS[3] and removes the others
+	findByIndexScript = redis.NewScript(`local found = {}
+	for _, member in ipairs(redis.call('smembers', KEYS[1])) do
+		if redis.call('zscore', KEYS[3], member) or redis.call('lpos', KEYS[2], member) then
+			table.insert(found, member)
+		else
+			redis.call('srem', KEYS[1], member)
+		end
+	end
+	return found`)
+
+	// pullBatchScript moves up to ARGV[1] deliveries from ready to unacked and
+	// returns them. If ARGV[2] isn't empty each one gets leased until that score
+	// with the token ARGV[2+i]
+	pullBatchScript = redis.NewScript(`local payloads = {}
+	for i = 1, tonumber(ARGV[1]) do
+		local payload = redis.call('rpoplpush', KEYS[1], KEYS[2])
+		if not payload then
+			break
+		end
+		if ARGV[2] ~= '' then
+			redis.call('zadd', KEYS[3], ARGV[2], ARGV[2 + i] .. ':' .. payload)
+		end
+		payloads[i] = payload
+	end
+	return payloads`)
+
+	// extendLeaseScript updates the expiry of the lease ARGV[2] if it's still held
+	extendLeaseScript = redis.NewScript(`if not redis.call('zscore', KEYS[1], ARGV[2]) then
+		return 0
+	end
+
+	redis.call('zadd', KEYS[1], ARGV[1], ARGV[2])
+	return 1`)
+
+	// returnExpiredLeasesScript returns all unacked deliveries whose lease expired
+	returnExpiredLeasesScript = redis.NewScript(`local members = redis.call('zrangebyscore', KEYS[1], '-inf', ARGV[1])
+	local returned = 0
+
+	for _, member in ipairs(members) do
+		redis.call('zrem', KEYS[1], member)
+
+		-- members consist of the lease token, a colon and the payload
+		local payload = string.sub(member, tonumber(ARGV[2]) + 2)
+		if redis.call('lrem', KEYS[2], 1, payload) == 1 then
+			redis.call('lpush', KEYS[3], payload)
+			returned = returned + 1
+		end
+	end
+
+	return returned`)
+
+	// returnUnackedScript moves all unacked deliveries KEYS[1] in chunks of
+	// ARGV[1] to the right of ready KEYS[2], which is the front, or to the left,
+	// the end, if ARGV[2] is 'end'. Either way they keep the order they were
+	// consumed in. Their leases KEYS[3] get dropped
+	returnUnackedScript = redis.NewScript(`local count = redis.call('llen', KEYS[1])
+	local chunk = tonumber(ARGV[1])
+
+	if ARGV[2] == 'end' then
+		-- The oldest unacked delivery is on the right, so pushing them from right
+		-- to left to the end of ready makes them get consumed in the same order
+		for stop = count - 1, 0, -chunk do
+			local val = redis.call('lrange', KEYS[1], math.max(stop - chunk + 1, 0), stop)
+			local reversed = {}
+			for i = #val, 1, -1 do
+				table.insert(reversed, val[i])
+			end
+			redis.call('lpush', KEYS[2], unpack(reversed))
+		end
+	else
+		-- Pushing them from left to right to the front of ready makes the oldest
+		-- one the first to be consumed again
+		for start = 0, count - 1, chunk do
+			redis.call('rpush', KEYS[2], unpack(redis.call('lrange', KEYS[1], start, start + chunk - 1)))
+		end
+	end
+	redis.call('del', KEYS[1], KEYS[3])
+
+	return count`)
+
+	// retryScript moves a delivery from unacked to the delayed set, checking its
+	// lease if it has one, and counts the attempt. Returns -1 if the delayed set
+	// holds ARGV[4] deliveries already
+	retryScript = redis.NewScript(`if tonumber(ARGV[4]) > 0 and redis.call('zcard', KEYS[3]) >= tonumber(ARGV[4]) then
+		return -1
+	end
+
+	if ARGV[2] ~= '' and redis.call('zrem', KEYS[2], ARGV[2]) == 0 then
+		return 0
+	end
+
+	if redis.call('lrem', KEYS[1], 1, ARGV[1]) == 0 then
+		return 0
+	end
+
+	redis.call('hincrby', KEYS[4], ARGV[1], 1)
+	redis.call('zadd', KEYS[3], ARGV[3], ARGV[1])
+	return 1`)
+
+	// streamSettleScript acks and deletes a stream delivery and pushes its
+	// payload to the list KEYS[2] or adds it to the stream KEYS[2] if given
+	streamSettleScript = redis.NewScript(`if redis.call('xack', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+		return 0
+	end
+	redis.call('xdel', KEYS[1], ARGV[2])
+
+	if KEYS[2] then
+		if ARGV[4] == 'stream' then
+			redis.call('xadd', KEYS[2], '*', 'p', ARGV[3])
+		else
+			redis.call('lpush', KEYS[2], ARGV[3])
+		end
+	end
+	return 1`)
+
+	// returnPendingScript moves all entries of the stream KEYS[1] pending on
+	// the consumer ARGV[2] of the group ARGV[1] to the end of the stream, in
+	// chunks of ARGV[3] entries, and returns how many it moved. The entries
+	// get new ids, so acking them under their old ids fails
+	returnPendingScript = redis.NewScript(`local returned = 0
+	while true do
+		local pending = redis.call('xpending', KEYS[1], ARGV[1], '-', '+', ARGV[3], ARGV[2])
+		if #pending == 0 then
+			break
+		end
+		for _, entry in ipairs(pending) do
+			local id = entry[1]
+			local entries = redis.call('xrange', KEYS[1], id, id)
+			redis.call('xack', KEYS[1], ARGV[1], id)
+			redis.call('xdel', KEYS[1], id)
+			if #entries > 0 then
+				redis.call('xadd', KEYS[1], '*', unpack(entries[1][2]))
+				returned = returned + 1
+			end
+		end
+	end
+	return returned`)
+
+	// returnRejectedDelayedScript moves up to ARGV[1] deliveries from the
+	// rejected list KEYS[1] to the delayed set KEYS[2] with score ARGV[2] and
+	// drops their rejection times from KEYS[3], whose members have a token of
+	// length ARGV[4], and their reasons from KEYS[4]. It stops early once the delayed set holds ARGV[3]
+	// deliveries (0 means unlimited). Deliveries whose payload is delayed
+	// already stay rejected in their place, as the delayed set would collapse
+	// them, and don't count as returned
+	returnRejectedDelayedScript = redis.NewScript(unstampRejectedLua + `local max = tonumber(ARGV[3])
+	local returned = 0
+	local skipped = {}
+
+	for i = 1, tonumber(ARGV[1]) do
+		if max > 0 and redis.call('zcard', KEYS[2]) >= max then
+			break
+		end
+		local payload = redis.call('rpop', KEYS[1])
+		if not payload then
+			break
+		end
+		if redis.call('zadd', KEYS[2], ARGV[2], payload) == 1 then
+			unstamp(KEYS[3], KEYS[4], payload, tonumber(ARGV[4]))
+			returned = returned + 1
+		else
+			table.insert(skipped, payload)
+		end
+	end
+
+	for i = #skipped, 1, -1 do
+		redis.call('rpush', KEYS[1], skipped[i])
+	end
+
+	return returned`)
+
+	// returnRejectedSinceScript moves the rejected deliveries of up to ARGV[3]
+	// of the rejection times scored above ARGV[1] in KEYS[1] from the rejected
+	// list KEYS[2] to the list or stream KEYS[3], depending on ARGV[2]. The
+	// members of KEYS[1] have a token of length ARGV[4], their reasons in KEYS[4]
+	// get dropped with them. Returns the number of
+	// returned deliveries and the number of rejection times it went through,
+	// which is less than ARGV[3] once there are no more
+	returnRejectedSinceScript = redis.NewScript(`local members = redis.call('zrangebyscore', KEYS[1], '(' .. ARGV[1], '+inf', 'limit', 0, ARGV[3])
+	local returned = 0
+
+	for _, member in ipairs(members) do
+		redis.call('zrem', KEYS[1], member)
+		redis.call('hdel', KEYS[4], member)
+		local payload = string.sub(member, tonumber(ARGV[4]) + 2)
+		if redis.call('lrem', KEYS[2], 1, payload) == 1 then
+			if ARGV[2] == 'stream' then
+				redis.call('xadd', KEYS[3], '*', 'p', payload)
+			else
+				redis.call('lpush', KEYS[3], payload)
+			end
+			returned = returned + 1
+		end
+	end
+
+	return {returned, #members}`)
+
+	// returnRejectedScript moves up to ARGV[1] of the oldest rejected deliveries
+	// from KEYS[1] to the end of the list or stream KEYS[2], depending on
+	// ARGV[2], and drops their rejection times from KEYS[3], whose members have
+	// a token of length ARGV[3], and their reasons from KEYS[4]
+	returnRejectedScript = redis.NewScript(unstampRejectedLua + `local returned = 0
+	for i = 1, tonumber(ARGV[1]) do
+		local payload = redis.call('rpop', KEYS[1])
+		if not payload then
+			break
+		end
+		if ARGV[2] == 'stream' then
+			redis.call('xadd', KEYS[2], '*', 'p', payload)
+		else
+			redis.call('lpush', KEYS[2], payload)
+		end
+		unstamp(KEYS[3], KEYS[4], payload, tonumber(ARGV[3]))
+		returned = returned + 1
+	end
+	return returned`)
+
+	// ackUnackedAtScript removes the delivery at index ARGV[1] from the unacked
+	// list KEYS[1] together with its lease in KEYS[2] and its retry attempts in
+	// KEYS[3], if its payload is ARGV[2]. Values wrapped in an envelope with the
+	// prefix ARGV[3] are compared by their payload. Lease members consist of a
+	// token of length ARGV[4], a colon and the value. Returns 0 if the delivery
+	// at the index has another payload or there is none
+	ackUnackedAtScript = redis.NewScript(`local value = redis.call('lindex', KEYS[1], ARGV[1])
+	if not value then
+		return 0
+	end
+	if value ~= ARGV[2] then
+		local prefix = ARGV[3]
+		if string.sub(value, 1, #prefix) ~= prefix then
+			return 0
+		end
+		local ok, decoded = pcall(cjson.decode, string.sub(value, #prefix + 1))
+		if not ok or type(decoded) ~= 'table' or decoded['p'] ~= ARGV[2] then
+			return 0
+		end
+	end
+
+	redis.call('lrem', KEYS[1], 1, value)
+	for _, member in ipairs(redis.call('zrange', KEYS[2], 0, -1)) do
+		if string.sub(member, tonumber(ARGV[4]) + 2) == value then
+			redis.call('zrem', KEYS[2], member)
+			break
+		end
+	end
+	redis.call('hdel', KEYS[3], value)
+	return 1`)
+)
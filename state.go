@@ -10,4 +10,6 @@ const (
 	Rejected
 	Pushed
 	Delayed
+	Nacked
+	Discarded
 )
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 type ConnectionStat struct {
@@ -21,9 +23,135 @@ func (stat ConnectionStat) String() string {
 
 type ConnectionStats map[string]ConnectionStat
 
+// ConsumerStat holds the counters of a single consumer
+type ConsumerStat struct {
+	Consumed int64 `json:"consumed"`
+	Acked    int64 `json:"acked"`
+	Rejected int64 `json:"rejected"`
+}
+
+func (stat ConsumerStat) String() string {
+	return fmt.Sprintf("[consumed:%d acked:%d rejected:%d]",
+		stat.Consumed,
+		stat.Acked,
+		stat.Rejected,
+	)
+}
+
+// PollStat counts how often the consume loop of a queue polled Redis and found
+// no deliveries (Empty) or at least one (Productive). A high share of empty
+// polls suggests increasing the poll duration
+type PollStat struct {
+	Empty      int64 `json:"empty"`
+	Productive int64 `json:"productive"`
+}
+
+func (stat PollStat) String() string {
+	return fmt.Sprintf("[empty:%d productive:%d]",
+		stat.Empty,
+		stat.Productive,
+	)
+}
+
+// batchSizeHistory is the number of batch sizes LastBatchSizes returns
+const batchSizeHistory = 32
+
+// pollCounters counts the polls of a queue and remembers the most recent batch
+// sizes, all methods are safe to call concurrently
+type pollCounters struct {
+	emptyCount      int64
+	productiveCount int64
+	batchSizes      []int // most recent last, at most batchSizeHistory
+	batchSizesMu    sync.Mutex
+}
+
+// polled counts a poll which found the given number of deliveries
+func (counters *pollCounters) polled(found int) {
+	if found == 0 {
+		atomic.AddInt64(&counters.emptyCount, 1)
+	} else {
+		atomic.AddInt64(&counters.productiveCount, 1)
+	}
+}
+
+// sized records the batch size the consume loop used for a poll
+func (counters *pollCounters) sized(batchSize int) {
+	counters.batchSizesMu.Lock()
+	defer counters.batchSizesMu.Unlock()
+
+	if len(counters.batchSizes) == batchSizeHistory {
+		counters.batchSizes = counters.batchSizes[1:]
+	}
+	counters.batchSizes = append(counters.batchSizes, batchSize)
+}
+
+// lastBatchSizes returns a copy of the recorded batch sizes, oldest first
+func (counters *pollCounters) lastBatchSizes() []int {
+	counters.batchSizesMu.Lock()
+	defer counters.batchSizesMu.Unlock()
+	return append([]int{}, counters.batchSizes...)
+}
+
+func (counters *pollCounters) stat() PollStat {
+	return PollStat{
+		Empty:      atomic.LoadInt64(&counters.emptyCount),
+		Productive: atomic.LoadInt64(&counters.productiveCount),
+	}
+}
+
+// consumerCounters counts the deliveries of a consumer, all methods are safe
+// to call on a nil counters
+type consumerCounters struct {
+	consumedCount int64
+	ackedCount    int64
+	rejectedCount int64
+	queueAcked    *int64 // acked count of the whole queue, see ConsumedCount
+}
+
+// consumed counts the delivery as consumed and makes acks and rejects of it
+// count towards these counters
+func (counters *consumerCounters) consumed(delivery Delivery) {
+	if counters == nil {
+		return
+	}
+	switch wrapped := delivery.(type) {
+	case *wrapDelivery:
+		wrapped.counters = counters
+	case *streamDelivery:
+		wrapped.counters = counters
+	}
+	atomic.AddInt64(&counters.consumedCount, 1)
+}
+
+func (counters *consumerCounters) acked() {
+	if counters == nil {
+		return
+	}
+	atomic.AddInt64(&counters.ackedCount, 1)
+	if counters.queueAcked != nil {
+		atomic.AddInt64(counters.queueAcked, 1)
+	}
+}
+
+func (counters *consumerCounters) rejected() {
+	if counters != nil {
+		atomic.AddInt64(&counters.rejectedCount, 1)
+	}
+}
+
+func (counters *consumerCounters) stat() ConsumerStat {
+	return ConsumerStat{
+		Consumed: atomic.LoadInt64(&counters.consumedCount),
+		Acked:    atomic.LoadInt64(&counters.ackedCount),
+		Rejected: atomic.LoadInt64(&counters.rejectedCount),
+	}
+}
+
 type QueueStat struct {
-	ReadyCount      int `json:"ready"`
-	RejectedCount   int `json:"rejected"`
+	ReadyCount      int      `json:"ready"`
+	RejectedCount   int      `json:"rejected"`
+	DelayedCount    int      `json:"delayed"`
+	Polls           PollStat `json:"polls"` // counted by this process, only set by Queue.Stats
 	connectionStats ConnectionStats
 }
 
@@ -36,9 +164,10 @@ func NewQueueStat(readyCount, rejectedCount int) QueueStat {
 }
 
 func (stat QueueStat) String() string {
-	return fmt.Sprintf("[ready:%d rejected:%d conn:%s",
+	return fmt.Sprintf("[ready:%d rejected:%d delayed:%d conn:%s",
 		stat.ReadyCount,
 		stat.RejectedCount,
+		stat.DelayedCount,
 		stat.connectionStats,
 	)
 }
@@ -81,7 +210,9 @@ func CollectStats(queueList []string, mainConnection *redisConnection) Stats {
 	stats := NewStats()
 	for _, queueName := range queueList {
 		queue := mainConnection.openQueue(queueName)
-		stats.QueueStats[queueName] = NewQueueStat(queue.ReadyCount(), queue.RejectedCount())
+		queueStat := NewQueueStat(queue.ReadyCount(), queue.RejectedCount())
+		queueStat.DelayedCount = queue.DelayedCount()
+		stats.QueueStats[queueName] = queueStat
 	}
 
 	connectionNames := mainConnection.GetConnections()
@@ -0,0 +1,121 @@
+package rmq
+
+import (
+	"sync"
+	"time"
+)
+
+// TimestampedStats is a stats snapshot of a queue taken at Time
+type TimestampedStats struct {
+	Time  time.Time `json:"time"`
+	Stats QueueStat `json:"stats"`
+}
+
+// statsHistory is a ring buffer of the most recent stats snapshots
+type statsHistory struct {
+	mutex  sync.Mutex
+	buffer []TimestampedStats
+	next   int // index the next snapshot gets written to
+	full   bool
+}
+
+func newStatsHistory(size int) *statsHistory {
+	return &statsHistory{
+		buffer: make([]TimestampedStats, size),
+	}
+}
+
+func (history *statsHistory) add(stats TimestampedStats) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	history.buffer[history.next] = stats
+	history.next = (history.next + 1) % len(history.buffer)
+	if history.next == 0 {
+		history.full = true
+	}
+}
+
+// snapshots returns a copy of the recorded snapshots, oldest first
+func (history *statsHistory) snapshots() []TimestampedStats {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	if !history.full {
+		return append([]TimestampedStats{}, history.buffer[:history.next]...)
+	}
+
+	snapshots := make([]TimestampedStats, 0, len(history.buffer))
+	snapshots = append(snapshots, history.buffer[history.next:]...)
+	return append(snapshots, history.buffer[:history.next]...)
+}
+
+// Watermark identifies which watermark a queue's ready count crossed
+type Watermark int
+
+const (
+	HighWatermark Watermark = iota // ready count rose above the high watermark
+	LowWatermark                   // ready count fell below the low watermark
+)
+
+// watermarks tracks a ready count crossing the high and low watermarks. After
+// crossing the high watermark only crossing the low one fires and vice versa
+type watermarks struct {
+	high     int
+	low      int
+	callback func(queue string, count int, crossed Watermark)
+	above    bool // crossed high and didn't cross low since
+}
+
+func (watermarks *watermarks) observe(queue string, count int) {
+	switch {
+	case !watermarks.above && count > watermarks.high:
+		watermarks.above = true
+		watermarks.callback(queue, count, HighWatermark)
+	case watermarks.above && count < watermarks.low:
+		watermarks.above = false
+		watermarks.callback(queue, count, LowWatermark)
+	}
+}
+
+// drainedObservations is the number of consecutive polls a queue must be
+// observed empty to count as drained, so a momentary gap between two batches
+// doesn't count
+const drainedObservations = 2
+
+// drainedWatch calls callback once the observed count drops to zero after
+// having been above zero
+type drainedWatch struct {
+	callback func()
+	busy     bool // observed above zero and didn't fire since
+	empty    int  // number of consecutive zero observations
+}
+
+// consumed marks the queue as busy because a delivery was consumed, even if
+// the delivery gets settled before the next observation. Safe to call on a nil
+// watch
+func (watch *drainedWatch) consumed() {
+	if watch == nil {
+		return
+	}
+	watch.busy = true
+	watch.empty = 0
+}
+
+func (watch *drainedWatch) observe(count int) {
+	if count > 0 {
+		watch.busy = true
+		watch.empty = 0
+		return
+	}
+	if !watch.busy {
+		return
+	}
+
+	watch.empty++
+	if watch.empty >= drainedObservations {
+		watch.busy = false
+		watch.empty = 0
+		watch.callback()
+	}
+}
@@ -1,6 +1,7 @@
 package rmq
 
 import (
+	"sort"
 	"testing"
 	"time"
 
@@ -63,3 +64,324 @@ func (suite *StatsSuite) TestStats(c *C) {
 	conn1.StopHeartbeat()
 	conn2.StopHeartbeat()
 }
+
+func (suite *StatsSuite) TestStatsHistory(c *C) {
+	connection := OpenConnection("history-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("history-q", WithStatsHistory(3, time.Millisecond)).(*redisQueue)
+	queue.PurgeReady()
+	c.Check(queue.StatsHistory(), HasLen, 0)
+
+	queue.Publish("history-d1")
+	stat, err := queue.Stats()
+	c.Assert(err, IsNil)
+	c.Check(stat.ReadyCount, Equals, 1)
+	c.Check(stat.UnackedCount(), Equals, 0)
+
+	queue.StartConsuming(10, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	queue.StopConsuming()
+
+	history := queue.StatsHistory()
+	c.Assert(history, HasLen, 3)
+	c.Check(history[0].Time.Before(history[1].Time), Equals, true)
+	c.Check(history[1].Time.Before(history[2].Time), Equals, true)
+	c.Check(history[2].Stats.UnackedCount(), Equals, 1)
+
+	c.Check(connection.OpenQueue("history-q2").StatsHistory(), IsNil)
+	connection.StopHeartbeat()
+}
+
+func (suite *StatsSuite) TestStatsHistoryRing(c *C) {
+	history := newStatsHistory(2)
+	start := time.Unix(1000, 0)
+	history.add(TimestampedStats{Time: start})
+	c.Check(history.snapshots(), HasLen, 1)
+	history.add(TimestampedStats{Time: start.Add(time.Second)})
+	history.add(TimestampedStats{Time: start.Add(2 * time.Second)})
+
+	snapshots := history.snapshots()
+	c.Assert(snapshots, HasLen, 2)
+	c.Check(snapshots[0].Time, Equals, start.Add(time.Second))
+	c.Check(snapshots[1].Time, Equals, start.Add(2*time.Second))
+}
+
+func (suite *StatsSuite) TestStatsMatching(c *C) {
+	connection := OpenConnection("matching-conn", "tcp", "localhost:6379", 1)
+	transactional := connection.OpenQueue("email.transactional").(*redisQueue)
+	marketing := connection.OpenQueue("email.marketing").(*redisQueue)
+	connection.OpenQueue("sms.marketing")
+	transactional.PurgeReady()
+	marketing.PurgeReady()
+	marketing.PurgeRejected()
+
+	transactional.Publish("matching-d1")
+	marketing.Publish("matching-d2")
+	marketing.Publish("matching-d3")
+	marketing.PublishRejected("matching-d4")
+
+	names, err := connection.QueuesMatching("email.*")
+	c.Check(err, IsNil)
+	sort.Strings(names)
+	c.Check(names, DeepEquals, []string{"email.marketing", "email.transactional"})
+
+	stats, err := connection.StatsMatching("email.*")
+	c.Check(err, IsNil)
+	c.Assert(stats, HasLen, 2)
+	c.Check(stats["email.transactional"].ReadyCount, Equals, 1)
+	c.Check(stats["email.marketing"].ReadyCount, Equals, 2)
+	c.Check(stats["email.marketing"].RejectedCount, Equals, 1)
+
+	stats, err = connection.StatsMatching("push.*")
+	c.Check(err, IsNil)
+	c.Check(stats, HasLen, 0)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *StatsSuite) TestCollectQueueStats(c *C) {
+	connection := OpenConnection("collect-queue-stats-conn", "tcp", "localhost:6379", 1)
+	first := connection.OpenQueue("collect-queue-stats-q1").(*redisQueue)
+	second := connection.OpenQueue("collect-queue-stats-q2").(*redisQueue)
+	first.PurgeReady()
+	second.PurgeReady()
+	second.PurgeDelayed()
+
+	first.Publish("collect-queue-stats-d1")
+	second.Publish("collect-queue-stats-d2")
+	second.PublishOnDelay("collect-queue-stats-d3", time.Now().Add(time.Hour))
+
+	stats, err := connection.CollectQueueStats()
+	c.Check(err, IsNil)
+	c.Check(stats["collect-queue-stats-q1"].ReadyCount, Equals, 1)
+	c.Check(stats["collect-queue-stats-q2"].ReadyCount, Equals, 1)
+	c.Check(stats["collect-queue-stats-q2"].DelayedCount, Equals, 1)
+
+	second.PurgeDelayed()
+	connection.StopHeartbeat()
+}
+
+func (suite *StatsSuite) TestInspect(c *C) {
+	connection := OpenConnection("inspect-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("inspect-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	queue.Publish("inspect-d1")
+	queue.Publish("inspect-d2")
+
+	stats, err := connection.Inspect("inspect-q")
+	c.Check(err, IsNil)
+	c.Check(stats["inspect-q"].ReadyCount, Equals, 2)
+	c.Check(stats["inspect-q"].RejectedCount, Equals, 0)
+
+	// inspecting doesn't register unknown queues
+	stats, err = connection.Inspect("inspect-unknown-q")
+	c.Check(err, IsNil)
+	c.Check(stats, HasLen, 0)
+	exists, err := connection.QueueExists("inspect-unknown-q")
+	c.Check(err, IsNil)
+	c.Check(exists, Equals, false)
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *StatsSuite) TestWatermarks(c *C) {
+	var crossings []Watermark
+	watermarks := &watermarks{high: 10, low: 2, callback: func(queue string, count int, crossed Watermark) {
+		c.Check(queue, Equals, "q")
+		crossings = append(crossings, crossed)
+	}}
+
+	for _, count := range []int{0, 1, 5, 11, 12, 5, 2, 1, 0, 11} {
+		watermarks.observe("q", count)
+	}
+	c.Check(crossings, DeepEquals, []Watermark{HighWatermark, LowWatermark, HighWatermark})
+}
+
+func (suite *StatsSuite) TestConsumerStats(c *C) {
+	connection := OpenConnection("consumer-stats-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("consumer-stats-q")
+	queue.PurgeReady()
+
+	_, ok := queue.ConsumerStats("unknown")
+	c.Check(ok, Equals, false)
+
+	consumer := NewTestConsumer("consumer-stats-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	name := queue.AddConsumer("consumer-stats-cons", consumer)
+
+	stat, ok := queue.ConsumerStats(name)
+	c.Check(ok, Equals, true)
+	c.Check(stat, Equals, ConsumerStat{})
+
+	queue.Publish("consumer-stats-d1")
+	queue.Publish("consumer-stats-d2")
+	queue.Publish("consumer-stats-d3")
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 3)
+	c.Check(consumer.LastDeliveries[0].Ack(), Equals, true)
+	c.Check(consumer.LastDeliveries[1].Reject(), Equals, true)
+
+	stat, _ = queue.ConsumerStats(name)
+	c.Check(stat, Equals, ConsumerStat{Consumed: 3, Acked: 1, Rejected: 1})
+
+	queue.StopConsuming()
+	queue.PurgeRejected()
+	connection.StopHeartbeat()
+}
+
+func (suite *StatsSuite) TestConsumedCount(c *C) {
+	connection := OpenConnection("consumed-count-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("consumed-count-q")
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	consumer := NewTestConsumer("consumed-count-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("consumed-count-cons", consumer)
+	c.Check(queue.ConsumedCount(), Equals, int64(0))
+
+	queue.Publish("consumed-count-d1")
+	queue.Publish("consumed-count-d2")
+	queue.Publish("consumed-count-d3")
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 3)
+	c.Check(consumer.LastDeliveries[0].Ack(), Equals, true)
+	c.Check(consumer.LastDeliveries[1].Ack(), Equals, true)
+	c.Check(consumer.LastDeliveries[2].Reject(), Equals, true)
+	c.Check(queue.ConsumedCount(), Equals, int64(2))
+	queue.StopConsuming()
+
+	// auto acked deliveries count too
+	autoAcked := connection.OpenQueue("consumed-count-auto-q", WithAutoAck())
+	autoAcked.PurgeReady()
+	autoConsumer := NewTestConsumer("consumed-count-auto-cons")
+	autoConsumer.AutoAck = false
+	autoAcked.StartConsuming(10, time.Millisecond)
+	autoAcked.AddConsumer("consumed-count-auto-cons", autoConsumer)
+	autoAcked.Publish("consumed-count-d4")
+	autoAcked.Publish("consumed-count-d5")
+	time.Sleep(10 * time.Millisecond)
+	c.Check(autoConsumer.Deliveries(), HasLen, 2)
+	c.Check(autoAcked.ConsumedCount(), Equals, int64(2))
+
+	autoAcked.StopConsuming()
+	queue.PurgeRejected()
+	connection.StopHeartbeat()
+}
+
+func (suite *StatsSuite) TestPollStats(c *C) {
+	connection := OpenConnection("polls-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("polls-q").(*redisQueue)
+	queue.PurgeReady()
+
+	c.Check(queue.PollStats(), Equals, PollStat{})
+	queue.deliveryChan = make(chan Delivery, 10)
+	queue.prefetchLimit = 10
+
+	// the ready list is empty, consumeBatch doesn't even get called
+	c.Check(queue.pollBatchSize(time.Now()), Equals, 0)
+	c.Check(queue.PollStats(), Equals, PollStat{Empty: 1})
+
+	c.Check(queue.Publish("polls-d1"), Equals, true)
+	c.Check(queue.pollBatchSize(time.Now()), Equals, 1)
+	c.Check(queue.PollStats(), Equals, PollStat{Empty: 1})
+	c.Check(queue.consumeBatch(5), Equals, false)
+	c.Check(queue.consumeBatch(5), Equals, false)
+	c.Check(queue.PollStats(), Equals, PollStat{Empty: 2, Productive: 1})
+
+	stat, err := queue.Stats()
+	c.Check(err, IsNil)
+	c.Check(stat.Polls, Equals, PollStat{Empty: 2, Productive: 1})
+
+	(<-queue.deliveryChan).Ack()
+	connection.StopHeartbeat()
+}
+
+func (suite *StatsSuite) TestLastBatchSizes(c *C) {
+	counters := &pollCounters{}
+	c.Check(counters.lastBatchSizes(), HasLen, 0)
+	for i := 0; i < batchSizeHistory+2; i++ {
+		counters.sized(i)
+	}
+	sizes := counters.lastBatchSizes()
+	c.Assert(sizes, HasLen, batchSizeHistory)
+	c.Check(sizes[0], Equals, 2)
+	c.Check(sizes[batchSizeHistory-1], Equals, batchSizeHistory+1)
+
+	connection := OpenConnection("batch-sizes-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("batch-sizes-q").(*redisQueue)
+	queue.PurgeReady()
+	c.Check(queue.PublishBatch([]string{"batch-sizes-d1", "batch-sizes-d2", "batch-sizes-d3"}), IsNil)
+	c.Check(queue.StartConsuming(2, time.Millisecond), IsNil)
+	time.Sleep(20 * time.Millisecond)
+	sizes = queue.LastBatchSizes()
+	c.Assert(len(sizes) > 1, Equals, true)
+	c.Check(sizes[0], Equals, 2) // capped by the prefetch limit
+	c.Check(sizes[len(sizes)-1], Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *StatsSuite) TestDrainedWatch(c *C) {
+	fired := 0
+	watch := &drainedWatch{callback: func() { fired++ }}
+
+	// a queue which never had deliveries doesn't drain
+	watch.observe(0)
+	watch.observe(0)
+	c.Check(fired, Equals, 0)
+
+	// a single empty poll between batches doesn't count
+	watch.observe(3)
+	watch.observe(0)
+	watch.observe(2)
+	watch.observe(0)
+	c.Check(fired, Equals, 0)
+	watch.observe(0)
+	c.Check(fired, Equals, 1)
+
+	// fires once per drain
+	watch.observe(0)
+	watch.observe(0)
+	c.Check(fired, Equals, 1)
+	watch.observe(1)
+	watch.observe(0)
+	watch.observe(0)
+	c.Check(fired, Equals, 2)
+
+	// deliveries which got settled before the queue was observed count too
+	watch.consumed()
+	watch.observe(0)
+	watch.observe(0)
+	c.Check(fired, Equals, 3)
+
+	var unset *drainedWatch
+	unset.consumed()
+}
+
+func (suite *StatsSuite) TestOnDrained(c *C) {
+	connection := OpenConnection("drained-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("drained-q").(*redisQueue)
+	queue.PurgeReady()
+
+	drained := make(chan struct{}, 1)
+	queue.OnDrained(func() { drained <- struct{}{} })
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("drained-cons", NewTestConsumer("drained-cons"))
+	c.Check(queue.PublishBatch([]string{"drained-d1", "drained-d2"}), IsNil)
+
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		c.Error("queue didn't drain")
+	}
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
@@ -0,0 +1,925 @@
+package rmq
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	streamGroup        = "rmq" // consumer group all stream queues consume with
+	streamPayloadField = "p"   // field of stream entries holding the payload
+)
+
+// streamQueue is a queue backed by a Redis stream and a consumer group instead
+// of lists. Each connection consumes as its own consumer of the group, so
+// unacked deliveries are the pending entries of that consumer and don't need
+// the cleaner to be recovered, they get claimed by other connections once they
+// were idle for claimAfter (see WithStreams). Rejected deliveries still go to
+// the rejected list of the queue.
+//
+// Delayed deliveries, leases and retry policies are not supported by stream
+// queues, the corresponding methods return false or ErrNotSupported. Stream
+// queues can't be used as push queues and consumer stats only count consumed
+// deliveries. Methods which are not overridden here operate on the lists of
+// the queue
+type streamQueue struct {
+	*redisQueue
+	streamKey string
+}
+
+func newStreamQueue(queue *redisQueue) *streamQueue {
+	streamQueue := &streamQueue{
+		redisQueue: queue,
+		streamKey:  queue.keys.StreamKey(queue.name),
+	}
+
+	if err := streamQueue.createGroup(); err != nil {
+		log.Panicf("rmq queue failed to create consumer group %s %s", queue, err)
+	}
+	return streamQueue
+}
+
+// createGroup creates the stream and its consumer group unless they exist
+func (queue *streamQueue) createGroup() error {
+	err := queue.redisClient.XGroupCreateMkStream(context.Background(), queue.streamKey, streamGroup, "0").Err()
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+func (queue *streamQueue) String() string {
+	return fmt.Sprintf("[%s conn:%s stream]", queue.name, queue.connectionName)
+}
+
+// Publish adds a delivery with the given payload to the stream
+func (queue *streamQueue) Publish(payload string) bool {
+	if queue.isClosed() {
+		return false
+	}
+	queue.touch()
+	return !redisErrIsNil(queue.redisClient.XAdd(context.Background(), queue.addArgs(payload)))
+}
+
+// PublishE is like Publish, but returns an error instead of panicking
+func (queue *streamQueue) PublishE(payload string) error {
+	if queue.isClosed() {
+		return ErrQueueClosed
+	}
+	queue.touch()
+	return queue.redisClient.XAdd(context.Background(), queue.addArgs(payload)).Err()
+}
+
+// PublishN is not supported by stream queues and returns ErrNotSupported,
+// streams have no ready list
+func (queue *streamQueue) PublishN(payload string) (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (queue *streamQueue) PublishBytes(payload []byte) bool {
+	return queue.Publish(string(payload))
+}
+
+// PublishWithHeaders adds a delivery with the given payload and headers to
+// the stream, wrapped in an envelope
+func (queue *streamQueue) PublishWithHeaders(payload string, headers map[string]string) error {
+	if queue.isClosed() {
+		return ErrQueueClosed
+	}
+	queue.touch()
+	return queue.redisClient.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: queue.streamKey,
+		Values: map[string]interface{}{streamPayloadField: encodeEnvelopeWithHeaders(payload, headers)},
+	}).Err()
+}
+
+// PublishAndAwaitReply publishes a request to the stream and waits for the
+// reply on replyQueue, see redisQueue.PublishAndAwaitReply
+func (queue *streamQueue) PublishAndAwaitReply(ctx context.Context, payload string, replyQueue Queue, timeout time.Duration) (string, error) {
+	return publishAndAwaitReply(ctx, queue, payload, replyQueue, timeout)
+}
+
+// PublishBlocking is not supported by stream queues and returns ErrNotSupported
+func (queue *streamQueue) PublishBlocking(ctx context.Context, payload string) error {
+	return ErrNotSupported
+}
+
+// PublishIndexed is not supported by stream queues and returns ErrNotSupported
+func (queue *streamQueue) PublishIndexed(payload string, indexKeys map[string]string) error {
+	return ErrNotSupported
+}
+
+// FindByIndex is not supported by stream queues and returns ErrNotSupported
+func (queue *streamQueue) FindByIndex(key, value string) ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+// PublishOnDelay is not supported by stream queues and returns false
+func (queue *streamQueue) PublishOnDelay(payload string, delayedAt time.Time) bool {
+	return false
+}
+
+// PublishOnDelayE is not supported by stream queues and returns ErrNotSupported
+func (queue *streamQueue) PublishOnDelayE(payload string, delayedAt time.Time) error {
+	return ErrNotSupported
+}
+
+// PublishOnDelayWithMode is not supported by stream queues and returns ErrNotSupported
+func (queue *streamQueue) PublishOnDelayWithMode(payload string, delayedAt time.Time, mode DelayMode) (bool, error) {
+	return false, ErrNotSupported
+}
+
+// PublishBytesOnDelay is not supported by stream queues and returns false
+func (queue *streamQueue) PublishBytesOnDelay(payload []byte, delayedAt time.Time) bool {
+	return false
+}
+
+// PublishBatchOnDelay is not supported by stream queues and returns ErrNotSupported
+func (queue *streamQueue) PublishBatchOnDelay(items []DelayedItem) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// PublishBatch adds deliveries with the given payloads to the stream in a
+// single pipeline, they get consumed in the order of the slice
+func (queue *streamQueue) PublishBatch(payloads []string) error {
+	if queue.isClosed() {
+		return ErrQueueClosed
+	}
+	queue.touch()
+	if len(payloads) == 0 {
+		return nil
+	}
+
+	_, err := queue.redisClient.Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		for _, payload := range payloads {
+			queue.PublishPipe(pipe, payload)
+		}
+		return nil
+	})
+	return err
+}
+
+// PublishPipe queues the publish of a delivery with the given payload on the
+// given pipeline without executing it
+func (queue *streamQueue) PublishPipe(pipe redis.Pipeliner, payload string) {
+	pipe.XAdd(context.Background(), queue.addArgs(payload))
+}
+
+// PublishDurable adds a delivery with the given payload to the stream and
+// waits until the write got replicated, like redisQueue.PublishDurable
+func (queue *streamQueue) PublishDurable(ctx context.Context, payload string) error {
+	if queue.isClosed() {
+		return ErrQueueClosed
+	}
+	queue.touch()
+	return queue.publishDurable(ctx, func(pipe redis.Pipeliner) {
+		pipe.XAdd(ctx, queue.addArgs(payload))
+	})
+}
+
+func (queue *streamQueue) addArgs(payload string) *redis.XAddArgs {
+	return &redis.XAddArgs{
+		Stream: queue.streamKey,
+		Values: map[string]interface{}{streamPayloadField: queue.wrap(payload)},
+	}
+}
+
+// StartConsuming starts reading new entries of the stream as consumer of the
+// group into a channel of size prefetchLimit. Reads block for up to
+// pollDuration, returns ErrAlreadyConsuming if the queue is already consuming
+func (queue *streamQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) error {
+	if err := queue.prepareConsuming(prefetchLimit, pollDuration); err != nil {
+		return err
+	}
+	go queue.consume()
+	return nil
+}
+
+// prepareConsuming sets up everything StartConsuming needs except for running
+// the consume loop
+func (queue *streamQueue) prepareConsuming(prefetchLimit int, pollDuration time.Duration) error {
+	queue.attachMu.Lock()
+	defer queue.attachMu.Unlock()
+	if queue.deliveryChan != nil {
+		return ErrAlreadyConsuming
+	}
+
+	if err := queue.redisClient.SAdd(context.Background(), queue.queuesKey, queue.name).Err(); err != nil {
+		return err
+	}
+	if err := queue.createGroup(); err != nil {
+		return err
+	}
+
+	queue.prefetchLimit = prefetchLimit
+	queue.pollDuration = pollDuration
+	queue.deliveryChan = make(chan Delivery, prefetchLimit)
+	queue.consumeCtx, queue.consumeCancel = context.WithCancel(context.Background())
+	atomic.StoreInt64(&queue.consumedCount, 0)
+	queue.resetErrorBudget()
+	return nil
+}
+
+// ConsumeWithContext is like the one of list queues, but reads from the stream
+func (queue *streamQueue) ConsumeWithContext(ctx context.Context, prefetchLimit int, pollDuration time.Duration, consumer Consumer) error {
+	return queue.consumeWithContext(ctx, func() error {
+		return queue.prepareConsuming(prefetchLimit, pollDuration)
+	}, queue.consume, consumer)
+}
+
+func (queue *streamQueue) consume() {
+	for {
+		slots := queue.inFlight.tryAcquire(queue.prefetchLimit - len(queue.consumeChan()))
+		count := queue.takeTokens(slots)
+		queue.polls.sized(count)
+		delivered := 0
+		if count > 0 {
+			delivered = queue.claimIdle(count)
+			if delivered < count {
+				delivered += queue.read(context.Background(), count-delivered, queue.pollDuration)
+			}
+		} else {
+			time.Sleep(queue.pollDuration)
+		}
+		queue.inFlight.releaseN(slots - delivered)
+		if queue.drained != nil {
+			queue.drained.observe(queue.ReadyCount() + queue.UnackedCount())
+		}
+
+		if queue.spendErrorBudget() {
+			queue.stopConsume()
+			return
+		}
+		queue.applyReconfigure()
+		if queue.stopping() {
+			queue.stopConsume()
+			return
+		}
+	}
+}
+
+// read reads up to count new entries, blocking for up to block if there are
+// none, hands them to the consumers and returns how many it read
+func (queue *streamQueue) read(ctx context.Context, count int, block time.Duration) int {
+	messages, err := queue.readGroup(ctx, count, block)
+	if err != nil && err != redis.Nil {
+		queue.consumeFailed(err)
+	}
+
+	queue.polls.polled(len(messages))
+	for _, message := range messages {
+		queue.deliver(message)
+	}
+	return len(messages)
+}
+
+func (queue *streamQueue) readGroup(ctx context.Context, count int, block time.Duration) ([]redis.XMessage, error) {
+	switch {
+	case block <= 0:
+		block = -1 // don't block, zero would block forever
+	case block < time.Millisecond:
+		block = time.Millisecond // would be sent as zero too
+	}
+
+	streams, err := queue.redisClient.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    streamGroup,
+		Consumer: queue.connectionName,
+		Streams:  []string{queue.streamKey, ">"},
+		Count:    int64(count),
+		Block:    block,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(streams) == 0 {
+		return nil, redis.Nil
+	}
+	return streams[0].Messages, nil
+}
+
+// claimIdle claims up to count entries which were pending on any consumer for
+// at least claimAfter, hands them to the consumers and returns how many it
+// claimed
+func (queue *streamQueue) claimIdle(count int) int {
+	if queue.claimAfter <= 0 {
+		return 0
+	}
+
+	ctx := context.Background()
+	pending, err := queue.redisClient.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: queue.streamKey,
+		Group:  streamGroup,
+		Start:  "-",
+		End:    "+",
+		Count:  int64(count),
+	}).Result()
+	if err != nil {
+		return 0 // try again on the next iteration
+	}
+
+	ids := []string{}
+	for _, entry := range pending {
+		if entry.Idle >= queue.claimAfter {
+			ids = append(ids, entry.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return 0
+	}
+
+	messages, err := queue.redisClient.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   queue.streamKey,
+		Group:    streamGroup,
+		Consumer: queue.connectionName,
+		MinIdle:  queue.claimAfter,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		return 0
+	}
+
+	for _, message := range messages {
+		queue.deliver(message)
+	}
+	return len(messages)
+}
+
+func (queue *streamQueue) deliver(message redis.XMessage) {
+	queue.touch()
+	delivery := queue.newDelivery(message)
+	delivery.inFlight = queue.inFlight
+	delivery.loopFailed = queue.consumeFailed
+	queue.drained.consumed()
+	if queue.handlePoison(delivery.payload, delivery) {
+		return
+	}
+	if queue.payloadValidator != nil {
+		if err := queue.payloadValidator([]byte(delivery.Payload())); err != nil {
+			delivery.RejectWithReason(err.Error())
+			return
+		}
+	}
+
+	if queue.autoAck && delivery.Ack() {
+		atomic.AddInt64(&queue.consumedCount, 1) // no consumer counters yet to count the ack
+	}
+	delivery.loopFailed = nil
+	delivery.ctx = queue.consumeCtx
+	queue.consumeChan() <- delivery
+}
+
+// ConsumeN reads up to n new entries of the stream one at a time and hands
+// them to consumer, see redisQueue.ConsumeN
+func (queue *streamQueue) ConsumeN(ctx context.Context, n int, consumer Consumer) (int, error) {
+	return consumeN(ctx, queue, n, consumer)
+}
+
+// Pull reads a single new entry of the stream, blocking until the deadline of
+// ctx if it has one. Returns ErrNoDelivery if there was none
+func (queue *streamQueue) Pull(ctx context.Context) (Delivery, error) {
+	if err := queue.redisClient.SAdd(ctx, queue.queuesKey, queue.name).Err(); err != nil {
+		return nil, err
+	}
+
+	block := time.Duration(0)
+	if deadline, ok := ctx.Deadline(); ok {
+		block = time.Until(deadline)
+	}
+
+	messages, err := queue.readGroup(ctx, 1, block)
+	switch {
+	case err == redis.Nil || err == nil && len(messages) == 0:
+		return nil, ErrNoDelivery
+	case err != nil && ctx.Err() != nil:
+		return nil, ctx.Err()
+	case err != nil:
+		return nil, err
+	}
+	queue.touch()
+	return queue.newDelivery(messages[0]), nil
+}
+
+// PullBatch reads up to max new entries of the stream. If there are none it
+// blocks until one arrives or the deadline of ctx passes, without a deadline it
+// returns ErrNoDelivery right away
+func (queue *streamQueue) PullBatch(ctx context.Context, max int) ([]Delivery, error) {
+	if max <= 0 {
+		return nil, ErrNoDelivery
+	}
+	if err := queue.redisClient.SAdd(ctx, queue.queuesKey, queue.name).Err(); err != nil {
+		return nil, err
+	}
+
+	block := time.Duration(0)
+	if deadline, ok := ctx.Deadline(); ok {
+		block = time.Until(deadline)
+	}
+
+	messages, err := queue.readGroup(ctx, max, block)
+	switch {
+	case err == redis.Nil || err == nil && len(messages) == 0:
+		return nil, ErrNoDelivery
+	case err != nil && ctx.Err() != nil:
+		return nil, ctx.Err()
+	case err != nil:
+		return nil, err
+	}
+
+	queue.touch()
+	deliveries := make([]Delivery, 0, len(messages))
+	for _, message := range messages {
+		deliveries = append(deliveries, queue.newDelivery(message))
+	}
+	return deliveries, nil
+}
+
+// PurgeReady removes all entries from the stream, including the pending ones,
+// and returns the number of purged entries
+func (queue *streamQueue) PurgeReady() int {
+	result := queue.redisClient.XTrim(context.Background(), queue.streamKey, 0)
+	if redisErrIsNil(result) {
+		return 0
+	}
+	return int(result.Val())
+}
+
+// TrimReady drops all but the newest keep entries of the stream and returns
+// the number of dropped entries. Note that unlike for list queues this also
+// drops entries which are unacked
+func (queue *streamQueue) TrimReady(keep int) (int, error) {
+	if keep < 0 {
+		keep = 0
+	}
+	dropped, err := queue.redisClient.XTrim(context.Background(), queue.streamKey, int64(keep)).Result()
+	return int(dropped), err
+}
+
+// RemoveReady is not supported by stream queues and returns ErrNotSupported
+func (queue *streamQueue) RemoveReady(payload string, count int) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// ReturnRejected moves up to count rejected deliveries to the stream
+func (queue *streamQueue) ReturnRejected(count int) int {
+	if count == 0 {
+		return 0
+	}
+
+	return queue.returnRejected(count, queue.streamKey, "stream")
+}
+
+func (queue *streamQueue) ReturnAllRejected() int {
+	returned := queue.ReturnRejected(queue.RejectedCount())
+	queue.dropRejectedStamps()
+	return returned
+}
+
+// Reserve is not supported by stream queues and returns ErrNotSupported
+func (queue *streamQueue) Reserve(ctx context.Context) (Reservation, error) {
+	return Reservation{}, ErrNotSupported
+}
+
+// Commit is not supported by stream queues and returns ErrNotSupported
+func (queue *streamQueue) Commit(token string) error {
+	return ErrNotSupported
+}
+
+// Rollback is not supported by stream queues and returns ErrNotSupported
+func (queue *streamQueue) Rollback(token string) error {
+	return ErrNotSupported
+}
+
+// ReturnAllUnackedE moves all entries pending on this connection to the end of
+// the stream, so other consumers can read them right away instead of claiming
+// them once they were idle for long enough. Acking them afterwards fails
+func (queue *streamQueue) ReturnAllUnackedE() (int, error) {
+	return returnPendingScript.Run(context.Background(), queue.redisClient,
+		[]string{queue.streamKey},
+		streamGroup,
+		queue.connectionName,
+		queue.migrateChunkSize,
+	).Int()
+}
+
+// ReturnAllUnacked is like ReturnAllUnackedE, but panics on redis errors
+func (queue *streamQueue) ReturnAllUnacked() int {
+	returned, err := queue.ReturnAllUnackedE()
+	if err != nil {
+		log.Panicf("rmq redis error is not nil %s", err)
+	}
+	return returned
+}
+
+// ReturnAllUnackedToFront is not supported by stream queues and returns
+// ErrNotSupported, entries can only be added to the end of a stream
+func (queue *streamQueue) ReturnAllUnackedToFront() (int, error) {
+	return 0, ErrNotSupported
+}
+
+// ReturnExpiredLeases is not supported by stream queues and returns
+// ErrNotSupported, idle entries get claimed instead (see WithStreams)
+func (queue *streamQueue) ReturnExpiredLeases() (int, error) {
+	return 0, ErrNotSupported
+}
+
+// FlushDelayed is not supported by stream queues and returns ErrNotSupported
+func (queue *streamQueue) FlushDelayed() (int, error) {
+	return 0, ErrNotSupported
+}
+
+// ReturnRejectedWithDelay is not supported by stream queues and returns
+// ErrNotSupported
+func (queue *streamQueue) ReturnRejectedWithDelay(count int, delay time.Duration) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// ReturnRejectedSince moves the deliveries which got rejected after since to
+// the stream, see redisQueue.ReturnRejectedSince
+func (queue *streamQueue) ReturnRejectedSince(since time.Time) (int, error) {
+	return queue.returnRejectedSince(since, queue.streamKey, "stream")
+}
+
+// Close purges and closes the queue
+// Deprecated: Use ClosePurging instead
+func (queue *streamQueue) Close() bool {
+	return queue.ClosePurging()
+}
+
+// ClosePurging purges the stream and the rejected deliveries and removes the
+// queue from the set of open queues
+func (queue *streamQueue) ClosePurging() bool {
+	queue.markClosed()
+	queue.PurgeRejected()
+	queue.PurgeReady()
+	result := queue.redisClient.SRem(context.Background(), queue.keys.QueuesKey(), queue.name)
+	if redisErrIsNil(result) {
+		return false
+	}
+	return result.Val() > 0
+}
+
+// CloseE purges the rejected deliveries and the stream and removes the queue
+// from the set of open queues, see redisQueue.CloseE
+func (queue *streamQueue) CloseE() error {
+	if err := queue.purgeRejectedE(); err != nil {
+		return fmt.Errorf("rmq queue failed to close %s at purge-rejected: %w", queue, err)
+	}
+	if err := queue.redisClient.XTrim(context.Background(), queue.streamKey, 0).Err(); err != nil {
+		return fmt.Errorf("rmq queue failed to close %s at purge-ready: %w", queue, err)
+	}
+	return queue.closeRemove()
+}
+
+// CloseEmpty removes the queue from the set of open queues if its stream and
+// rejected list are empty, otherwise it returns ErrQueueNotEmpty. Unlike for
+// list queues the check isn't atomic with the removal
+func (queue *streamQueue) CloseEmpty() (bool, error) {
+	stat, err := queue.Stats()
+	if err != nil {
+		return false, err
+	}
+	if stat.ReadyCount > 0 || stat.UnackedCount() > 0 || stat.RejectedCount > 0 {
+		return false, ErrQueueNotEmpty
+	}
+
+	removed, err := queue.redisClient.SRem(context.Background(), queue.keys.QueuesKey(), queue.name).Result()
+	if err != nil {
+		return false, err
+	}
+	queue.markClosed()
+	return removed > 0, nil
+}
+
+// ReadyCount returns the number of entries which weren't read by any consumer yet
+func (queue *streamQueue) ReadyCount() int {
+	stat, err := queue.Stats()
+	if err != nil {
+		log.Panicf("rmq redis error is not nil %s", err)
+	}
+	return stat.ReadyCount
+}
+
+// ReadyBytes returns the approximate memory the stream uses in bytes, which
+// includes the entries which were read but not acked yet
+func (queue *streamQueue) ReadyBytes() (int64, error) {
+	return memoryUsage(queue.redisClient, queue.streamKey)
+}
+
+// UnackedCount returns the number of entries pending on this connection
+func (queue *streamQueue) UnackedCount() int {
+	stat, err := queue.Stats()
+	if err != nil {
+		log.Panicf("rmq redis error is not nil %s", err)
+	}
+	return stat.UnackedCount()
+}
+
+// Stats returns the counts of the queue in a single round trip. Entries
+// pending on other consumers count neither as ready nor as unacked
+func (queue *streamQueue) Stats() (QueueStat, error) {
+	ctx := context.Background()
+	pipe := queue.redisClient.Pipeline()
+	length := pipe.XLen(ctx, queue.streamKey)
+	pending := pipe.XPending(ctx, queue.streamKey, streamGroup)
+	rejectedCount := pipe.LLen(ctx, queue.rejectedKey)
+	consumers := pipe.SMembers(ctx, queue.consumersKey)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return QueueStat{}, err
+	}
+
+	pendingCount, unackedCount := int64(0), int64(0)
+	if summary := pending.Val(); summary != nil {
+		pendingCount = summary.Count
+		unackedCount = summary.Consumers[queue.connectionName]
+	}
+
+	stat := NewQueueStat(int(length.Val()-pendingCount), int(rejectedCount.Val()))
+	stat.Polls = queue.PollStats()
+	stat.connectionStats[queue.connectionName] = ConnectionStat{
+		active:       true,
+		unackedCount: int(unackedCount),
+		consumers:    consumers.Val(),
+	}
+	return stat, nil
+}
+
+func (queue *streamQueue) WaitUntilEmpty(ctx context.Context, pollInterval time.Duration) error {
+	return waitUntilEmpty(ctx, pollInterval, queue.Stats)
+}
+
+// streamDelivery is a delivery read from a stream queue
+type streamDelivery struct {
+	id         string
+	payload    string // as stored in the stream, possibly wrapped in an envelope
+	envelope   envelope
+	ctx        context.Context
+	queue      *streamQueue
+	counters   *consumerCounters // of the consumer which got the delivery, nil if none
+	inFlight   *inFlightLimiter  // released once the entry isn't pending anymore, nil if none
+	settled    int32             // set to 1 once inFlight was released
+	loopFailed func(err error)   // takes redis errors while the consume loop handles the delivery, nil afterwards
+}
+
+func (queue *streamQueue) newDelivery(message redis.XMessage) *streamDelivery {
+	payload, _ := message.Values[streamPayloadField].(string)
+	return &streamDelivery{
+		id:       message.ID,
+		payload:  payload,
+		envelope: queue.unwrap(payload),
+		queue:    queue,
+	}
+}
+
+func (delivery *streamDelivery) String() string {
+	return fmt.Sprintf("[%s %s %s]", delivery.payload, delivery.id, delivery.queue.streamKey)
+}
+
+func (delivery *streamDelivery) Payload() string {
+	return delivery.envelope.Payload
+}
+
+func (delivery *streamDelivery) EnvelopeVersion() int {
+	return delivery.envelope.Version
+}
+
+func (delivery *streamDelivery) Attempts() int {
+	return delivery.envelope.Attempts
+}
+
+func (delivery *streamDelivery) Headers() map[string]string {
+	return delivery.envelope.Headers
+}
+
+func (delivery *streamDelivery) Context() context.Context {
+	if delivery.ctx == nil {
+		return context.Background()
+	}
+	return delivery.ctx
+}
+
+func (delivery *streamDelivery) Ack() bool {
+	if !delivery.settle("", "") {
+		return false
+	}
+	delivery.counters.acked()
+	return true
+}
+
+// AckWith acks the delivery in a MULTI/EXEC transaction together with the
+// commands fn adds to the given pipeline, see wrapDelivery.AckWith. The
+// transaction watches the stream and only applies fn's commands if the entry
+// is still pending
+func (delivery *streamDelivery) AckWith(fn func(pipe redis.Pipeliner) error) error {
+	ctx := context.Background()
+	var err error
+	for i := 0; i < ackWithAttempts; i++ {
+		err = delivery.queue.redisClient.Watch(ctx, func(tx *redis.Tx) error {
+			pending, err := tx.XPendingExt(ctx, &redis.XPendingExtArgs{
+				Stream: delivery.queue.streamKey,
+				Group:  streamGroup,
+				Start:  delivery.id,
+				End:    delivery.id,
+				Count:  1,
+			}).Result()
+			if err != nil {
+				return err
+			}
+			if len(pending) == 0 {
+				return ErrNotUnacked
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if err := fn(pipe); err != nil {
+					return err
+				}
+
+				pipe.XAck(ctx, delivery.queue.streamKey, streamGroup, delivery.id)
+				pipe.XDel(ctx, delivery.queue.streamKey, delivery.id)
+				return nil
+			})
+			return err
+		}, delivery.queue.streamKey)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err == ErrNotUnacked {
+		delivery.release()
+	}
+	if err != nil {
+		return err
+	}
+
+	delivery.release()
+	delivery.counters.acked()
+	return nil
+}
+
+// AckAndPublish acks the delivery and publishes payload to next, which can be
+// a list or a stream queue, in a single script
+func (delivery *streamDelivery) AckAndPublish(next Queue, payload string) error {
+	settled := false
+	if target, ok := next.(*streamQueue); ok {
+		settled = delivery.settleTo(target.streamKey, "stream", target.wrap(payload))
+	} else if target, ok := pushTargetOf(next); ok {
+		settled = delivery.settleTo(target.readyKeyName(), "list", target.wrap(payload))
+	} else {
+		return ErrUnsupportedPushQueue
+	}
+
+	if !settled {
+		return ErrNotUnacked
+	}
+	delivery.counters.acked()
+	return nil
+}
+
+func (delivery *streamDelivery) Reject() bool {
+	return delivery.rejectTo("")
+}
+
+// rejectTo rejects the delivery to the rejected list with the given reason,
+// which may be empty, and counts it as rejected
+func (delivery *streamDelivery) rejectTo(reason string) bool {
+	if !delivery.settle(delivery.queue.rejectedKey, "list") {
+		return false
+	}
+	stampRejected(delivery.queue.redisClient, delivery.queue.rejectedAtKey, delivery.queue.rejectReasonsKey, delivery.payload, reason)
+	delivery.counters.rejected()
+	return true
+}
+
+// RejectWithReason rejects the delivery to the queue the reject router of its
+// queue picks for the reason, see wrapDelivery.RejectWithReason
+func (delivery *streamDelivery) RejectWithReason(reason string) bool {
+	return delivery.RejectWithReasonE(reason) == nil
+}
+
+// RejectWithReasonE is like RejectWithReason, but returns ErrNotUnacked if the
+// delivery wasn't unacked anymore and ErrUnsupportedPushQueue if the router
+// picked a queue deliveries can't be moved to
+func (delivery *streamDelivery) RejectWithReasonE(reason string) error {
+	var queue Queue
+	routed := false
+	if delivery.queue.rejectRouter != nil {
+		queue, routed = delivery.queue.rejectRouter(delivery, reason)
+	}
+	if !routed {
+		if !delivery.rejectTo(reason) {
+			return ErrNotUnacked
+		}
+		return nil
+	}
+
+	settled := false
+	if target, ok := queue.(*streamQueue); ok {
+		settled = delivery.settleTo(target.streamKey, "stream", target.wrap(delivery.Payload()))
+	} else if target, ok := pushTargetOf(queue); ok {
+		settled = delivery.settleTo(target.readyKeyName(), "list", target.wrap(delivery.Payload()))
+	} else {
+		return ErrUnsupportedPushQueue
+	}
+	if !settled {
+		return ErrNotUnacked
+	}
+	delivery.counters.rejected()
+	return nil
+}
+
+// Nack adds the delivery to the end of the stream again
+func (delivery *streamDelivery) Nack() bool {
+	return delivery.settle(delivery.queue.streamKey, "stream")
+}
+
+// Discard acks and deletes the entry without storing it anywhere
+func (delivery *streamDelivery) Discard() error {
+	if !delivery.settle("", "") {
+		return ErrNotUnacked
+	}
+	return nil
+}
+
+// Retry is not supported by stream queues and returns ErrNotSupported
+func (delivery *streamDelivery) Retry() error {
+	return ErrNotSupported
+}
+
+// ExtendLease is not supported by stream queues and returns ErrNotSupported
+func (delivery *streamDelivery) ExtendLease(duration time.Duration) error {
+	return ErrNotSupported
+}
+
+// Push is like wrapDelivery.Push
+func (delivery *streamDelivery) Push() bool {
+	if delivery.queue.pushDiscard {
+		return delivery.Ack()
+	}
+	if delivery.queue.pushKey == "" {
+		return delivery.Reject()
+	}
+	if !delivery.settle(delivery.queue.pushKey, "list") {
+		return false
+	}
+	delivery.counters.acked()
+	return true
+}
+
+// settle acks the delivery and moves its payload to key (unless key is
+// empty), which is a list or a stream depending on kind
+func (delivery *streamDelivery) settle(key, kind string) bool {
+	return delivery.settleTo(key, kind, delivery.payload)
+}
+
+// settleTo is like settle, but moves value instead of the payload
+func (delivery *streamDelivery) settleTo(key, kind, value string) bool {
+	settled, err := delivery.trySettleTo(key, kind, value)
+	if err != nil {
+		if delivery.loopFailed != nil {
+			delivery.loopFailed(err)
+			return false
+		}
+		log.Panicf("rmq redis error is not nil %s", err)
+	}
+	return settled
+}
+
+// trySettleTo is like settleTo, but returns redis errors
+func (delivery *streamDelivery) trySettleTo(key, kind, value string) (bool, error) {
+	keys := []string{delivery.queue.streamKey}
+	if key != "" {
+		keys = append(keys, key)
+	}
+
+	result := streamSettleScript.Run(context.Background(), delivery.queue.redisClient,
+		keys,
+		streamGroup,
+		delivery.id,
+		value,
+		kind,
+	)
+	if err := result.Err(); err != nil {
+		return false, err
+	}
+	delivery.release() // also if it wasn't pending anymore, it's not in flight either way
+	return result.Val() == int64(1), nil
+}
+
+// requeue adds the delivery to the end of the stream again like Nack, for the
+// library's own returns
+func (delivery *streamDelivery) requeue() error {
+	_, err := delivery.trySettleTo(delivery.queue.streamKey, "stream", delivery.payload)
+	return err
+}
+
+// release frees the in flight slot of the delivery
+func (delivery *streamDelivery) release() {
+	if atomic.CompareAndSwapInt32(&delivery.settled, 0, 1) {
+		delivery.inFlight.release()
+	}
+}
@@ -0,0 +1,159 @@
+package rmq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/adjust/gocheck"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestStreamsSuite(t *testing.T) {
+	TestingSuiteT(&StreamsSuite{}, t)
+}
+
+type StreamsSuite struct{}
+
+func (suite *StreamsSuite) TestStreamQueue(c *C) {
+	connection := OpenConnection("stream-conn", "tcp", "localhost:6379", 1)
+	queue, ok := connection.OpenQueue("stream-q", WithStreams(0)).(*streamQueue)
+	c.Assert(ok, Equals, true)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	c.Check(queue.Publish("stream-d1"), Equals, true)
+	c.Check(queue.PublishBatch([]string{"stream-d2", "stream-d3"}), IsNil)
+	c.Check(queue.PublishOnDelay("stream-d4", time.Now()), Equals, false)
+	c.Check(queue.ReadyCount(), Equals, 3)
+
+	consumer := NewTestConsumer("stream-cons")
+	consumer.AutoAck = false
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, ErrAlreadyConsuming)
+	queue.AddConsumer("stream-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 3)
+	c.Check(consumer.LastDeliveries[0].Payload(), Equals, "stream-d1")
+	c.Check(consumer.LastDeliveries[2].Payload(), Equals, "stream-d3")
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 3)
+
+	c.Check(consumer.LastDeliveries[0].Ack(), Equals, true)
+	c.Check(consumer.LastDeliveries[0].Ack(), Equals, false)
+	c.Check(consumer.LastDeliveries[1].Reject(), Equals, true)
+	c.Check(queue.RejectedCount(), Equals, 1)
+	c.Check(consumer.LastDeliveries[2].Nack(), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 4)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "stream-d3")
+	c.Check(consumer.LastDelivery.Retry(), Equals, ErrNotSupported)
+	c.Check(consumer.LastDelivery.Ack(), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	c.Check(queue.ReturnAllRejected(), Equals, 1)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 5)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "stream-d2")
+	c.Check(consumer.LastDelivery.Ack(), Equals, true)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *StreamsSuite) TestStreamQueueClaim(c *C) {
+	deadConnection := OpenConnection("stream-dead-conn", "tcp", "localhost:6379", 1)
+	deadQueue := deadConnection.OpenQueue("stream-claim-q", WithStreams(0)).(*streamQueue)
+	deadQueue.PurgeReady()
+	deadQueue.Publish("stream-claim-d1")
+
+	deadConsumer := NewTestConsumer("stream-dead-cons")
+	deadConsumer.AutoAck = false
+	deadQueue.StartConsuming(10, time.Millisecond)
+	deadQueue.AddConsumer("stream-dead-cons", deadConsumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(deadConsumer.LastDeliveries, HasLen, 1)
+	deadQueue.StopConsuming()
+	deadConnection.StopHeartbeat()
+
+	connection := OpenConnection("stream-claim-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("stream-claim-q", WithStreams(5*time.Millisecond)).(*streamQueue)
+	consumer := NewTestConsumer("stream-claim-cons")
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("stream-claim-cons", consumer)
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "stream-claim-d1")
+	c.Check(deadConsumer.LastDelivery.Ack(), Equals, false) // acked by the claiming consumer
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *StreamsSuite) TestStreamQueueReturnAllUnacked(c *C) {
+	connection := OpenConnection("stream-return-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("stream-return-q", WithStreams(0)).(*streamQueue)
+	queue.PurgeReady()
+	c.Check(queue.PublishBatch([]string{"stream-return-d1", "stream-return-d2"}), IsNil)
+
+	first, err := queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	_, err = queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(queue.UnackedCount(), Equals, 2)
+	c.Check(queue.ReturnAllUnacked(), Equals, 2)
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(first.Ack(), Equals, false) // returned under a new id
+
+	// a block below a millisecond doesn't block forever
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Microsecond)
+	delivery, err := queue.Pull(ctx)
+	cancel()
+	if err == nil {
+		c.Check(delivery.Payload(), Equals, "stream-return-d1")
+	}
+
+	// graceful shutdown returns the pending entries once it runs out of time
+	ctx, cancel = context.WithTimeout(context.Background(), 1100*time.Millisecond)
+	defer cancel()
+	c.Check(connection.GracefulShutdown(ctx), IsNil)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 2)
+
+	_, err = queue.ReturnExpiredLeases()
+	c.Check(err, Equals, ErrNotSupported)
+	_, err = queue.FlushDelayed()
+	c.Check(err, Equals, ErrNotSupported)
+	_, err = queue.ReturnAllUnackedToFront()
+	c.Check(err, Equals, ErrNotSupported)
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *StreamsSuite) TestStreamAckWith(c *C) {
+	connection := OpenConnection("stream-ack-with-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("stream-ack-with-q", WithStreams(0)).(*streamQueue)
+	queue.PurgeReady()
+	processedKey := "rmq::test::stream-ack-with::processed"
+	queue.redisClient.Del(context.Background(), processedKey)
+
+	c.Check(queue.Publish("stream-ack-with-d1"), Equals, true)
+	delivery, err := queue.Pull(context.Background())
+	c.Assert(err, IsNil)
+	process := func(pipe redis.Pipeliner) error {
+		pipe.SAdd(context.Background(), processedKey, delivery.Payload())
+		return nil
+	}
+	c.Check(delivery.AckWith(process), IsNil)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.redisClient.SCard(context.Background(), processedKey).Val(), Equals, int64(1))
+
+	// an entry which isn't pending anymore applies nothing
+	queue.redisClient.Del(context.Background(), processedKey)
+	c.Check(delivery.AckWith(process), Equals, ErrNotUnacked)
+	c.Check(queue.redisClient.SCard(context.Background(), processedKey).Val(), Equals, int64(0))
+
+	connection.StopHeartbeat()
+}
@@ -1,7 +1,8 @@
 package rmq
 
 type TestBatchConsumer struct {
-	LastBatch Deliveries
+	LastBatch            Deliveries
+	LastFlushedByTimeout bool
 
 	finish chan int
 }
@@ -19,6 +20,11 @@ func (consumer *TestBatchConsumer) Consume(batch Deliveries) {
 	// log.Printf("TestBatchConsumer.Consume() finished")
 }
 
+func (consumer *TestBatchConsumer) ConsumeBatch(batch Batch) {
+	consumer.LastFlushedByTimeout = batch.FlushedByTimeout()
+	consumer.Consume(batch.Deliveries())
+}
+
 func (consumer *TestBatchConsumer) Finish() {
 	// log.Printf("TestBatchConsumer.Finish()")
 	consumer.LastBatch = nil
@@ -0,0 +1,36 @@
+package rmq
+
+import (
+	"sync"
+	"time"
+)
+
+// TestClock is a Clock which only moves when told to
+type TestClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewTestClock(now time.Time) *TestClock {
+	return &TestClock{now: now}
+}
+
+func (clock *TestClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+// Set sets the current time of the clock
+func (clock *TestClock) Set(now time.Time) {
+	clock.mu.Lock()
+	clock.now = now
+	clock.mu.Unlock()
+}
+
+// Advance moves the clock forward by the given duration
+func (clock *TestClock) Advance(duration time.Duration) {
+	clock.mu.Lock()
+	clock.now = clock.now.Add(duration)
+	clock.mu.Unlock()
+}
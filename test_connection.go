@@ -1,6 +1,12 @@
 package rmq
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+)
 
 type TestConnection struct {
 	queues map[string]*TestQueue
@@ -12,7 +18,7 @@ func NewTestConnection() TestConnection {
 	}
 }
 
-func (connection TestConnection) OpenQueue(name string) Queue {
+func (connection TestConnection) OpenQueue(name string, options ...QueueOption) Queue {
 	if queue, ok := connection.queues[name]; ok {
 		return queue
 	}
@@ -22,10 +28,88 @@ func (connection TestConnection) OpenQueue(name string) Queue {
 	return queue
 }
 
+func (connection TestConnection) OpenTemporaryQueue(name string, ttl time.Duration) Queue {
+	return connection.OpenQueue(name)
+}
+
+func (connection TestConnection) OpenTenantQueue(tenant, name string, options ...QueueOption) Queue {
+	return connection.OpenQueue(TenantQueueName(tenant, name), options...)
+}
+
+// GracefulShutdown stops all queues of the connection from consuming
+func (connection TestConnection) GracefulShutdown(ctx context.Context) error {
+	for _, queue := range connection.queues {
+		queue.StopConsuming()
+	}
+	return nil
+}
+
 func (connection TestConnection) CollectStats(queueList []string) Stats {
 	return Stats{}
 }
 
+// Inspect returns the number of deliveries published to the given queue as
+// its ready count, or empty stats if the queue wasn't opened
+func (connection TestConnection) Inspect(queueName string) (QueueStats, error) {
+	queue, ok := connection.queues[queueName]
+	if !ok {
+		return QueueStats{}, nil
+	}
+	return QueueStats{queueName: NewQueueStat(len(queue.LastDeliveries), 0)}, nil
+}
+
+// QueuesMatching returns the names of the opened queues matching the given
+// glob style pattern, sorted by name
+func (connection TestConnection) QueuesMatching(pattern string) ([]string, error) {
+	names := []string{}
+	for name := range connection.queues {
+		if matched, _ := path.Match(pattern, name); matched {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// StatsMatching returns the stats of the opened queues matching the given
+// glob style pattern, like Inspect
+func (connection TestConnection) StatsMatching(pattern string) (QueueStats, error) {
+	names, _ := connection.QueuesMatching(pattern)
+	stats := QueueStats{}
+	for _, name := range names {
+		stats[name] = NewQueueStat(len(connection.queues[name].LastDeliveries), 0)
+	}
+	return stats, nil
+}
+
+// PeekUnacked returns no payloads, test queues don't have unacked deliveries
+func (connection TestConnection) PeekUnacked(connectionName, queueName string, limit int) ([]string, error) {
+	return []string{}, nil
+}
+
+// AckUnackedAt returns ErrDeliveryNotFound, test queues don't have unacked
+// deliveries
+func (connection TestConnection) AckUnackedAt(connectionName, queueName string, index int, payload string) error {
+	return ErrDeliveryNotFound
+}
+
+// CopyReady publishes up to count of the first deliveries published to the
+// queue with the given name to dst, returns the number of copied deliveries
+func (connection TestConnection) CopyReady(srcQueue string, dst Queue, count int) (int, error) {
+	queue, ok := connection.queues[srcQueue]
+	if !ok || count <= 0 {
+		return 0, nil
+	}
+	if count > len(queue.LastDeliveries) {
+		count = len(queue.LastDeliveries)
+	}
+	payloads := append([]string(nil), queue.LastDeliveries[:count]...)
+	if err := dst.PublishBatch(payloads); err != nil {
+		return 0, err
+	}
+	return len(payloads), nil
+}
+
 func (connection TestConnection) GetDeliveries(queueName string) []string {
 	queue, ok := connection.queues[queueName]
 	if !ok {
@@ -53,3 +137,12 @@ func (connection TestConnection) Reset() {
 func (connection TestConnection) GetOpenQueues() []string {
 	return []string{}
 }
+
+func (connection TestConnection) QueueExists(name string) (bool, error) {
+	_, ok := connection.queues[name]
+	return ok, nil
+}
+
+func (connection TestConnection) OpenedQueues() ([]string, error) {
+	return []string{}, nil
+}
@@ -18,7 +18,14 @@ func (suite *ConnectionSuite) TestConnection(c *C) {
 	c.Check(connection, Implements, &conn)
 	c.Check(connection.GetDelivery("things", 0), Equals, "rmq.TestConnection: delivery not found: things[0]")
 
+	exists, err := connection.QueueExists("things")
+	c.Check(err, IsNil)
+	c.Check(exists, Equals, false)
+
 	queue := connection.OpenQueue("things")
+	exists, err = connection.QueueExists("things")
+	c.Check(err, IsNil)
+	c.Check(exists, Equals, true)
 	c.Check(connection.GetDelivery("things", -1), Equals, "rmq.TestConnection: delivery not found: things[-1]")
 	c.Check(connection.GetDelivery("things", 0), Equals, "rmq.TestConnection: delivery not found: things[0]")
 	c.Check(connection.GetDelivery("things", 1), Equals, "rmq.TestConnection: delivery not found: things[1]")
@@ -40,3 +47,30 @@ func (suite *ConnectionSuite) TestConnection(c *C) {
 	c.Check(connection.GetDelivery("things", 0), Equals, "blab")
 	c.Check(connection.GetDelivery("things", 1), Equals, "rmq.TestConnection: delivery not found: things[1]")
 }
+
+func (suite *ConnectionSuite) TestConnectionMatching(c *C) {
+	connection := NewTestConnection()
+	emails := connection.OpenQueue("email.welcome")
+	connection.OpenQueue("email.reset")
+	connection.OpenQueue("sms.welcome")
+	c.Check(emails.Publish("d1"), Equals, true)
+	c.Check(emails.Publish("d2"), Equals, true)
+
+	names, err := connection.QueuesMatching("email.*")
+	c.Check(err, IsNil)
+	c.Check(names, DeepEquals, []string{"email.reset", "email.welcome"})
+	stats, err := connection.StatsMatching("email.*")
+	c.Check(err, IsNil)
+	c.Check(stats, HasLen, 2)
+	c.Check(stats["email.welcome"].ReadyCount, Equals, 2)
+
+	unacked, err := connection.PeekUnacked("conn", "email.welcome", 10)
+	c.Check(err, IsNil)
+	c.Check(unacked, HasLen, 0)
+	c.Check(connection.AckUnackedAt("conn", "email.welcome", 0, "d1"), Equals, ErrDeliveryNotFound)
+
+	copied, err := connection.CopyReady("email.welcome", connection.OpenQueue("email.copy"), 1)
+	c.Check(err, IsNil)
+	c.Check(copied, Equals, 1)
+	c.Check(connection.GetDeliveries("email.copy"), DeepEquals, []string{"d1"})
+}
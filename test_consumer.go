@@ -1,6 +1,7 @@
 package rmq
 
 import (
+	"sync"
 	"time"
 )
 
@@ -10,9 +11,12 @@ type TestConsumer struct {
 	AutoFinish    bool
 	SleepDuration time.Duration
 
+	// LastDelivery and LastDeliveries are written while consuming, read them
+	// with Last and Deliveries unless the queue stopped consuming
 	LastDelivery   Delivery
 	LastDeliveries []Delivery
 
+	mu     sync.Mutex // guards LastDelivery and LastDeliveries
 	finish chan int
 }
 
@@ -30,8 +34,10 @@ func (consumer *TestConsumer) String() string {
 }
 
 func (consumer *TestConsumer) Consume(delivery Delivery) {
+	consumer.mu.Lock()
 	consumer.LastDelivery = delivery
 	consumer.LastDeliveries = append(consumer.LastDeliveries, delivery)
+	consumer.mu.Unlock()
 
 	if consumer.SleepDuration > 0 {
 		time.Sleep(consumer.SleepDuration)
@@ -44,6 +50,20 @@ func (consumer *TestConsumer) Consume(delivery Delivery) {
 	}
 }
 
+// Last returns the delivery consumed last, nil if none
+func (consumer *TestConsumer) Last() Delivery {
+	consumer.mu.Lock()
+	defer consumer.mu.Unlock()
+	return consumer.LastDelivery
+}
+
+// Deliveries returns a copy of the deliveries consumed so far
+func (consumer *TestConsumer) Deliveries() []Delivery {
+	consumer.mu.Lock()
+	defer consumer.mu.Unlock()
+	return append([]Delivery(nil), consumer.LastDeliveries...)
+}
+
 func (consumer *TestConsumer) Finish() {
 	consumer.finish <- 1
 }
@@ -1,13 +1,20 @@
 package rmq
 
 import (
+	"context"
 	"encoding/json"
 	"time"
+
+	"github.com/go-redis/redis/v8"
 )
 
 type TestDelivery struct {
-	State   State
-	payload string
+	State        State
+	RejectReason string
+	Ctx          context.Context   // returned by Context, defaults to context.Background()
+	HeaderMap    map[string]string // returned by Headers
+	AttemptCount int               // returned by Attempts
+	payload      string
 }
 
 func NewTestDelivery(content interface{}) *TestDelivery {
@@ -33,6 +40,25 @@ func (delivery *TestDelivery) Payload() string {
 	return delivery.payload
 }
 
+func (delivery *TestDelivery) EnvelopeVersion() int {
+	return 0
+}
+
+func (delivery *TestDelivery) Attempts() int {
+	return delivery.AttemptCount
+}
+
+func (delivery *TestDelivery) Headers() map[string]string {
+	return delivery.HeaderMap
+}
+
+func (delivery *TestDelivery) Context() context.Context {
+	if delivery.Ctx == nil {
+		return context.Background()
+	}
+	return delivery.Ctx
+}
+
 func (delivery *TestDelivery) Ack() bool {
 	if delivery.State == Unacked {
 		delivery.State = Acked
@@ -41,6 +67,23 @@ func (delivery *TestDelivery) Ack() bool {
 	return false
 }
 
+// AckWith acks the delivery without calling fn
+func (delivery *TestDelivery) AckWith(fn func(pipe redis.Pipeliner) error) error {
+	if !delivery.Ack() {
+		return ErrNotUnacked
+	}
+	return nil
+}
+
+// AckAndPublish acks the delivery and publishes payload to next
+func (delivery *TestDelivery) AckAndPublish(next Queue, payload string) error {
+	if !delivery.Ack() {
+		return ErrNotUnacked
+	}
+	next.Publish(payload)
+	return nil
+}
+
 func (delivery *TestDelivery) Reject() bool {
 	if delivery.State == Unacked {
 		delivery.State = Rejected
@@ -49,6 +92,56 @@ func (delivery *TestDelivery) Reject() bool {
 	return false
 }
 
+func (delivery *TestDelivery) RejectWithReason(reason string) bool {
+	if delivery.State == Unacked {
+		delivery.State = Rejected
+		delivery.RejectReason = reason
+		return true
+	}
+	return false
+}
+
+func (delivery *TestDelivery) RejectWithReasonE(reason string) error {
+	if !delivery.RejectWithReason(reason) {
+		return ErrNotUnacked
+	}
+	return nil
+}
+
+func (delivery *TestDelivery) Nack() bool {
+	if delivery.State == Unacked {
+		delivery.State = Nacked
+		return true
+	}
+	return false
+}
+
+// Discard marks the delivery as Discarded
+func (delivery *TestDelivery) Discard() error {
+	if delivery.State == Unacked {
+		delivery.State = Discarded
+		return nil
+	}
+	return ErrNotUnacked
+}
+
+// Retry marks the delivery as Delayed, as if it was retried with a backoff
+func (delivery *TestDelivery) Retry() error {
+	if delivery.State == Unacked {
+		delivery.State = Delayed
+		return nil
+	}
+	return ErrNotUnacked
+}
+
+// ExtendLease succeeds as long as the delivery is unacked
+func (delivery *TestDelivery) ExtendLease(duration time.Duration) error {
+	if delivery.State == Unacked {
+		return nil
+	}
+	return ErrNotUnacked
+}
+
 func (delivery *TestDelivery) Push() bool {
 	if delivery.State == Unacked {
 		delivery.State = Pushed
@@ -41,3 +41,34 @@ func (suite *DeliverySuite) TestDeliveryReject(c *C) {
 	c.Check(delivery.Ack(), Equals, false)
 	c.Check(delivery.State, Equals, Rejected)
 }
+
+func (suite *DeliverySuite) TestDeliveryNack(c *C) {
+	delivery := NewTestDelivery("p")
+	c.Check(delivery.State, Equals, Unacked)
+	c.Check(delivery.Nack(), Equals, true)
+	c.Check(delivery.State, Equals, Nacked)
+
+	c.Check(delivery.Nack(), Equals, false)
+	c.Check(delivery.Ack(), Equals, false)
+	c.Check(delivery.State, Equals, Nacked)
+}
+
+func (suite *DeliverySuite) TestDeliveryDiscard(c *C) {
+	delivery := NewTestDelivery("p")
+	c.Check(delivery.Discard(), IsNil)
+	c.Check(delivery.State, Equals, Discarded)
+	c.Check(delivery.State.String(), Equals, "Discarded")
+
+	c.Check(delivery.Discard(), Equals, ErrNotUnacked)
+	c.Check(delivery.Ack(), Equals, false)
+	c.Check(delivery.State, Equals, Discarded)
+}
+
+func (suite *DeliverySuite) TestDeliveryRejectWithReason(c *C) {
+	delivery := NewTestDelivery("p")
+	c.Check(delivery.RejectWithReason("invalid"), Equals, true)
+	c.Check(delivery.State, Equals, Rejected)
+	c.Check(delivery.RejectReason, Equals, "invalid")
+	c.Check(delivery.RejectWithReason("again"), Equals, false)
+	c.Check(delivery.RejectReason, Equals, "invalid")
+}
@@ -1,10 +1,17 @@
 package rmq
 
-import "time"
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
 
 type TestQueue struct {
 	name           string
 	LastDeliveries []string
+	uniqueTags     map[string]bool // tags added by AddConsumerUnique
+	discard        bool            // record nothing, see DiscardQueue
 }
 
 func NewTestQueue(name string) *TestQueue {
@@ -17,43 +24,178 @@ func (queue *TestQueue) String() string {
 	return queue.name
 }
 
+// record appends the published payloads to LastDeliveries
+func (queue *TestQueue) record(payloads ...string) {
+	if queue.discard {
+		return
+	}
+	queue.LastDeliveries = append(queue.LastDeliveries, payloads...)
+}
+
 func (queue *TestQueue) Publish(payload string) bool {
-	queue.LastDeliveries = append(queue.LastDeliveries, payload)
+	queue.record(payload)
 	return true
 }
 
+func (queue *TestQueue) PublishE(payload string) error {
+	queue.Publish(payload)
+	return nil
+}
+
+// PublishN records the payload and returns the number of LastDeliveries
+func (queue *TestQueue) PublishN(payload string) (int64, error) {
+	queue.Publish(payload)
+	return int64(len(queue.LastDeliveries)), nil
+}
+
 func (queue *TestQueue) PublishBytes(payload []byte) bool {
 	return queue.Publish(string(payload))
 }
 
+func (queue *TestQueue) PublishBatch(payloads []string) error {
+	queue.record(payloads...)
+	return nil
+}
+
+// PublishPipe records the payload without using the pipeline
+func (queue *TestQueue) PublishPipe(pipe redis.Pipeliner, payload string) {
+	queue.record(payload)
+}
+
+func (queue *TestQueue) PublishDurable(ctx context.Context, payload string) error {
+	queue.record(payload)
+	return nil
+}
+
 func (queue *TestQueue) PublishOnDelay(payload string, delayedAt time.Time) bool {
-	queue.LastDeliveries = append(queue.LastDeliveries, payload)
+	queue.record(payload)
 	return true
 }
 
+func (queue *TestQueue) PublishWithHeaders(payload string, headers map[string]string) error {
+	queue.record(payload)
+	return nil
+}
+
+// PublishAndAwaitReply records the payload, test queues never get replies
+func (queue *TestQueue) PublishAndAwaitReply(ctx context.Context, payload string, replyQueue Queue, timeout time.Duration) (string, error) {
+	queue.record(payload)
+	return "", ErrNoReply
+}
+
+// PublishBlocking records the payload without blocking
+func (queue *TestQueue) PublishBlocking(ctx context.Context, payload string) error {
+	queue.record(payload)
+	return nil
+}
+
+// PublishIndexed records the payload, the index keys are ignored
+func (queue *TestQueue) PublishIndexed(payload string, indexKeys map[string]string) error {
+	queue.record(payload)
+	return nil
+}
+
+// FindByIndex never finds anything
+func (queue *TestQueue) FindByIndex(key, value string) ([]string, error) {
+	return []string{}, nil
+}
+
+func (queue *TestQueue) PublishOnDelayE(payload string, delayedAt time.Time) error {
+	queue.PublishOnDelay(payload, delayedAt)
+	return nil
+}
+
+// PublishOnDelayWithMode records the payload regardless of mode
+func (queue *TestQueue) PublishOnDelayWithMode(payload string, delayedAt time.Time, mode DelayMode) (bool, error) {
+	return queue.PublishOnDelay(payload, delayedAt), nil
+}
+
 func (queue *TestQueue) PublishBytesOnDelay(payload []byte, delayedAt time.Time) bool {
 	return queue.PublishOnDelay(string(payload), delayedAt)
 }
 
+func (queue *TestQueue) PublishBatchOnDelay(items []DelayedItem) (int, error) {
+	for _, item := range items {
+		queue.PublishOnDelay(item.Payload, item.At)
+	}
+	return len(items), nil
+}
+
 func (queue *TestQueue) PublishRejected(payload string) bool {
 	return queue.Publish(string(payload))
 }
 
-func (queue *TestQueue) SetPushQueue(pushQueue Queue) {
+func (queue *TestQueue) AppendRejected(payload string) error {
+	queue.Publish(payload)
+	return nil
 }
 
-func (queue *TestQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) bool {
-	return true
+func (queue *TestQueue) SetPushQueue(pushQueue Queue) error {
+	return nil
+}
+
+func (queue *TestQueue) SetRejectRouter(router RejectRouter) {
+}
+
+func (queue *TestQueue) SetRetryPolicy(policy RetryPolicy) {
+}
+
+func (queue *TestQueue) SetPayloadValidator(validator func(payload []byte) error) {
+}
+
+func (queue *TestQueue) SetWatermarks(high, low int, callback func(queue string, count int, crossed Watermark)) {
+}
+
+func (queue *TestQueue) OnDrained(callback func()) {
+}
+
+func (queue *TestQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) error {
+	return nil
 }
 
 func (queue *TestQueue) StopConsuming() bool {
 	return true
 }
 
+func (queue *TestQueue) ConsumeErr() error {
+	return nil
+}
+
+func (queue *TestQueue) ReconfigureConsuming(prefetchLimit int, pollDuration time.Duration) error {
+	return nil
+}
+
+// ConsumeN consumes nothing, test queues have no deliveries
+func (queue *TestQueue) ConsumeN(ctx context.Context, n int, consumer Consumer) (int, error) {
+	return 0, nil
+}
+
+// ConsumeWithContext blocks until ctx is done without consuming anything
+func (queue *TestQueue) ConsumeWithContext(ctx context.Context, prefetchLimit int, pollDuration time.Duration, consumer Consumer) error {
+	<-ctx.Done()
+	return nil
+}
+
 func (queue *TestQueue) AddConsumer(tag string, consumer Consumer) string {
 	return ""
 }
 
+// AddConsumerUnique returns ErrDuplicateConsumerTag if the tag was already
+// added since the last Reset
+func (queue *TestQueue) AddConsumerUnique(tag string, consumer Consumer) (string, error) {
+	if queue.uniqueTags[tag] {
+		return "", ErrDuplicateConsumerTag
+	}
+	queue.uniqueTags[tag] = true
+	return "", nil
+}
+
+func (queue *TestQueue) AddConsumerWithHandle(tag string, consumer Consumer) *ConsumerHandle {
+	handle := newConsumerHandle("", nil)
+	close(handle.done)
+	return handle
+}
+
 func (queue *TestQueue) AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) string {
 	return ""
 }
@@ -62,34 +204,162 @@ func (queue *TestQueue) AddBatchConsumerWithTimeout(tag string, batchSize int, t
 	return ""
 }
 
+func (queue *TestQueue) AddFairConsumers(tag string, consumers []Consumer) []string {
+	return make([]string, len(consumers))
+}
+
+func (queue *TestQueue) AddPartitionedConsumers(tag string, count int, keyFn func(payload string) string, consumers []Consumer) []string {
+	return make([]string, count)
+}
+
+func (queue *TestQueue) AddConsumerFunc(tag string, concurrency int, fn func(delivery Delivery)) []string {
+	return make([]string, concurrency)
+}
+
+func (queue *TestQueue) PollStats() PollStat {
+	return PollStat{}
+}
+
+func (queue *TestQueue) ConsumedCount() int64 {
+	return 0
+}
+
+func (queue *TestQueue) LastBatchSizes() []int {
+	return []int{}
+}
+
+func (queue *TestQueue) Pull(ctx context.Context) (Delivery, error) {
+	return nil, ErrNoDelivery
+}
+
+func (queue *TestQueue) PullBatch(ctx context.Context, max int) ([]Delivery, error) {
+	return nil, ErrNoDelivery
+}
+
+func (queue *TestQueue) Reserve(ctx context.Context) (Reservation, error) {
+	return Reservation{}, ErrNoDelivery
+}
+
+// Commit fails with ErrNotUnacked, test queues have no reservations
+func (queue *TestQueue) Commit(token string) error {
+	return ErrNotUnacked
+}
+
+// Rollback fails with ErrNotUnacked, test queues have no reservations
+func (queue *TestQueue) Rollback(token string) error {
+	return ErrNotUnacked
+}
+
 func (queue *TestQueue) ReturnRejected(count int) int {
 	return 0
 }
 
+// TrimReady drops all but the last keep of LastDeliveries
+func (queue *TestQueue) TrimReady(keep int) (int, error) {
+	if keep < 0 {
+		keep = 0
+	}
+	if len(queue.LastDeliveries) <= keep {
+		return 0, nil
+	}
+	dropped := len(queue.LastDeliveries) - keep
+	queue.LastDeliveries = queue.LastDeliveries[dropped:]
+	return dropped, nil
+}
+
+func (queue *TestQueue) ReturnRejectedSince(since time.Time) (int, error) {
+	return 0, nil
+}
+
+func (queue *TestQueue) RejectedReasons(count int) ([]RejectedReason, error) {
+	return nil, nil
+}
+
+func (queue *TestQueue) ReturnRejectedWithDelay(count int, delay time.Duration) (int, error) {
+	return 0, nil
+}
+
 func (queue *TestQueue) ReturnAllRejected() int {
 	return 0
 }
 
+func (queue *TestQueue) ReturnExpiredLeases() (int, error) {
+	return 0, nil
+}
+
 func (queue *TestQueue) PurgeReady() int {
 	return 0
 }
 
+func (queue *TestQueue) ReturnAllUnackedToFront() (int, error) {
+	return 0, nil
+}
+
+// RemoveReady removes up to count recorded deliveries with the given payload,
+// all of them if count is zero
+func (queue *TestQueue) RemoveReady(payload string, count int) (int, error) {
+	if count < 0 {
+		count = -count
+	}
+
+	if len(queue.LastDeliveries) == 0 {
+		return 0, nil
+	}
+	removed := 0
+	kept := queue.LastDeliveries[:0]
+	for _, delivery := range queue.LastDeliveries {
+		if delivery == payload && (count == 0 || removed < count) {
+			removed++
+			continue
+		}
+		kept = append(kept, delivery)
+	}
+	queue.LastDeliveries = kept
+	return removed, nil
+}
+
 func (queue *TestQueue) PurgeRejected() int {
 	return 0
 }
 
+func (queue *TestQueue) FlushDelayed() (int, error) {
+	return 0, nil
+}
+
+func (queue *TestQueue) CloseE() error {
+	return nil
+}
+
 func (queue *TestQueue) Close() bool {
 	return false
 }
 
+func (queue *TestQueue) ClosePurging() bool {
+	return false
+}
+
+func (queue *TestQueue) CloseEmpty() (bool, error) {
+	return false, nil
+}
+
 func (queue *TestQueue) Reset() {
 	queue.LastDeliveries = []string{}
+	queue.uniqueTags = map[string]bool{}
 }
 
 func (queue *TestQueue) ReadyCount() int {
 	return 0
 }
 
+// ReadyBytes returns the total length of LastDeliveries
+func (queue *TestQueue) ReadyBytes() (int64, error) {
+	bytes := int64(0)
+	for _, payload := range queue.LastDeliveries {
+		bytes += int64(len(payload))
+	}
+	return bytes, nil
+}
+
 func (queue *TestQueue) RejectedCount() int {
 	return 0
 }
@@ -97,3 +367,19 @@ func (queue *TestQueue) RejectedCount() int {
 func (queue *TestQueue) UnackedCount() int {
 	return 0
 }
+
+func (queue *TestQueue) Stats() (QueueStat, error) {
+	return NewQueueStat(0, 0), nil
+}
+
+func (queue *TestQueue) StatsHistory() []TimestampedStats {
+	return nil
+}
+
+func (queue *TestQueue) WaitUntilEmpty(ctx context.Context, pollInterval time.Duration) error {
+	return nil
+}
+
+func (queue *TestQueue) ConsumerStats(name string) (ConsumerStat, bool) {
+	return ConsumerStat{}, false
+}